@@ -0,0 +1,74 @@
+package v1
+
+import (
+	"gin-photo-storage/constant"
+	"gin-photo-storage/models"
+	"gin-photo-storage/utils"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// Get the upload jobs which have run out of attempts, the latest ones first, with the numbers of jobs in the queue.
+func GetFailedUploadJobs(context *gin.Context) {
+	responseCode := constant.INTERNAL_SERVER_ERROR
+	data := make(map[string]interface{})
+	offset := context.GetInt("offset")
+
+	jobs, err := utils.GetFailedUploadJobs(offset, constant.PAGE_SIZE)
+	if err == nil {
+		var stats utils.UploadQueueStats
+		if stats, err = utils.GetUploadQueueStats(); err == nil {
+			data["jobs"] = jobs
+			data["stats"] = stats
+			responseCode = constant.ADMIN_FAILED_JOBS_GET_SUCCESS
+		}
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"code": responseCode,
+		"data": data,
+		"msg": constant.GetMessage(responseCode),
+	})
+}
+
+// Rebuild the photo index from the db in background, one reindex runs at a time.
+func StartReindex(context *gin.Context) {
+	responseCode := constant.ADMIN_REINDEX_STARTED
+	data := make(map[string]interface{})
+
+	report, err := models.StartReindex()
+	if err == models.ReindexRunningError {
+		responseCode = constant.ADMIN_REINDEX_RUNNING
+	} else if err != nil {
+		responseCode = constant.INTERNAL_SERVER_ERROR
+	} else {
+		data["report"] = report
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"code": responseCode,
+		"data": data,
+		"msg": constant.GetMessage(responseCode),
+	})
+}
+
+// Get the progress of the running or the last reindex.
+func GetReindexProgress(context *gin.Context) {
+	responseCode := constant.ADMIN_REINDEX_GET_SUCCESS
+	data := make(map[string]interface{})
+
+	report, err := models.GetReindexReport()
+	if err == models.NoReindexError {
+		responseCode = constant.ADMIN_REINDEX_NOT_EXIST
+	} else if err != nil {
+		responseCode = constant.INTERNAL_SERVER_ERROR
+	} else {
+		data["report"] = report
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"code": responseCode,
+		"data": data,
+		"msg": constant.GetMessage(responseCode),
+	})
+}
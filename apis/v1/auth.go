@@ -9,6 +9,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"net/http"
+	"strconv"
 )
 
 // @Summary Add a new auth.
@@ -107,6 +108,61 @@ func CheckAuth(context *gin.Context) {
 	})
 }
 
+// Update the privacy setting of the login user, buckets without their own setting follow it.
+// "privacy" is one of keep, strip_original & strip_shared, "keep_exif" tells if the stripped location
+// is still kept in the db. A missing field is left unchanged.
+func UpdateAuthPrivacy(context *gin.Context) {
+	userName := context.GetString("user_name")
+	privacy := models.PrivacyMode(context.PostForm("privacy"))
+	var keepExif *bool
+	if value, ok := context.GetPostForm("keep_exif"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "UpdateAuthPrivacy()"))
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"code": constant.INVALID_PARAMS,
+				"data": make(map[string]string),
+				"msg":  constant.GetMessage(constant.INVALID_PARAMS),
+			})
+			return
+		}
+		keepExif = &parsed
+	}
+
+	validCheck := validation.Validation{}
+	validCheck.Required(userName, "user_name").Message("Must have user name")
+	if !privacy.Valid() {
+		validCheck.SetError("privacy", "Privacy must be keep, strip_original or strip_shared")
+	}
+
+	responseCode := constant.INVALID_PARAMS
+	data := make(map[string]interface{})
+	if !validCheck.HasErrors() {
+		if auth, err := models.UpdateAuthPrivacy(userName, privacy, keepExif); err != nil {
+			if err == models.NoSuchAuthError {
+				responseCode = constant.USER_AUTH_ERROR
+			} else {
+				responseCode = constant.INTERNAL_SERVER_ERROR
+			}
+		} else {
+			responseCode = constant.USER_PRIVACY_UPDATE_SUCCESS
+			data["privacy"] = auth.Privacy
+			data["keep_exif"] = auth.KeepExif
+		}
+	} else {
+		for _, err := range validCheck.Errors {
+			utils.AppLogger.Info(err.Message, zap.String("service", "UpdateAuthPrivacy()"))
+		}
+	}
+
+	data["user_name"] = userName
+	context.JSON(http.StatusOK, gin.H{
+		"code": responseCode,
+		"data": data,
+		"msg": constant.GetMessage(responseCode),
+	})
+}
+
 //func SignOut(context *gin.Context) {
 //	userName, _ := context.Get("user_name")
 //	data := make(map[string]string)
@@ -31,6 +31,9 @@ func AddBucket(context *gin.Context) {
 	validCheck.Required(bucketToAdd.AuthID, "auth_id").Message("Must have auth id")
 	validCheck.Required(bucketToAdd.Name, "bucket_name").Message("Must have bucket name")
 	validCheck.MaxSize(bucketToAdd.Name, 64, "bucket_name").Message("Bucket name length can not exceed 64")
+	if !bucketToAdd.Privacy.Valid() {
+		validCheck.SetError("privacy", "Privacy must be keep, strip_original or strip_shared")
+	}
 
 	if !validCheck.HasErrors() {
 		if err := models.AddBucket(&bucketToAdd); err != nil {
@@ -123,6 +126,9 @@ func UpdateBucket(context *gin.Context) {
 	validCheck := validation.Validation{}
 	validCheck.Required(bucketToUpdate.ID, "bucket_id").Message("Must have bucket id")
 	validCheck.MaxSize(bucketToUpdate.Name, 64, "bucket_name").Message("Bucket name length can not exceed 64")
+	if !bucketToUpdate.Privacy.Valid() {
+		validCheck.SetError("privacy", "Privacy must be keep, strip_original or strip_shared")
+	}
 
 	data := make(map[string]interface{})
 	if !validCheck.HasErrors() {
@@ -240,4 +246,55 @@ func GetBucketByAuthID(context *gin.Context) {
 		"data": data,
 		"msg":  constant.GetMessage(responseCode),
 	})
-}
\ No newline at end of file
+}
+
+// Get the storage usage of a user against its quota,
+// & the usage of one of its buckets if "bucket_id" is given.
+func GetUsage(context *gin.Context) {
+	responseCode := constant.INVALID_PARAMS
+	authID, authErr := strconv.Atoi(context.Query("auth_id"))
+	bucketID, bucketErr := strconv.Atoi(context.DefaultQuery("bucket_id", "0"))
+	if authErr != nil || bucketErr != nil {
+		utils.AppLogger.Info(constant.GetMessage(responseCode), zap.String("service", "GetUsage()"))
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"code": responseCode,
+			"data": make(map[string]string),
+			"msg":  constant.GetMessage(responseCode),
+		})
+		return
+	}
+	if !checkAuthID(context, authID, constant.USER_ACCESS_DENIED, "GetUsage()") {
+		return
+	}
+
+	validCheck := validation.Validation{}
+	validCheck.Min(authID, 1, "auth_id").Message("Auth id should be positive")
+	validCheck.Min(bucketID, 0, "bucket_id").Message("Bucket id must be >= 0")
+
+	data := make(map[string]interface{})
+	if !validCheck.HasErrors() {
+		if userUsage, bucketUsage, err := models.GetUsage(uint(authID), uint(bucketID)); err != nil {
+			if err == models.NoSuchBucketError {
+				responseCode = constant.BUCKET_NOT_EXIST
+			} else {
+				responseCode = constant.INTERNAL_SERVER_ERROR
+			}
+		} else {
+			responseCode = constant.BUCKET_USAGE_GET_SUCCESS
+			data["user"] = userUsage
+			if bucketUsage != nil {
+				data["bucket"] = bucketUsage
+			}
+		}
+	} else {
+		for _, err := range validCheck.Errors {
+			utils.AppLogger.Info(err.Message, zap.String("service", "GetUsage()"))
+		}
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"code": responseCode,
+		"data": data,
+		"msg":  constant.GetMessage(responseCode),
+	})
+}
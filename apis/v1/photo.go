@@ -1,23 +1,46 @@
 package v1
 
 import (
+	"fmt"
 	"gin-photo-storage/constant"
 	"gin-photo-storage/models"
+	"gin-photo-storage/search"
 	"gin-photo-storage/utils"
 	"github.com/astaxie/beego/validation"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"go.uber.org/zap"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// Add a new photo
+// Add a new photo.
+// If "direct" is true, no file is posted, instead a presigned url is returned
+// and the client uploads the file to the storage by itself, then confirms the upload.
+// If "duplicate" is "reject" or "flag", a photo looking like an existing one of the user
+// is rejected or flagged with "duplicate_of", it's not supported by direct uploads.
 func AddPhoto(context *gin.Context) {
 	responseCode := constant.INVALID_PARAMS
 
-	photoFile, fileErr := context.FormFile("photo")
+	direct := context.PostForm("direct") == "true"
+	policy := models.DuplicatePolicy(context.PostForm("duplicate"))
+	var photoFile *multipart.FileHeader
+	var fileErr error
+	var size int64
+	var checksum string
+	if direct {
+		size, fileErr = strconv.ParseInt(context.PostForm("size"), 10, 64)
+		checksum = context.PostForm("checksum")
+	} else {
+		photoFile, fileErr = context.FormFile("photo")
+	}
 	if fileErr != nil {
 		//log.Println(fileErr)
 		utils.AppLogger.Info(fileErr.Error(), zap.String("service", "AddPhoto()"))
@@ -40,6 +63,16 @@ func AddPhoto(context *gin.Context) {
 	validCheck.Required(photo.BucketID, "bucket_id").Message("Must have bucket id")
 	validCheck.Required(photo.Name, "photo_name").Message("Must have photo name")
 	validCheck.MaxSize(photo.Name, 255, "photo_name").Message("Photo name len must not exceed 255")
+	if direct {
+		validCheck.Min(int(size), 1, "size").Message("Photo size should be positive")
+		validCheck.Match(checksum, regexp.MustCompile("^[0-9a-fA-F]{64}$"), "checksum").Message("Checksum must be a SHA-256 hex string")
+		if policy != models.DuplicateAllow {
+			validCheck.SetError("duplicate", "Duplicate policy is not supported by direct uploads")
+		}
+	}
+	if !policy.Valid() {
+		validCheck.SetError("duplicate", "Duplicate policy must be reject or flag")
+	}
 
 	data := make(map[string]interface{})
 	photoToAdd := &models.Photo{BucketID: photo.BucketID, AuthID: photo.AuthID,
@@ -47,16 +80,48 @@ func AddPhoto(context *gin.Context) {
 		Tag:strings.Join(photo.Tags, ";")}
 
 	if !validCheck.HasErrors() {
-		if photoToAdd, uploadID, err := models.AddPhoto(photoToAdd, photoFile); err != nil {
+		var uploadID, uploadUrl string
+		var err error
+		var file multipart.File
+		var addedPhoto *models.Photo
+		if direct {
+			addedPhoto, uploadID, uploadUrl, err = models.AddPhotoDirect(photoToAdd, size, checksum)
+		} else if file, err = photoFile.Open(); err == nil {
+			addedPhoto, uploadID, err = models.AddPhoto(photoToAdd, file, photoFile.Size, policy)
+		} else {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhoto()"))
+			err = models.PhotoFileBrokenError
+		}
+		if err != nil {
 			if err == models.PhotoExistsError {
 				responseCode = constant.PHOTO_ALREADY_EXIST
+			} else if err == models.QuotaExceededError {
+				responseCode = constant.PHOTO_QUOTA_EXCEEDED
+			} else if err == models.PhotoContentError {
+				responseCode = constant.PHOTO_CONTENT_REJECTED
+			} else if err == models.UploadTooLargeError {
+				responseCode = constant.PHOTO_TOO_LARGE
+			} else if err == models.DuplicatePhotoError {
+				responseCode = constant.PHOTO_DUPLICATED
+				data["duplicate_of"] = addedPhoto.ID	// the existing photo
+			} else if err == models.PhotoFileBrokenError {
+				responseCode = constant.PHOTO_UPLOAD_ERROR
+			} else if err == utils.PresignNotSupportedError {
+				responseCode = constant.PHOTO_DIRECT_UPLOAD_UNSUPPORTED
+			} else if err == models.PrivacyDirectUploadError {
+				responseCode = constant.PHOTO_PRIVACY_DIRECT_UPLOAD_DENIED
+			} else if err == models.PrivacyStripError {
+				responseCode = constant.PHOTO_PRIVACY_STRIP_FAILED
 			} else {
 				responseCode = constant.INTERNAL_SERVER_ERROR
 			}
 		} else {
 			responseCode = constant.PHOTO_ADD_IN_PROCESS
-			data["photo"] = *photoToAdd
+			data["photo"] = *addedPhoto
 			data["photo_upload_id"] = uploadID
+			if direct {
+				data["photo_upload_url"] = uploadUrl
+			}
 		}
 	} else {
 		for _, err := range validCheck.Errors {
@@ -72,6 +137,49 @@ func AddPhoto(context *gin.Context) {
 	})
 }
 
+// Confirm a direct upload after the client has uploaded the file to the storage.
+func ConfirmPhotoUpload(context *gin.Context) {
+	uploadID := context.PostForm("upload_id")
+
+	validCheck := validation.Validation{}
+	validCheck.Required(uploadID, "upload_id").Message("Must have upload id")
+
+	responseCode := constant.INVALID_PARAMS
+	data := make(map[string]interface{})
+	data["upload_id"] = uploadID
+	if !validCheck.HasErrors() {
+		auth, err := models.GetAuthByUserName(context.GetString("user_name"))
+		if err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "ConfirmPhotoUpload()"))
+			responseCode = constant.PHOTO_ACCESS_DENIED
+		} else if err := models.ConfirmDirectUpload(uploadID, auth.ID); err != nil {
+			if err == models.NoSuchUploadError {
+				responseCode = constant.PHOTO_NOT_EXIST
+			} else if err == models.UploadAccessError {
+				responseCode = constant.PHOTO_ACCESS_DENIED
+			} else if err == models.UploadVerifyError {
+				responseCode = constant.PHOTO_VERIFY_ERROR
+			} else if err == models.PhotoContentError {
+				responseCode = constant.PHOTO_CONTENT_REJECTED
+			} else {
+				responseCode = constant.INTERNAL_SERVER_ERROR
+			}
+		} else {
+			responseCode = constant.PHOTO_UPLOAD_SUCCESS
+		}
+	} else {
+		for _, err := range validCheck.Errors {
+			utils.AppLogger.Info(err.Message, zap.String("service", "ConfirmPhotoUpload()"))
+		}
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"code": responseCode,
+		"data": data,
+		"msg": constant.GetMessage(responseCode),
+	})
+}
+
 // Delete an existed photo.
 func DeletePhoto(context *gin.Context) {
 	responseCode := constant.INVALID_PARAMS
@@ -258,6 +366,107 @@ func GetPhotoByBucketID(context *gin.Context) {
 	})
 }
 
+// Get the duplicate photos of a user, grouped by similarity, a page of groups at a time.
+// "distance" is the max hamming distance between the perceptual hashes of near duplicates.
+func GetDuplicatePhotos(context *gin.Context) {
+	responseCode := constant.INVALID_PARAMS
+	authID, authErr := strconv.Atoi(context.Query("auth_id"))
+	distance, distanceErr := strconv.Atoi(context.DefaultQuery("distance", strconv.Itoa(constant.DUPLICATE_MAX_DISTANCE)))
+	if authErr != nil || distanceErr != nil {
+		utils.AppLogger.Info(constant.GetMessage(responseCode), zap.String("service", "GetDuplicatePhotos()"))
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"code": responseCode,
+			"data": make(map[string]string),
+			"msg":  constant.GetMessage(responseCode),
+		})
+		return
+	}
+	if !checkAuthID(context, authID, constant.PHOTO_ACCESS_DENIED, "GetDuplicatePhotos()") {
+		return
+	}
+
+	validCheck := validation.Validation{}
+	validCheck.Min(authID, 1, "auth_id").Message("Auth id should be positive")
+	validCheck.Range(distance, 0, constant.DUPLICATE_MAX_DISTANCE_LIMIT, "distance").
+		Message("Distance must be in [0, %d]", constant.DUPLICATE_MAX_DISTANCE_LIMIT)
+
+	data := make(map[string]interface{})
+	if !validCheck.HasErrors() {
+		if groups, err := models.GetDuplicatePhotos(uint(authID), distance, context.GetInt("offset")); err != nil {
+			responseCode = constant.INTERNAL_SERVER_ERROR
+		} else {
+			responseCode = constant.PHOTO_GET_SUCCESS
+			for _, group := range groups {
+				for i := 0;i < len(group);i++ {
+					group[i].Tags = strings.Split(group[i].Tag, ";")
+				}
+			}
+			data["duplicates"] = groups
+		}
+	} else {
+		for _, err := range validCheck.Errors {
+			utils.AppLogger.Info(err.Message, zap.String("service", "GetDuplicatePhotos()"))
+		}
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"code": responseCode,
+		"data": data,
+		"msg":  constant.GetMessage(responseCode),
+	})
+}
+
+// Suggest the tags of the user starting with a prefix, the most used ones first.
+// If "bucket_id" is given, only the tags of the photos in the bucket are suggested.
+func SuggestPhotoTags(context *gin.Context) {
+	responseCode := constant.INVALID_PARAMS
+	authID, authErr := strconv.Atoi(context.Query("auth_id"))
+	bucketID, bucketErr := strconv.Atoi(context.DefaultQuery("bucket_id", "0"))
+	prefix := strings.TrimSpace(context.Query("prefix"))
+	if authErr != nil || bucketErr != nil {
+		utils.AppLogger.Info(constant.GetMessage(responseCode), zap.String("service", "SuggestPhotoTags()"))
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"code": responseCode,
+			"data": make(map[string]string),
+			"msg":  constant.GetMessage(responseCode),
+		})
+		return
+	}
+	if !checkAuthID(context, authID, constant.PHOTO_ACCESS_DENIED, "SuggestPhotoTags()") {
+		return
+	}
+
+	validCheck := validation.Validation{}
+	validCheck.Min(authID, 1, "auth_id").Message("Auth id should be positive")
+	validCheck.Min(bucketID, 0, "bucket_id").Message("Bucket id should be positive")
+	validCheck.MinSize(prefix, 1, "prefix").Message("Prefix can't be empty")
+	validCheck.MaxSize(prefix, constant.TAG_PREFIX_MAX_LENGTH, "prefix").
+		Message("Prefix can't be longer than %d", constant.TAG_PREFIX_MAX_LENGTH)
+
+	data := make(map[string]interface{})
+	if !validCheck.HasErrors() {
+		suggestions, err := models.SuggestTags(prefix, uint(authID), uint(bucketID))
+		if err == nil {
+			data["tags"] = suggestions
+			responseCode = constant.PHOTO_TAG_SUGGEST_SUCCESS
+		} else if err == models.PhotoSearchUnavailableError {
+			responseCode = constant.PHOTO_SEARCH_UNAVAILABLE
+		} else {
+			responseCode = constant.INTERNAL_SERVER_ERROR
+		}
+	} else {
+		for _, err := range validCheck.Errors {
+			utils.AppLogger.Info(err.Message, zap.String("service", "SuggestPhotoTags()"))
+		}
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"code": responseCode,
+		"data": data,
+		"msg":  constant.GetMessage(responseCode),
+	})
+}
+
 // Get the upload status of a photo by upload id.
 func GetPhotoUploadStatus(context *gin.Context) {
 	uploadID := context.Query("upload_id")
@@ -270,6 +479,10 @@ func GetPhotoUploadStatus(context *gin.Context) {
 	data["upload_id"] = uploadID
 	if !validCheck.HasErrors() {
 		responseCode = models.GetPhotoUploadStatus(uploadID)
+		if transferred, total, ok := models.GetPhotoUploadProgress(uploadID); ok {
+			data["transferred"] = transferred
+			data["total"] = total
+		}
 	} else {
 		for _, err := range validCheck.Errors {
 			//log.Println(err)
@@ -284,41 +497,162 @@ func GetPhotoUploadStatus(context *gin.Context) {
 	})
 }
 
-// Search a photo (by tag / description)
+// Stream the progress of an upload by Server-Sent Events, from the latest progress until the upload ends,
+// i.e. a "progress" event each time the bytes stored or the stage changes.
+func StreamPhotoUploadProgress(context *gin.Context) {
+	uploadID := context.Query("upload_id")
+
+	validCheck := validation.Validation{}
+	validCheck.Required(uploadID, "upload_id").Message("Must have upload id")
+
+	responseCode := constant.INVALID_PARAMS
+	data := make(map[string]interface{})
+	data["upload_id"] = uploadID
+	if !validCheck.HasErrors() {
+		auth, err := models.GetAuthByUserName(context.GetString("user_name"))
+		if err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "StreamPhotoUploadProgress()"))
+			responseCode = constant.PHOTO_ACCESS_DENIED
+		} else {
+			latest, progresses, stop, err := models.WatchPhotoUploadProgress(uploadID, auth.ID)
+			if err == nil && latest != nil {
+				defer stop()
+				streamUploadProgress(context, latest, progresses)
+				return
+			}
+			if err == nil {
+				stop()
+				responseCode = constant.PHOTO_NOT_EXIST
+			} else if err == models.NoSuchUploadError {
+				responseCode = constant.PHOTO_NOT_EXIST
+			} else if err == models.UploadAccessError {
+				responseCode = constant.PHOTO_ACCESS_DENIED
+			} else {
+				responseCode = constant.INTERNAL_SERVER_ERROR
+			}
+		}
+	} else {
+		for _, err := range validCheck.Errors {
+			utils.AppLogger.Info(err.Message, zap.String("service", "StreamPhotoUploadProgress()"))
+		}
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"code": responseCode,
+		"data": data,
+		"msg": constant.GetMessage(responseCode),
+	})
+}
+
+// Write the progress of an upload as events until it ends or the client leaves,
+// a comment is sent when it's quiet for a while so proxies keep the connection.
+func streamUploadProgress(context *gin.Context, latest *utils.UploadProgress, progresses <-chan *utils.UploadProgress) {
+	context.Header("Cache-Control", "no-cache")
+	context.Header("X-Accel-Buffering", "no")	// don't let nginx buffer the events
+	context.SSEvent("progress", latest)
+	if latest.Stage.Final() {
+		return
+	}
+
+	heartbeat := time.NewTicker(constant.UPLOAD_PROGRESS_HEARTBEAT_SECOND * time.Second)
+	defer heartbeat.Stop()
+	context.Stream(func(writer io.Writer) bool {
+		select {
+		case progress, ok := <-progresses:
+			if !ok {
+				return false
+			}
+			context.SSEvent("progress", progress)
+			return !progress.Stage.Final()
+		case <-heartbeat.C:
+			fmt.Fprint(writer, ": ping\n\n")
+			return true
+		case <-context.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// Search photos by a query "q" (see search/query.go for the syntax), or by color.
+// The "tag", "desc" & "camera" parameters are still accepted, a photo has to match them too & any word of a desc or camera matches.
+// A color is in #rrggbb, photos with a palette color within the "tolerance" (CIE76, 20 by default) match it.
+// The photos can be sorted by "taken_at" or "created_at", or by "-taken_at" for the latest ones first.
 func SearchPhoto(context *gin.Context) {
 	responseCode := constant.INVALID_PARAMS
 	authID, err := strconv.Atoi(context.Query("auth_id"))
-	tag, tagExisted := context.GetQuery("tag")
-	desc, descExisted := context.GetQuery("desc")
-	if err != nil || (tagExisted && descExisted) || (!tagExisted && !descExisted) {
+	color, colorExisted := context.GetQuery("color")
+	tolerance, toleranceErr := strconv.ParseFloat(
+		context.DefaultQuery("tolerance", strconv.FormatFloat(constant.COLOR_SEARCH_TOLERANCE, 'f', -1, 64)), 64)
+	sort := context.Query("sort")
+
+	// the legacy parameters are matched as they are, not parsed as a query
+	query := context.Query("q")
+	terms := make([]*search.Node, 0)
+	for _, param := range []string{"tag", "desc", "camera"} {
+		if value, existed := context.GetQuery(param); existed {
+			terms = append(terms, &search.Node{Kind: search.NodeTerm, Field: param, Value: value, AnyWord: true})
+		}
+	}
+
+	if err != nil || toleranceErr != nil || colorExisted == (query != "" || len(terms) > 0) {
 		utils.AppLogger.Info(constant.GetMessage(responseCode), zap.String("service", "SearchPhoto()"))
 		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"code": responseCode,
 			"data": make(map[string]string),
 			"msg":  constant.GetMessage(responseCode),
 		})
-	}
-
-	var searchType models.SearchType
-	var field string
-	if tagExisted {
-		searchType = constant.SEARCH_BY_TAG
-		field = tag
-	} else {
-		searchType = constant.SEARCH_BY_DESC
-		field = desc
+		return
 	}
 
 	validCheck := validation.Validation{}
 	validCheck.Min(authID, 1, "auth_id").Message("Auth id must be positive")
-	validCheck.MinSize(field, 1, "search_field").Message("Search field can't be empty")
+	for _, term := range terms {
+		validCheck.MinSize(term.Value, 1, term.Field).Message("Search field can't be empty")
+	}
+	if sortField := strings.TrimPrefix(sort, "-");sort != "" &&
+		sortField != constant.SORT_BY_TAKEN_AT && sortField != constant.SORT_BY_CREATED_AT {
+		validCheck.SetError("sort", "Photos can only be sorted by taken_at or created_at")
+	}
+	if colorExisted {
+		validCheck.Match(color, regexp.MustCompile("^#[0-9a-fA-F]{6}$"), "color").Message("Color must be in #rrggbb")
+		if tolerance < 0 || tolerance > constant.COLOR_SEARCH_MAX_TOLERANCE {
+			validCheck.SetError("tolerance", fmt.Sprintf("Tolerance must be within 0 and %v", constant.COLOR_SEARCH_MAX_TOLERANCE))
+		}
+	}
 
 	data := make(map[string]interface{})
 	if !validCheck.HasErrors() {
 		offset := context.GetInt("offset")
-		if photos, err := models.SearchPhoto(field, uint(authID), offset, searchType); err == nil {
+		var photos []models.PhotoToIndex
+		if colorExisted {
+			photos, err = models.SearchPhotoByColor(color, tolerance, uint(authID), offset, sort)
+		} else {
+			var root *search.Node
+			if query != "" {
+				root, err = search.Parse(query)
+			}
+			if err == nil {
+				if len(terms) > 0 {
+					if root != nil {
+						terms = append([]*search.Node{root}, terms...)	// an OR in the query doesn't take the terms
+					}
+					root = &search.Node{Kind: search.NodeAnd, Children: terms}
+				}
+				photos, err = models.SearchPhoto(root, uint(authID), offset, sort)
+			}
+		}
+		if queryErr, ok := err.(*search.QueryError); ok {
+			utils.AppLogger.Info(queryErr.Error(), zap.String("service", "SearchPhoto()"))
+			data["position"] = queryErr.Position
+			data["error"] = queryErr.Message
+			responseCode = constant.PHOTO_SEARCH_QUERY_INVALID
+		} else if err == nil {
 			data["photos"] = photos
 			responseCode = constant.PHOTO_SEARCH_BY_TAG_SUCCESS
+		} else if err == models.PhotoSearchRejectedError {
+			responseCode = constant.PHOTO_SEARCH_REJECTED
+		} else if err == models.PhotoSearchUnavailableError {
+			responseCode = constant.PHOTO_SEARCH_UNAVAILABLE
 		} else {
 			responseCode = constant.INTERNAL_SERVER_ERROR
 		}
@@ -333,4 +667,158 @@ func SearchPhoto(context *gin.Context) {
 		"data": data,
 		"msg": constant.GetMessage(responseCode),
 	})
+}
+
+// Get the content of a photo, only the owner of the photo can access it.
+// Range, If-None-Match & If-Modified-Since requests are supported.
+func GetPhotoContent(context *gin.Context) {
+	photo, status, responseCode := getOwnedPhoto(context, "GetPhotoContent()")
+	if photo == nil {
+		context.AbortWithStatusJSON(status, gin.H{
+			"code": responseCode,
+			"data": make(map[string]string),
+			"msg":  constant.GetMessage(responseCode),
+		})
+		return
+	}
+
+	object, err := utils.Store.Stat(photo.ObjectKey())
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "GetPhotoContent()"))
+		status, responseCode = http.StatusInternalServerError, constant.INTERNAL_SERVER_ERROR
+		if err == utils.ObjectNotExistError {
+			status, responseCode = http.StatusNotFound, constant.PHOTO_NOT_EXIST	// not uploaded yet
+		}
+		context.AbortWithStatusJSON(status, gin.H{
+			"code": responseCode,
+			"data": make(map[string]string),
+			"msg":  constant.GetMessage(responseCode),
+		})
+		return
+	}
+
+	context.Header("Cache-Control", "private, no-cache")
+	serveObject(context, object, photo.Name)
+}
+
+// Render a photo in the given size, the size must be in the allow-list.
+// "fit" is one of contain (default), cover & fill, "format" is jpeg or png, "q" is the jpeg quality.
+func GetPhotoRender(context *gin.Context) {
+	width, widthErr := strconv.Atoi(context.Query("w"))
+	height, heightErr := strconv.Atoi(context.Query("h"))
+	quality, qualityErr := strconv.Atoi(context.DefaultQuery("q", strconv.Itoa(constant.RENDER_DEFAULT_QUALITY)))
+	if widthErr != nil || heightErr != nil || qualityErr != nil {
+		utils.AppLogger.Info(constant.GetMessage(constant.INVALID_PARAMS), zap.String("service", "GetPhotoRender()"))
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"code": constant.INVALID_PARAMS,
+			"data": make(map[string]string),
+			"msg":  constant.GetMessage(constant.INVALID_PARAMS),
+		})
+		return
+	}
+	options := models.RenderOptions{
+		Width: width,
+		Height: height,
+		Fit: context.DefaultQuery("fit", models.RenderFitContain),
+		Format: strings.Replace(context.Query("format"), "jpg", "jpeg", 1),
+		Quality: quality,
+	}
+
+	photo, status, responseCode := getOwnedPhoto(context, "GetPhotoRender()")
+	var object *utils.ObjectInfo
+	if photo != nil {
+		var err error
+		if object, err = models.RenderPhoto(photo, &options); err != nil {
+			switch err {
+			case models.RenderOptionsError:
+				status, responseCode = http.StatusBadRequest, constant.INVALID_PARAMS
+			case models.RenderSizeNotAllowedError:
+				status, responseCode = http.StatusBadRequest, constant.PHOTO_RENDER_SIZE_NOT_ALLOWED
+			case models.RenderDecodeError:
+				status, responseCode = http.StatusUnprocessableEntity, constant.PHOTO_RENDER_ERROR
+			case utils.ImageTooLargeError:
+				status, responseCode = http.StatusUnprocessableEntity, constant.PHOTO_TOO_LARGE
+			case utils.ObjectNotExistError:
+				status, responseCode = http.StatusNotFound, constant.PHOTO_NOT_EXIST	// not uploaded yet
+			default:
+				status, responseCode = http.StatusInternalServerError, constant.INTERNAL_SERVER_ERROR
+			}
+		}
+	}
+	if object == nil {
+		context.AbortWithStatusJSON(status, gin.H{
+			"code": responseCode,
+			"data": make(map[string]string),
+			"msg":  constant.GetMessage(responseCode),
+		})
+		return
+	}
+
+	// a render never changes, since the content of a photo never changes
+	context.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", constant.RENDER_MAX_AGE))
+	name := strings.TrimSuffix(photo.Name, path.Ext(photo.Name)) + path.Ext(object.Key)
+	serveObject(context, object, name)
+}
+
+// Serve an object in the storage as a file of the given name.
+func serveObject(context *gin.Context, object *utils.ObjectInfo, name string) {
+	etag := object.ETag
+	if !strings.HasPrefix(etag, "\"") && !strings.HasPrefix(etag, "W/") {
+		etag = "\"" + etag + "\""
+	}
+	context.Header("ETag", etag)
+	context.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		context.Header("Content-Type", contentType)
+	}
+
+	// ServeContent deals with conditional & range requests
+	reader := utils.NewObjectReader(object.Key, object.Size)
+	defer reader.Close()
+	http.ServeContent(context.Writer, context.Request, name, object.LastModified, reader)
+}
+
+// Get the photo given by the "id" path param, it must be owned by the login user.
+// If not, the photo is nil & the http status with the response code are returned.
+func getOwnedPhoto(context *gin.Context, service string) (*models.Photo, int, int) {
+	photoID, err := strconv.Atoi(context.Param("id"))
+	if err != nil || photoID < 1 {
+		utils.AppLogger.Info("Photo id should be positive", zap.String("service", service))
+		return nil, http.StatusBadRequest, constant.INVALID_PARAMS
+	}
+
+	auth, err := models.GetAuthByUserName(context.GetString("user_name"))
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", service))
+		return nil, http.StatusForbidden, constant.PHOTO_ACCESS_DENIED
+	}
+
+	photo, err := models.GetPhotoByID(uint(photoID))
+	if err == models.NoSuchPhotoError {
+		return nil, http.StatusNotFound, constant.PHOTO_NOT_EXIST
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, constant.INTERNAL_SERVER_ERROR
+	}
+	if photo.AuthID != auth.ID {
+		return nil, http.StatusForbidden, constant.PHOTO_ACCESS_DENIED
+	}
+	return photo, http.StatusOK, constant.PHOTO_GET_SUCCESS
+}
+
+// Check the auth id of a request is the id of the user logged in, otherwise the request is aborted
+// with 403 & the given response code.
+func checkAuthID(context *gin.Context, authID int, responseCode int, service string) bool {
+	auth, err := models.GetAuthByUserName(context.GetString("user_name"))
+	if err == nil && auth.ID == uint(authID) {
+		return true
+	}
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", service))
+	}
+	context.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"code": responseCode,
+		"data": make(map[string]string),
+		"msg":  constant.GetMessage(responseCode),
+	})
+	return false
 }
\ No newline at end of file
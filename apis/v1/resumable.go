@@ -0,0 +1,220 @@
+package v1
+
+import (
+	"encoding/base64"
+	"fmt"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/models"
+	"gin-photo-storage/utils"
+	"github.com/astaxie/beego/validation"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Describe the supported tus protocol version & extensions.
+func OptionsResumableUpload(context *gin.Context) {
+	context.Header("Tus-Resumable", constant.TUS_VERSION)
+	context.Header("Tus-Version", constant.TUS_VERSION)
+	context.Header("Tus-Extension", constant.TUS_EXTENSION)
+	context.Header("Tus-Max-Size", strconv.FormatInt(models.MaxUploadBytes(), 10))
+	context.Status(http.StatusNoContent)
+}
+
+// Create a resumable upload (tus creation extension).
+// The photo fields are passed in the "Upload-Metadata" header,
+// i.e. auth_id, bucket_id, name (or filename), tags (separated by ";"), description
+// & duplicate (the duplicate policy, see AddPhoto).
+func CreateResumableUpload(context *gin.Context) {
+	if !checkTusVersion(context) {
+		return
+	}
+
+	responseCode := constant.INVALID_PARAMS
+	length, err := strconv.ParseInt(context.GetHeader("Upload-Length"), 10, 64)
+	metadata, metaErr := parseTusMetadata(context.GetHeader("Upload-Metadata"))
+	if err != nil || metaErr != nil {
+		utils.AppLogger.Info(constant.GetMessage(responseCode), zap.String("service", "CreateResumableUpload()"))
+		abortTus(context, http.StatusBadRequest, responseCode)
+		return
+	}
+
+	authID, _ := strconv.Atoi(metadata["auth_id"])
+	bucketID, _ := strconv.Atoi(metadata["bucket_id"])
+	name := metadata["name"]
+	if name == "" {
+		name = metadata["filename"]
+	}
+
+	validCheck := validation.Validation{}
+	validCheck.Min(authID, 1, "auth_id").Message("Must have auth id")
+	validCheck.Min(bucketID, 1, "bucket_id").Message("Must have bucket id")
+	validCheck.Required(name, "photo_name").Message("Must have photo name")
+	validCheck.MaxSize(name, 255, "photo_name").Message("Photo name len must not exceed 255")
+	validCheck.Min(int(length), 1, "upload_length").Message("Upload length should be positive")
+	if !models.DuplicatePolicy(metadata["duplicate"]).Valid() {
+		validCheck.SetError("duplicate", "Duplicate policy must be reject or flag")
+	}
+	if validCheck.HasErrors() {
+		for _, err := range validCheck.Errors {
+			utils.AppLogger.Info(err.Message, zap.String("service", "CreateResumableUpload()"))
+		}
+		abortTus(context, http.StatusBadRequest, responseCode)
+		return
+	}
+
+	photoToAdd := &models.Photo{AuthID: uint(authID), BucketID: uint(bucketID), Name: name,
+		Tag: metadata["tags"], Description: metadata["description"]}
+	if err := models.CheckQuota(photoToAdd.AuthID, photoToAdd.BucketID, length); err != nil {
+		if err == models.QuotaExceededError {
+			abortTus(context, http.StatusForbidden, constant.PHOTO_QUOTA_EXCEEDED)
+		} else {
+			abortTus(context, http.StatusBadRequest, responseCode)
+		}
+		return
+	}
+	upload, err := models.CreateResumableUpload(photoToAdd, length, models.DuplicatePolicy(metadata["duplicate"]))
+	if err != nil {
+		if err == models.UploadTooLargeError {
+			abortTus(context, http.StatusRequestEntityTooLarge, constant.PHOTO_TOO_LARGE)
+		} else {
+			abortTus(context, http.StatusInternalServerError, constant.INTERNAL_SERVER_ERROR)
+		}
+		return
+	}
+
+	context.Header("Location", strings.TrimRight(context.Request.URL.Path, "/") + "/" + upload.ID)
+	context.Header("Upload-Offset", "0")
+	context.JSON(http.StatusCreated, gin.H{
+		"code": constant.PHOTO_ADD_IN_PROCESS,
+		"data": gin.H{"upload_id": upload.ID},
+		"msg": constant.GetMessage(constant.PHOTO_ADD_IN_PROCESS),
+	})
+}
+
+// Report the offset of a resumable upload, so that the client knows where to resume.
+// A complete upload whose photo was not added for a temporary error is completed again.
+func HeadResumableUpload(context *gin.Context) {
+	if !checkTusVersion(context) {
+		return
+	}
+
+	upload, err := models.ResumeResumableUpload(context.Param("upload_id"))
+	if err != nil && err != models.UploadLockedError {
+		abortResumableUpload(context, upload, err)
+		return
+	}
+
+	context.Header("Cache-Control", "no-store")
+	context.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	context.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.PhotoUploadID != "" {
+		context.Header("Photo-Upload-Id", upload.PhotoUploadID)
+	}
+	context.Status(http.StatusOK)
+}
+
+// Append a chunk to a resumable upload.
+func PatchResumableUpload(context *gin.Context) {
+	if !checkTusVersion(context) {
+		return
+	}
+
+	if context.ContentType() != "application/offset+octet-stream" {
+		abortTus(context, http.StatusUnsupportedMediaType, constant.INVALID_PARAMS)
+		return
+	}
+	offset, err := strconv.ParseInt(context.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		abortTus(context, http.StatusBadRequest, constant.INVALID_PARAMS)
+		return
+	}
+
+	upload, err := models.WriteResumableUpload(context.Param("upload_id"), offset, context.Request.Body)
+	if upload != nil {
+		context.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	}
+	if err != nil {
+		abortResumableUpload(context, upload, err)
+		return
+	}
+
+	if upload.PhotoUploadID != "" {
+		context.Header("Photo-Upload-Id", upload.PhotoUploadID)
+	}
+	context.Status(http.StatusNoContent)
+}
+
+// Abort a resumable upload request by the error of the upload.
+// An upload spooled on another instance is rejected with the instance, so that a proxy can route it there.
+func abortResumableUpload(context *gin.Context, upload *models.ResumableUpload, err error) {
+	switch err {
+	case models.NoSuchUploadError:
+		abortTus(context, http.StatusNotFound, constant.PHOTO_NOT_EXIST)
+	case models.UploadInstanceError:
+		context.Header("Upload-Instance", upload.Instance)
+		abortTus(context, http.StatusMisdirectedRequest, constant.PHOTO_UPLOAD_WRONG_INSTANCE)
+	case models.UploadOffsetError:
+		abortTus(context, http.StatusConflict, constant.PHOTO_UPLOAD_OFFSET_CONFLICT)
+	case models.UploadLockedError:
+		abortTus(context, http.StatusLocked, constant.PHOTO_UPLOAD_LOCKED)
+	case models.PhotoExistsError:
+		abortTus(context, http.StatusConflict, constant.PHOTO_ALREADY_EXIST)
+	case models.QuotaExceededError:
+		abortTus(context, http.StatusForbidden, constant.PHOTO_QUOTA_EXCEEDED)
+	case models.DuplicatePhotoError:
+		abortTus(context, http.StatusConflict, constant.PHOTO_DUPLICATED)
+	case models.PhotoContentError:
+		abortTus(context, http.StatusUnprocessableEntity, constant.PHOTO_CONTENT_REJECTED)
+	case models.PrivacyStripError:
+		abortTus(context, http.StatusUnprocessableEntity, constant.PHOTO_PRIVACY_STRIP_FAILED)
+	default:
+		abortTus(context, http.StatusInternalServerError, constant.INTERNAL_SERVER_ERROR)
+	}
+}
+
+// Check the tus version of the request, abort if it's not supported.
+func checkTusVersion(context *gin.Context) bool {
+	context.Header("Tus-Resumable", constant.TUS_VERSION)
+	if context.GetHeader("Tus-Resumable") != constant.TUS_VERSION {
+		context.Header("Tus-Version", constant.TUS_VERSION)
+		abortTus(context, http.StatusPreconditionFailed, constant.INVALID_PARAMS)
+		return false
+	}
+	return true
+}
+
+// Abort a tus request with the given status & response code.
+func abortTus(context *gin.Context, status int, responseCode int) {
+	context.AbortWithStatusJSON(status, gin.H{
+		"code": responseCode,
+		"data": make(map[string]string),
+		"msg": constant.GetMessage(responseCode),
+	})
+}
+
+// Parse the tus metadata header, which is like "key1 base64(value1),key2 base64(value2)".
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid metadata pair: %s", pair)
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata, nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"path/filepath"
 )
 
 type Cfg struct {
@@ -14,11 +15,11 @@ var ServerCfg Cfg
 
 // Init config from the local config file.
 func init() {
-	confFile, err := os.Open("conf/server.conf")
-	defer confFile.Close()
+	confFile, err := openConfFile()
 	if err != nil {
 		log.Fatalln(err)
 	}
+	defer confFile.Close()
 
 	ServerCfg.ConfigMap = make(map[string]string)
 	err = json.NewDecoder(confFile).Decode(&ServerCfg.ConfigMap)
@@ -27,6 +28,26 @@ func init() {
 	}
 }
 
+// Open "conf/server.conf" under the working directory or its nearest parent,
+// so that the tests of a package, which run in the package directory, share the config.
+func openConfFile() (*os.File, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		confFile, err := os.Open(filepath.Join(dir, "conf", "server.conf"))
+		if !os.IsNotExist(err) {
+			return confFile, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, err
+		}
+		dir = parent
+	}
+}
+
 // Get the corresponding config value of the given key.
 func (cfg *Cfg) Get(key string) string {
 	if val, ok := cfg.ConfigMap[key]; ok {
@@ -7,11 +7,13 @@ const (
 	JWT 				= "jwt"
 	JWT_EXP_MINUTE 		= 30
 	PHOTO_STORAGE_ADMIN = "admin"
+	ADMIN_USERS 		= "ADMIN_USERS"
 
 	// Server constants
 	SERVER_PORT = "SERVER_PORT"
 	SERVER_DOMAIN = "SERVER_DOMAIN"
 	SERVER_PATH = "SERVER_PATH"
+	SHUTDOWN_TIMEOUT_SECOND = 30
 	PAGE_SIZE 	= 20
 
 	// DB constants
@@ -32,6 +34,14 @@ const (
 	LOGIN_MAX_AGE 	= 1800
 	LOGIN_USER 		= "LOGIN_"
 
+	// Storage constants
+	STORAGE_TYPE 		= "STORAGE_TYPE"
+	STORAGE_TYPE_COS 	= "cos"
+	STORAGE_TYPE_S3 	= "s3"
+	STORAGE_TYPE_LOCAL 	= "local"
+	LOCAL_STORAGE_ROOT 	= "LOCAL_STORAGE_ROOT"
+	LOCAL_STORAGE_URL 	= "LOCAL_STORAGE_URL"
+
 	// COS constants
 	COS_BUCKET_NAME = "COS_BUCKET_NAME"
 	COS_APP_ID 		= "COS_APP_ID"
@@ -39,15 +49,154 @@ const (
 	COS_SECRET_ID 	= "COS_SECRET_ID"
 	COS_SECRET_KEY 	= "COS_SECRET_KEY"
 
-	// Callback constants
-	URL_UPDATE_CHANNEL 		= "PHOTO_URL_UPDATE"
+	BLOB_KEY_PREFIX 	= "blobs/"
+	BLOB_KEY_FORMAT 	= "blobs/%s/%s"
+
+	// S3 constants
+	S3_ENDPOINT 	= "S3_ENDPOINT"
+	S3_REGION 		= "S3_REGION"
+	S3_BUCKET_NAME 	= "S3_BUCKET_NAME"
+	S3_ACCESS_KEY 	= "S3_ACCESS_KEY"
+	S3_SECRET_KEY 	= "S3_SECRET_KEY"
+	S3_USE_SSL 		= "S3_USE_SSL"
+	S3_PATH_STYLE 	= "S3_PATH_STYLE"
+
+	// Event constants
+	EVENT_TRANSPORT 		= "EVENT_TRANSPORT"
+	EVENT_TRANSPORT_REDIS 	= "redis"
+	EVENT_TRANSPORT_MEMORY 	= "memory"
+	EVENT_CHANNEL_PREFIX 	= "EVENT_"
+	PHOTO_PROCESS_WORKERS 	= "PHOTO_PROCESS_WORKERS"
+	PHOTO_PROCESS_GROUP 	= "photo-processors"
 	PHOTO_UPDATE_ID_FORMAT 	= "photo-%d"
-	PHOTO_DELETE_CHANNEL 	= "PHOTO_DELETE"
+
+	// Direct upload constants
+	DIRECT_UPLOAD_KEY_FORMAT 		= "direct-upload-%s"
+	DIRECT_UPLOAD_OBJECT_PREFIX 	= "uploads/"
+	DIRECT_UPLOAD_OBJECT_FORMAT 	= "uploads/%x"
+	DIRECT_UPLOAD_EXPIRE_MINUTE 	= 30
+	DIRECT_UPLOAD_INFO_EXPIRE_HOUR 	= 24
+
+	// Resumable upload constants
+	TUS_VERSION 					= "1.0.0"
+	TUS_EXTENSION 					= "creation"
+	TUS_SPOOL_DIR 					= "TUS_SPOOL_DIR"
+	RESUMABLE_UPLOAD_ID_FORMAT 		= "tus-%x"
+	RESUMABLE_UPLOAD_KEY_FORMAT 	= "resumable-upload-%s"
+	RESUMABLE_UPLOAD_LOCK_FORMAT 	= "resumable-upload-lock-%s"
+	RESUMABLE_UPLOAD_EXPIRE_HOUR 	= 24
+	RESUMABLE_UPLOAD_LOCK_MINUTE 	= 10
+	UPLOAD_PROGRESS_KEY_FORMAT 		= "progress-%s"
+	UPLOAD_STAGE_KEY_FORMAT 		= "upload-stage-%s"
+	UPLOAD_STAGE_EXPIRE_HOUR 		= 24
+	UPLOAD_PROGRESS_CHANNEL_FORMAT 	= "UPLOAD_PROGRESS_%s"
+	UPLOAD_PROGRESS_INTERVAL_MS 	= 500
+	UPLOAD_PROGRESS_HEARTBEAT_SECOND = 15
+
+	// Upload job constants
+	UPLOAD_SPOOL_DIR 			= "UPLOAD_SPOOL_DIR"
+	UPLOAD_WORKERS 				= "UPLOAD_WORKERS"
+	UPLOAD_MAX_ATTEMPTS 		= "UPLOAD_MAX_ATTEMPTS"
+	UPLOAD_INSTANCE_ID 			= "UPLOAD_INSTANCE_ID"
+	UPLOAD_JOB_STREAM_FORMAT 	= "upload-jobs-%s"
+	UPLOAD_JOB_GROUP 			= "upload-workers"
+	UPLOAD_JOB_RETRY_KEY_FORMAT = "upload-jobs-retry-%s"
+	UPLOAD_JOB_INSTANCES_KEY 	= "upload-jobs-instances"
+	UPLOAD_JOB_DEAD_STREAM 		= "upload-jobs-dead"
+	UPLOAD_JOB_DEAD_MAX_LEN 	= 10000
+	UPLOAD_JOB_BLOCK_SECOND 	= 5
+	UPLOAD_JOB_CLAIM_MINUTE 	= 30	// a job idle longer is left by a stopped instance, a running one is kept alive
+	UPLOAD_RETRY_BASE_SECOND 	= 10
+	UPLOAD_RETRY_MAX_SECOND 	= 1800
+	UPLOAD_SPOOL_EXPIRE_HOUR 	= 72
+
+	// Garbage collection constants
+	GC_INTERVAL_MINUTE 	= "GC_INTERVAL_MINUTE"
+	GC_GRACE_MINUTE 	= "GC_GRACE_MINUTE"
+	GC_DRY_RUN 			= "GC_DRY_RUN"
+	GC_LEGACY_PREFIXES 	= "GC_LEGACY_PREFIXES"	// where the objects uploaded before content addressing are
+	GC_LOCK 			= "garbage-collector-lock"
+	GC_BATCH_SIZE 		= 500
+
+	// Derivative constants
+	DERIVATIVE_SIZES 		= "DERIVATIVE_SIZES"
+	DERIVATIVE_KEY_PREFIX 	= "derivatives/"
+	DERIVATIVE_KEY_FORMAT 	= "derivatives/%s/%d.%s"
+	DERIVATIVE_SHARED_KEY_FORMAT = "derivatives/%s/shared.%s"
+	DERIVATIVE_LOCK_FORMAT 	= "derivative-lock-%s"
+	DERIVATIVE_LOCK_MINUTE 	= 10
+	DERIVATIVE_QUALITY 		= 85
+	IMAGE_MAX_PIXELS 		= 50000000
+
+	// Placeholder constants
+	PLACEHOLDER_SAMPLE_SIZE 	= 32
+	BLURHASH_COMPONENTS 		= 4		// along the longer side, one less along the shorter side
+
+	// Palette constants
+	PALETTE_MAX_COLORS 			= 5
+	PALETTE_MIN_SHARE 			= 0.05
+	PALETTE_CELL_SIZE 			= 10.0	// the edge of a CIELAB cell indexing palette colors
+	PALETTE_CELL_OFFSET 		= 20	// shift the a & b cells to positive numbers
+	COLOR_SEARCH_TOLERANCE 		= 20.0	// the default CIE76 difference of a color search
+	COLOR_SEARCH_MAX_TOLERANCE 	= 40.0
+
+	// Render constants
+	RENDER_ALLOWED_SIZES 	= "RENDER_ALLOWED_SIZES"
+	RENDER_KEY_PREFIX 		= "renders/"
+	RENDER_KEY_FORMAT 		= "renders/%s/%dx%d-%s-q%d.%s"
+	RENDER_DEFAULT_QUALITY 	= 85
+	RENDER_MAX_AGE 			= 86400
+
+	// Upload validation constants
+	UPLOAD_MAX_BYTES 		= "UPLOAD_MAX_BYTES"
+	UPLOAD_MAX_WIDTH 		= "UPLOAD_MAX_WIDTH"
+	UPLOAD_MAX_HEIGHT 		= "UPLOAD_MAX_HEIGHT"
+	UPLOAD_ALLOWED_TYPES 	= "UPLOAD_ALLOWED_TYPES"
+
+	// Duplicate constants
+	DUPLICATE_MAX_DISTANCE 		= 6
+	DUPLICATE_MAX_DISTANCE_LIMIT = 16
+
+	// Quota constants
+	QUOTA_USER_MAX_PHOTOS 		= "QUOTA_USER_MAX_PHOTOS"
+	QUOTA_USER_MAX_BYTES 		= "QUOTA_USER_MAX_BYTES"
+	QUOTA_BUCKET_MAX_PHOTOS 	= "QUOTA_BUCKET_MAX_PHOTOS"
+	QUOTA_BUCKET_MAX_BYTES 		= "QUOTA_BUCKET_MAX_BYTES"
+
+	// Privacy constants
+	PRIVACY_DEFAULT 	= "PRIVACY_DEFAULT"
+	PRIVACY_KEEP_EXIF 	= "PRIVACY_KEEP_EXIF"
+
+	// Outbox constants
+	OUTBOX_LOCK 				= "outbox-relay-lock"
+	OUTBOX_LOCK_MINUTE 			= 1
+	OUTBOX_BATCH_SIZE 			= 100
+	OUTBOX_POLL_SECOND 			= 5
+	OUTBOX_RETRY_BASE_SECOND 	= 5
+	OUTBOX_RETRY_MAX_SECOND 	= 3600
+
+	// Reindex constants
+	REINDEX_LOCK 				= "reindex-lock"
+	REINDEX_LOCK_MINUTE 		= 10	// kept alive while the reindex runs
+	REINDEX_REPORT_KEY 			= "reindex-report"
+	REINDEX_BATCH_SIZE 			= 500
+	REINDEX_CHANGES_KEY 		= "reindex-changes"	// photos changed by the outbox during a reindex
+	REINDEX_CHANGES_EXPIRE_HOUR = 24
 
 	// Elasticsearch constants
 	ES_HOST 		= "ES_HOST"
 	ES_PORT 		= "ES_PORT"
-	ES_PHOTO_INDEX 	= "ES_PHOTO_INDEX"
-	SEARCH_BY_TAG	= "tags"
-	SEARCH_BY_DESC	= "description"
+	ES_PHOTO_INDEX 	= "ES_PHOTO_INDEX"	// the alias of the photo index
+	PHOTO_INDEX_VERSION 	= 2			// bumped once the mapping changes
+	PHOTO_INDEX_NAME_FORMAT = "%s-v%d-%d"	// the alias & the mapping version & the creation time
+	SEARCH_BY_TAG		= "tags"
+	SEARCH_BY_DESC		= "description"
+	SEARCH_BY_CAMERA	= "camera"
+	SEARCH_BY_COLOR		= "palette_codes"
+	SORT_BY_TAKEN_AT	= "taken_at"
+	SORT_BY_CREATED_AT	= "created_at"
+	SEARCH_QUERY_MAX_TERMS 	= 32
+	SEARCH_QUERY_MAX_DEPTH 	= 8		// nested parentheses
+	TAG_PREFIX_MAX_LENGTH 	= 20	// the longest prefix indexed for tag suggestions
+	TAG_SUGGEST_SIZE 		= 10
 )
@@ -9,6 +9,8 @@ const (
 	USER_AUTH_ERROR 		= 1004
 	USER_AUTH_TIMEOUT 		= 1005
 	USER_SIGNOUT_SUCCESS 	= 1006
+	USER_PRIVACY_UPDATE_SUCCESS 	= 1007
+	USER_ACCESS_DENIED 				= 1008
 
 	// JWT related responses
 	JWT_GENERATION_ERROR 	= 2001
@@ -22,6 +24,7 @@ const (
 	BUCKET_DELETE_SUCCESS 	= 3004
 	BUCKET_UPDATE_SUCCESS 	= 3005
 	BUCKET_GET_SUCCESS 		= 3006
+	BUCKET_USAGE_GET_SUCCESS 	= 3007
 
 	// Photo related responses
 	PHOTO_ALREADY_EXIST 			= 4001
@@ -34,6 +37,32 @@ const (
 	PHOTO_GET_SUCCESS 				= 4008
 	PHOTO_SEARCH_BY_TAG_SUCCESS 	= 4009
 	PHOTO_SEARCH_BY_DESC_SUCCESS	= 4010
+	PHOTO_DIRECT_UPLOAD_UNSUPPORTED	= 4011
+	PHOTO_VERIFY_ERROR 				= 4012
+	PHOTO_UPLOAD_OFFSET_CONFLICT 	= 4013
+	PHOTO_UPLOAD_LOCKED 			= 4014
+	PHOTO_TOO_LARGE 				= 4015
+	PHOTO_ACCESS_DENIED 			= 4016
+	PHOTO_QUOTA_EXCEEDED 			= 4017
+	PHOTO_RENDER_SIZE_NOT_ALLOWED 	= 4018
+	PHOTO_RENDER_ERROR 				= 4019
+	PHOTO_DUPLICATED 				= 4020
+	PHOTO_CONTENT_REJECTED 			= 4021
+	PHOTO_PRIVACY_DIRECT_UPLOAD_DENIED 	= 4022
+	PHOTO_SEARCH_QUERY_INVALID 		= 4023
+	PHOTO_SEARCH_REJECTED 			= 4024
+	PHOTO_SEARCH_UNAVAILABLE 		= 4025
+	PHOTO_TAG_SUGGEST_SUCCESS 		= 4026
+	PHOTO_PRIVACY_STRIP_FAILED 		= 4027
+	PHOTO_UPLOAD_WRONG_INSTANCE 	= 4028
+
+	// Admin related responses
+	ADMIN_PERMISSION_DENIED 		= 6001
+	ADMIN_FAILED_JOBS_GET_SUCCESS 	= 6002
+	ADMIN_REINDEX_STARTED 			= 6003
+	ADMIN_REINDEX_RUNNING 			= 6004
+	ADMIN_REINDEX_GET_SUCCESS 		= 6005
+	ADMIN_REINDEX_NOT_EXIST 		= 6006
 
 	// Internal server responses
 	INTERNAL_SERVER_ERROR 	= 5001
@@ -54,6 +83,8 @@ func init() {
 	Message[USER_AUTH_ERROR] 		= "User authentication fail."
 	Message[USER_AUTH_TIMEOUT] 		= "User authentication timeout."
 	Message[USER_SIGNOUT_SUCCESS] 	= "User sign out success."
+	Message[USER_PRIVACY_UPDATE_SUCCESS] = "User privacy update success."
+	Message[USER_ACCESS_DENIED] = "No permission to access the user."
 	Message[JWT_GENERATION_ERROR] 	= "JWT generation fail."
 	Message[JWT_MISSING_ERROR] 		= "JWT is missing."
 	Message[JWT_PARSE_ERROR]		= "JWT parse error."
@@ -64,6 +95,7 @@ func init() {
 	Message[BUCKET_DELETE_SUCCESS] 	= "Bucket delete success."
 	Message[BUCKET_UPDATE_SUCCESS] 	= "Bucket update success."
 	Message[BUCKET_GET_SUCCESS] 	= "Bucket get success."
+	Message[BUCKET_USAGE_GET_SUCCESS] = "Usage get success."
 	Message[PHOTO_ALREADY_EXIST] 	= "Photo already exists."
 	Message[PHOTO_ADD_IN_PROCESS] 	= "Adding photo is in process."
 	Message[PHOTO_UPLOAD_SUCCESS] 	= "Photo upload success."
@@ -74,6 +106,30 @@ func init() {
 	Message[PHOTO_GET_SUCCESS]		= "Photo get success."
 	Message[PHOTO_SEARCH_BY_TAG_SUCCESS] = "Photo search by tag success."
 	Message[PHOTO_SEARCH_BY_DESC_SUCCESS] = "Photo search by description success."
+	Message[PHOTO_DIRECT_UPLOAD_UNSUPPORTED] = "Direct upload is not supported by the storage."
+	Message[PHOTO_VERIFY_ERROR] = "Uploaded photo verification fail."
+	Message[PHOTO_UPLOAD_OFFSET_CONFLICT] = "Upload offset does not match."
+	Message[PHOTO_UPLOAD_LOCKED] = "Upload is being written by another request."
+	Message[PHOTO_TOO_LARGE] = "Photo is too large."
+	Message[PHOTO_ACCESS_DENIED] = "No permission to access the photo."
+	Message[PHOTO_QUOTA_EXCEEDED] = "Storage quota exceeded."
+	Message[PHOTO_RENDER_SIZE_NOT_ALLOWED] = "Render size is not allowed."
+	Message[PHOTO_RENDER_ERROR] = "Photo can not be rendered."
+	Message[PHOTO_DUPLICATED] = "Photo duplicates an existing one."
+	Message[PHOTO_CONTENT_REJECTED] = "Photo content is not an allowed image."
+	Message[PHOTO_PRIVACY_DIRECT_UPLOAD_DENIED] = "Direct upload is not allowed by the privacy setting."
+	Message[PHOTO_SEARCH_QUERY_INVALID] = "Search query is invalid."
+	Message[PHOTO_SEARCH_REJECTED] = "Search is rejected, the query may be too complex."
+	Message[PHOTO_SEARCH_UNAVAILABLE] = "Search is unavailable for now, please retry later."
+	Message[PHOTO_TAG_SUGGEST_SUCCESS] = "Tag suggestion success."
+	Message[PHOTO_PRIVACY_STRIP_FAILED] = "Photo can not be stripped as the privacy setting requires."
+	Message[PHOTO_UPLOAD_WRONG_INSTANCE] = "Upload is spooled on another instance, see the Upload-Instance header."
+	Message[ADMIN_PERMISSION_DENIED] = "Admin permission is required."
+	Message[ADMIN_FAILED_JOBS_GET_SUCCESS] = "Failed jobs get success."
+	Message[ADMIN_REINDEX_STARTED] = "Reindex started."
+	Message[ADMIN_REINDEX_RUNNING] = "Reindex is running already."
+	Message[ADMIN_REINDEX_GET_SUCCESS] = "Reindex progress get success."
+	Message[ADMIN_REINDEX_NOT_EXIST] = "No reindex has run."
 }
 
 // Translate a response code to a detailed message.
@@ -0,0 +1,234 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"go.uber.org/zap"
+	"sync"
+)
+
+// A message carried by a transport, i.e. the topic & the JSON payload of an event.
+type Message struct {
+	Topic 		string
+	Payload 	[]byte
+}
+
+// A message delivered to a subscriber of a group, it's acked once it's handled.
+type Delivery struct {
+	Message
+	Ack 	func() error
+}
+
+// The transport which carries the events, e.g. redis so they reach every instance.
+type Transport interface {
+	// Publish a message to its topic.
+	Publish(message Message) error
+	// Subscribe the given topics, every subscriber gets every message,
+	// the returned channel is closed once the context is done.
+	Subscribe(ctx context.Context, topics []string) (<-chan Message, error)
+	// Subscribe the given topics in a group, each message goes to one subscriber of the group,
+	// the returned channel is closed once the context is done.
+	SubscribeGroup(ctx context.Context, group string, topics []string) (<-chan Delivery, error)
+}
+
+// A handler of the events subscribed.
+type Handler func(event Event)
+
+// A handler of the events subscribed in a group, an event is acked only if it's handled without an error.
+type GroupHandler func(event Event) error
+
+// The event bus.
+// 1. A subscriber gets every event published to its topics, e.g. every instance refreshing its cache.
+// 2. The subscribers of a group compete for the events, i.e. an event is handled by one of them,
+//    e.g. a job which must be done once no matter how many instances run.
+type Bus struct {
+	transport 	Transport
+	logger 		*zap.Logger
+}
+
+// Create an event bus on the given transport.
+func NewBus(transport Transport, logger *zap.Logger) *Bus {
+	return &Bus{transport: transport, logger: logger}
+}
+
+// Publish an event.
+func (bus *Bus) Publish(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := bus.transport.Publish(Message{Topic: event.Topic(), Payload: payload}); err != nil {
+		bus.logger.Info(err.Error(), zap.String("service", "Bus.Publish()"), zap.String("topic", event.Topic()))
+		return err
+	}
+	return nil
+}
+
+// Subscribe the given topics, the events are handled one by one in a background goroutine
+// until the context is done. A message which can't be decoded is dropped.
+func (bus *Bus) Subscribe(ctx context.Context, handler Handler, topics ...string) error {
+	messages, err := bus.transport.Subscribe(ctx, topics)
+	if err != nil {
+		bus.logger.Info(err.Error(), zap.String("service", "Bus.Subscribe()"))
+		return err
+	}
+
+	go func() {
+		for message := range messages {
+			event, err := Decode(message.Topic, message.Payload)
+			if err != nil {
+				bus.logger.Info(err.Error(), zap.String("service", "Bus.Subscribe()"),
+					zap.String("topic", message.Topic))
+				continue
+			}
+			handler(event)
+		}
+	}()
+	return nil
+}
+
+// Subscribe the given topics in a group, the events are handled one by one in a background goroutine
+// until the context is done. How an event which fails its handler is delivered again is up to the transport,
+// so a handler must be idempotent. A message which can't be decoded is dropped.
+func (bus *Bus) SubscribeGroup(ctx context.Context, group string, handler GroupHandler, topics ...string) error {
+	deliveries, err := bus.transport.SubscribeGroup(ctx, group, topics)
+	if err != nil {
+		bus.logger.Info(err.Error(), zap.String("service", "Bus.SubscribeGroup()"))
+		return err
+	}
+
+	go func() {
+		for delivery := range deliveries {
+			event, err := Decode(delivery.Topic, delivery.Payload)
+			if err == nil {
+				if err = handler(event); err == nil {
+					err = delivery.Ack()
+				}
+			} else {
+				delivery.Ack()	// it never decodes, so it's dropped
+			}
+			if err != nil {
+				bus.logger.Info(err.Error(), zap.String("service", "Bus.SubscribeGroup()"),
+					zap.String("group", group), zap.String("topic", delivery.Topic))
+			}
+		}
+	}()
+	return nil
+}
+
+// A transport within the process, for a single instance or tests.
+// A message delivered to a group is never delivered again, whether it's acked or not.
+// Every subscriber has a queue of its own, so publishing never waits for a slow subscriber.
+type MemoryTransport struct {
+	lock 		sync.RWMutex
+	subscribers map[*memorySubscriber]bool
+}
+
+type memorySubscriber struct {
+	ctx 		context.Context
+	group 		string	// empty if it's not in a group
+	topics 		map[string]bool
+	lock 		sync.Mutex
+	queue 		[]Message
+	ready 		chan struct{}	// signaled once a message is queued
+	messages 	chan Message
+}
+
+// Create a transport within the process.
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{subscribers: make(map[*memorySubscriber]bool)}
+}
+
+func (t *MemoryTransport) Publish(message Message) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	// the subscribers are iterated in a random order, so the messages of a group are spread over its subscribers
+	delivered := make(map[string]bool)
+	for subscriber := range t.subscribers {
+		if !subscriber.topics[message.Topic] || delivered[subscriber.group] {
+			continue
+		}
+		if subscriber.group != "" {
+			delivered[subscriber.group] = true
+		}
+		subscriber.push(message)
+	}
+	return nil
+}
+
+func (t *MemoryTransport) Subscribe(ctx context.Context, topics []string) (<-chan Message, error) {
+	return t.subscribe(ctx, "", topics), nil
+}
+
+func (t *MemoryTransport) SubscribeGroup(ctx context.Context, group string, topics []string) (<-chan Delivery, error) {
+	messages := t.subscribe(ctx, group, topics)
+	deliveries := make(chan Delivery)
+	go func() {
+		defer close(deliveries)
+		for message := range messages {
+			deliveries <- Delivery{Message: message, Ack: func() error { return nil }}
+		}
+	}()
+	return deliveries, nil
+}
+
+func (t *MemoryTransport) subscribe(ctx context.Context, group string, topics []string) chan Message {
+	subscriber := &memorySubscriber{
+		ctx: ctx,
+		group: group,
+		topics: make(map[string]bool),
+		ready: make(chan struct{}, 1),
+		messages: make(chan Message),
+	}
+	for _, topic := range topics {
+		subscriber.topics[topic] = true
+	}
+
+	t.lock.Lock()
+	t.subscribers[subscriber] = true
+	t.lock.Unlock()
+
+	go subscriber.pump()
+	go func() {
+		<-ctx.Done()
+		t.lock.Lock()
+		delete(t.subscribers, subscriber)
+		t.lock.Unlock()
+	}()
+	return subscriber.messages
+}
+
+// Queue a message without waiting.
+func (subscriber *memorySubscriber) push(message Message) {
+	subscriber.lock.Lock()
+	subscriber.queue = append(subscriber.queue, message)
+	subscriber.lock.Unlock()
+	select {
+	case subscriber.ready <- struct{}{}:
+	default:	// signaled already
+	}
+}
+
+// Pass the queued messages to the subscriber in order, the channel is closed once the context is done.
+func (subscriber *memorySubscriber) pump() {
+	defer close(subscriber.messages)
+	for {
+		subscriber.lock.Lock()
+		queue := subscriber.queue
+		subscriber.queue = nil
+		subscriber.lock.Unlock()
+
+		for _, message := range queue {
+			select {
+			case subscriber.messages <- message:
+			case <-subscriber.ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-subscriber.ready:
+		case <-subscriber.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package events
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+// Wait for the given number of events, or fail after a while.
+func waitEvents(t *testing.T, received <-chan Event, count int) []Event {
+	got := make([]Event, 0, count)
+	for len(got) < count {
+		select {
+		case event := <-received:
+			got = append(got, event)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d events, want %d", len(got), count)
+		}
+	}
+	return got
+}
+
+func TestMemoryBusFanOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := NewBus(NewMemoryTransport(), zap.NewNop())
+
+	received := make(chan Event, 8)
+	for i := 0;i < 2;i++ {
+		if err := bus.Subscribe(ctx, func(event Event) { received <- event }, TopicPhotoDeleted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bus.Publish(PhotoDeleted{PhotoID: 1})
+	bus.Publish(PhotoProcessed{PhotoID: 2})	// not subscribed
+
+	for _, event := range waitEvents(t, received, 2) {
+		if event.(PhotoDeleted).PhotoID != 1 {
+			t.Errorf("got %+v", event)
+		}
+	}
+	select {
+	case event := <-received:
+		t.Errorf("unexpected event %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBusGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := NewBus(NewMemoryTransport(), zap.NewNop())
+
+	// two groups of two subscribers, every group handles each event once
+	received := map[string]chan Event{"a": make(chan Event, 16), "b": make(chan Event, 16)}
+	for group, events := range received {
+		events := events
+		for i := 0;i < 2;i++ {
+			err := bus.SubscribeGroup(ctx, group, func(event Event) error {
+				events <- event
+				return nil
+			}, TopicPhotoUploaded)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 1;i <= 5;i++ {
+		bus.Publish(PhotoUploaded{PhotoID: uint(i)})
+	}
+
+	for group, events := range received {
+		seen := make(map[uint]bool)
+		for _, event := range waitEvents(t, events, 5) {
+			seen[event.(PhotoUploaded).PhotoID] = true
+		}
+		if len(seen) != 5 {
+			t.Errorf("group %s got %v", group, seen)
+		}
+		select {
+		case event := <-events:
+			t.Errorf("group %s got %+v twice", group, event)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestMemoryBusSlowSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := NewBus(NewMemoryTransport(), zap.NewNop())
+
+	// a subscriber stuck in its handler doesn't hold up the publishers or the other subscribers
+	release := make(chan struct{})
+	slow := make(chan Event, 128)
+	bus.Subscribe(ctx, func(event Event) {
+		<-release
+		slow <- event
+	}, TopicPhotoDeleted)
+	fast := make(chan Event, 128)
+	bus.Subscribe(ctx, func(event Event) { fast <- event }, TopicPhotoDeleted)
+
+	published := make(chan struct{})
+	go func() {
+		for i := 1;i <= 100;i++ {
+			bus.Publish(PhotoDeleted{PhotoID: uint(i)})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publishing is blocked by a slow subscriber")
+	}
+	waitEvents(t, fast, 100)
+
+	// the slow subscriber gets every event in order once it goes on
+	close(release)
+	for i, event := range waitEvents(t, slow, 100) {
+		if event.(PhotoDeleted).PhotoID != uint(i + 1) {
+			t.Fatalf("event %d is %+v", i, event)
+		}
+	}
+}
+
+func TestMemoryBusUnsubscribe(t *testing.T) {
+	transport := NewMemoryTransport()
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, _ := transport.Subscribe(ctx, []string{TopicPhotoDeleted})
+	transport.Publish(Message{Topic: TopicPhotoDeleted})
+	cancel()
+
+	// the channel is closed after the context is done, whether the messages are taken or not
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-messages:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("the channel is not closed")
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var UnknownTopicError = errors.New("unknown event topic")
+
+// The topics of the photo lifecycle events.
+const (
+	TopicPhotoUploaded 		= "photo.uploaded"
+	TopicPhotoUploadFailed 	= "photo.upload_failed"
+	TopicPhotoProcessed 	= "photo.processed"
+	TopicPhotoDeleted 		= "photo.deleted"
+)
+
+// An event published on the bus, it's encoded in JSON on the wire.
+type Event interface {
+	// Get the topic the event is published to.
+	Topic() string
+}
+
+// The file of a photo is stored & the photo has got its url.
+type PhotoUploaded struct {
+	PhotoID 	uint	`json:"photo_id"`
+	Url 		string	`json:"url"`
+}
+
+// The file of a photo fails to be stored & the photo is deleted.
+type PhotoUploadFailed struct {
+	PhotoID 	uint	`json:"photo_id"`
+	Reason 		string	`json:"reason"`
+}
+
+// An uploaded photo is processed, i.e. its EXIF, placeholder & derivatives are ready.
+type PhotoProcessed struct {
+	PhotoID 	uint	`json:"photo_id"`
+	Url 		string	`json:"url"`
+}
+
+// A photo is deleted.
+type PhotoDeleted struct {
+	PhotoID 	uint	`json:"photo_id"`
+	AuthID 		uint	`json:"auth_id"`
+	BucketID 	uint	`json:"bucket_id"`
+	Hash 		string	`json:"hash"`
+}
+
+func (PhotoUploaded) Topic() string {
+	return TopicPhotoUploaded
+}
+
+func (PhotoUploadFailed) Topic() string {
+	return TopicPhotoUploadFailed
+}
+
+func (PhotoProcessed) Topic() string {
+	return TopicPhotoProcessed
+}
+
+func (PhotoDeleted) Topic() string {
+	return TopicPhotoDeleted
+}
+
+// Decode the payload of an event by its topic.
+func Decode(topic string, payload []byte) (Event, error) {
+	switch topic {
+	case TopicPhotoUploaded:
+		event := PhotoUploaded{}
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicPhotoUploadFailed:
+		event := PhotoUploadFailed{}
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicPhotoProcessed:
+		event := PhotoProcessed{}
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case TopicPhotoDeleted:
+		event := PhotoDeleted{}
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	default:
+		return nil, UnknownTopicError
+	}
+}
@@ -0,0 +1,205 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis"
+	"os"
+	"strings"
+	"time"
+)
+
+// Every message is published both to a pub/sub channel & to a capped stream of its topic.
+// 1. The subscribers get the messages of the channels, so every instance gets every message,
+//    but a message is lost if it's published while an instance is not connected.
+// 2. The groups read the streams, so each message is handled by one subscriber of a group,
+//    & a message not acked is taken over by a subscriber after groupClaimIdle, even after a restart.
+const (
+	streamMaxLen 	= 10000
+	groupReadCount 	= 100
+	groupBlock 		= 5 * time.Second
+	groupClaimIdle 	= 5 * time.Minute
+	groupRetryDelay = time.Second
+)
+
+// A transport on redis pub/sub & streams.
+type RedisTransport struct {
+	client 	*redis.Client
+	prefix 	string	// prefixed to the topics as the channels
+}
+
+// Create a transport on the given redis client.
+func NewRedisTransport(client *redis.Client, prefix string) *RedisTransport {
+	return &RedisTransport{client: client, prefix: prefix}
+}
+
+// Get the stream of a topic.
+func (t *RedisTransport) streamKey(topic string) string {
+	return t.prefix + "stream:" + topic
+}
+
+func (t *RedisTransport) Publish(message Message) error {
+	pipe := t.client.TxPipeline()
+	pipe.Publish(t.prefix + message.Topic, message.Payload)
+	pipe.XAdd(&redis.XAddArgs{
+		Stream: t.streamKey(message.Topic),
+		MaxLenApprox: streamMaxLen,
+		Values: map[string]interface{}{"payload": string(message.Payload)},
+	})
+	_, err := pipe.Exec()
+	return err
+}
+
+func (t *RedisTransport) Subscribe(ctx context.Context, topics []string) (<-chan Message, error) {
+	channels := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		channels = append(channels, t.prefix + topic)
+	}
+	pubsub := t.client.Subscribe(channels...)
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	messages := make(chan Message)
+	go func() {
+		defer close(messages)
+		defer pubsub.Close()
+		received := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-received:
+				if !ok {
+					return
+				}
+				message := Message{Topic: msg.Channel[len(t.prefix):], Payload: []byte(msg.Payload)}
+				select {
+				case messages <- message:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return messages, nil
+}
+
+// The group starts with the messages published after it's created.
+func (t *RedisTransport) SubscribeGroup(ctx context.Context, group string, topics []string) (<-chan Delivery, error) {
+	streams := make([]string, 0, len(topics) * 2)
+	topicOf := make(map[string]string)
+	for _, topic := range topics {
+		stream := t.streamKey(topic)
+		err := t.client.XGroupCreateMkStream(stream, group, "$").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {	// the group exists already
+			return nil, err
+		}
+		streams = append(streams, stream)
+		topicOf[stream] = topic
+	}
+	for range topics {
+		streams = append(streams, ">")
+	}
+	hostname, _ := os.Hostname()
+	consumer := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+
+	deliveries := make(chan Delivery)
+	deliver := func(stream string, message redis.XMessage) bool {
+		payload, _ := message.Values["payload"].(string)
+		delivery := Delivery{
+			Message: Message{Topic: topicOf[stream], Payload: []byte(payload)},
+			Ack: func() error {
+				return t.client.XAck(stream, group, message.ID).Err()
+			},
+		}
+		select {
+		case deliveries <- delivery:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		defer close(deliveries)
+		for ctx.Err() == nil {
+			// the messages left by a stopped subscriber, or failing their handlers, go first
+			for _, stream := range streams[:len(topics)] {
+				for _, message := range t.claimStale(stream, group, consumer) {
+					if !deliver(stream, message) {
+						return
+					}
+				}
+			}
+
+			results, err := t.client.XReadGroup(&redis.XReadGroupArgs{
+				Group: group,
+				Consumer: consumer,
+				Streams: streams,
+				Count: groupReadCount,
+				Block: groupBlock,
+			}).Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				select {
+				case <-time.After(groupRetryDelay):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			for _, result := range results {
+				for _, message := range result.Messages {
+					if !deliver(result.Stream, message) {
+						return
+					}
+				}
+			}
+		}
+	}()
+	return deliveries, nil
+}
+
+// Take over the messages of a group pending too long.
+// A message trimmed from the stream before it's acked can't be claimed, it's acked as it's lost anyway.
+func (t *RedisTransport) claimStale(stream string, group string, consumer string) []redis.XMessage {
+	pending, err := t.client.XPendingExt(&redis.XPendingExtArgs{
+		Stream: stream,
+		Group: group,
+		Start: "-",
+		End: "+",
+		Count: groupReadCount,
+	}).Result()
+	if err != nil {
+		return nil
+	}
+	ids := make([]string, 0, len(pending))
+	for _, entry := range pending {
+		if entry.Idle >= groupClaimIdle {
+			ids = append(ids, entry.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	messages, err := t.client.XClaim(&redis.XClaimArgs{
+		Stream: stream,
+		Group: group,
+		Consumer: consumer,
+		MinIdle: groupClaimIdle,
+		Messages: ids,
+	}).Result()
+	if err == nil {
+		return messages
+	}
+	for _, id := range ids {
+		if found, err := t.client.XRange(stream, id, id).Result(); err == nil && len(found) == 0 {
+			t.client.XAck(stream, group, id)
+		}
+	}
+	return nil
+}
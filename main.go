@@ -1,14 +1,83 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"gin-photo-storage/conf"
+	"gin-photo-storage/models"
 	"gin-photo-storage/routers"
 	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"go.uber.org/zap"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 func main() {
+	// "-gc" collects the garbage once & exits, instead of running the server
+	runGC := flag.Bool("gc", false, "collect the garbage once and exit")
+	dryRun := flag.Bool("dry-run", false, "report the garbage without deleting it")
+	// "-reindex" rebuilds the photo index from the db once & exits
+	runReindex := flag.Bool("reindex", false, "rebuild the photo index from the db and exit")
+	flag.Parse()
+	models.InitDB()
+	if *runGC {
+		grace, _ := strconv.Atoi(conf.ServerCfg.Get(constant.GC_GRACE_MINUTE))
+		report := models.CollectGarbage(context.Background(), *dryRun, time.Duration(grace) * time.Minute)
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		if len(report.Errors) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if *runReindex {
+		report, err := models.Reindex(func(report *models.ReindexReport) {
+			fmt.Fprintf(os.Stderr, "%s: %d/%d indexed, %d failed\n", report.State, report.Indexed, report.Total, report.Failed)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		if report.State != models.ReindexDone {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// the background work stops once the server shuts down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// process the uploaded photos on the events in background
+	if err := models.ListenPhotoEvents(ctx); err != nil {
+		utils.AppLogger.Fatal(err.Error(), zap.String("service", "main()"))
+	}
+
+	// make sure the photo index is of the current mapping
+	if err := models.EnsurePhotoIndex(); err != nil {
+		utils.AppLogger.Fatal(err.Error(), zap.String("service", "main()"))
+	}
+
+	// collect the garbage in background
+	go models.RunGarbageCollector(ctx)
+
+	// relay the photo changes to elasticsearch in background
+	go models.RunOutboxRelay(ctx)
+
+	// run the queued upload jobs in background
+	models.RunUploadWorkers()
+
 	// get the global router
 	router := routers.Router
 
@@ -19,7 +88,22 @@ func main() {
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	// shut down the server gracefully on SIGINT / SIGTERM, the requests in process are finished first
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), constant.SHUTDOWN_TIMEOUT_SECOND * time.Second)
+		defer shutdownCancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "main()"))
+		}
+	}()
+
 	// run the server
-	server.ListenAndServeTLS("conf/server.crt", "conf/server.key")
-	//server.ListenAndServe()
+	err := server.ListenAndServeTLS("conf/server.crt", "conf/server.key")
+	//err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		utils.AppLogger.Fatal(err.Error(), zap.String("service", "main()"))
+	}
 }
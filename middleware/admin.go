@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// A wrapper function which returns the admin middleware, it must follow the auth middleware.
+// The admins are the users listed in the config file.
+func GetAdminMiddleware() gin.HandlerFunc {
+	admins := make(map[string]bool)
+	for _, userName := range strings.Split(conf.ServerCfg.Get(constant.ADMIN_USERS), ",") {
+		if userName = strings.TrimSpace(userName); userName != "" {
+			admins[userName] = true
+		}
+	}
+
+	return func(context *gin.Context) {
+		if admins[context.GetString("user_name")] {
+			context.Next()
+			return
+		}
+		context.JSON(http.StatusForbidden, gin.H{
+			"code": constant.ADMIN_PERMISSION_DENIED,
+			"data": make(map[string]string),
+			"msg": constant.GetMessage(constant.ADMIN_PERMISSION_DENIED),
+		})
+		context.Abort()
+	}
+}
@@ -12,9 +12,12 @@ type Auth struct {
 	UserName 	string `json:"user_name" gorm:"type:varchar(16)"`
 	Password 	string `json:"password" gorm:"type:varchar(255)"`
 	Email 		string `json:"email" gorm:"type:varchar(128)"`
+	Privacy 	PrivacyMode `json:"privacy" gorm:"type:varchar(16)"`
+	KeepExif 	*bool `json:"keep_exif" gorm:"type:tinyint(1)"`
 }
 
 var AuthExistsError = errors.New("auth already exists")
+var NoSuchAuthError = errors.New("no such auth")
 
 // Add a new auth.
 func AddAuth(username, password, email string) error {
@@ -57,4 +60,17 @@ func CheckAuth(username, password string) bool {
 		return true
 	}
 	return false
+}
+
+// Get an auth by its user name.
+func GetAuthByUserName(username string) (*Auth, error) {
+	trx := db.Begin()
+	defer trx.Commit()
+
+	auth := Auth{}
+	trx.Where("user_name = ?", username).First(&auth)
+	if auth.ID == 0 {
+		return nil, NoSuchAuthError
+	}
+	return &auth, nil
 }
\ No newline at end of file
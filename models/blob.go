@@ -0,0 +1,138 @@
+package models
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+)
+
+// A photo file in the storage, addressed by the SHA-256 hash of its content.
+// Photos with identical content share one blob, it's deleted with the last photo.
+type Blob struct {
+	BaseModel
+	Hash 		string	`json:"hash" gorm:"type:char(64);unique_index"`
+	Size 		int64	`json:"size" gorm:"type:bigint"`
+	RefCount 	int		`json:"ref_count" gorm:"type:int"`
+	State 		int		`json:"state" gorm:"type:tinyint(1)"`	// 0: uploading, 1: stored
+}
+
+// "blob" is a reserved word of MySQL, use another table name.
+func (Blob) TableName() string {
+	return "photo_blob"
+}
+
+// Get the key of a blob in the storage.
+func BlobKey(hash string) string {
+	return fmt.Sprintf(constant.BLOB_KEY_FORMAT, hash[:2], hash)
+}
+
+// Calculate the SHA-256 hash of a file, then rewind it.
+func hashFile(file io.ReadSeeker) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// Add a reference to the blob of the given hash, the blob is created if not exists.
+// It's one upsert, so two uploads of the same new content never both try to create the blob.
+func acquireBlob(trx *gorm.DB, hash string, size int64) (*Blob, error) {
+	err := trx.Exec("INSERT INTO photo_blob (hash, size, ref_count, state) VALUES (?, ?, 1, 0) " +
+		"ON DUPLICATE KEY UPDATE ref_count = ref_count + 1", hash, size).Error
+	if err != nil {
+		return nil, err
+	}
+	blob := Blob{}
+	err = trx.Where("hash = ?", hash).First(&blob).Error
+	return &blob, err
+}
+
+// Remove a reference to the blob of the given hash.
+// If it's the last reference, the blob record & its derivatives are deleted and their keys are returned,
+// the caller deletes the objects after the transaction commits.
+// A blob still uploading has no object yet, its upload deletes the object when it's stored, see dropStoredObject.
+func releaseBlob(trx *gorm.DB, hash string) ([]string, error) {
+	if hash == "" {
+		return nil, nil	// photos uploaded before content addressing have no blob
+	}
+
+	blob := Blob{}
+	trx.Set("gorm:query_option", "FOR UPDATE").Where("hash = ?", hash).First(&blob)
+	if blob.ID == 0 {
+		return nil, nil
+	}
+	if blob.RefCount > 1 {
+		return nil, trx.Model(&blob).Update("ref_count", gorm.Expr("ref_count - ?", 1)).Error
+	}
+	if err := trx.Delete(&blob).Error; err != nil {
+		return nil, err
+	}
+	if err := releaseExif(trx, hash); err != nil {
+		return nil, err
+	}
+	derivativeKeys, err := releaseDerivatives(trx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{BlobKey(hash)}, derivativeKeys...), nil
+}
+
+// Mark the blob of the given hash as stored.
+func markBlobStored(trx *gorm.DB, hash string) error {
+	return trx.Model(&Blob{}).Where("hash = ?", hash).Update("state", 1).Error
+}
+
+// Index all photos sharing the given blob again, with the data derived from the blob.
+func indexBlobPhotos(hash string) error {
+	photoIDs := make([]uint, 0)
+	if err := db.Model(&Photo{}).Where("hash = ?", hash).Pluck("id", &photoIDs).Error; err != nil {
+		return err
+	}
+	trx := db.Begin()
+	for _, photoID := range photoIDs {
+		if err := addOutboxEntry(trx, photoID, OutboxIndex); err != nil {
+			trx.Rollback()
+			return err
+		}
+	}
+	if err := trx.Commit().Error; err != nil {
+		return err
+	}
+	notifyOutbox()
+	return nil
+}
+
+// Delete the object of a blob stored after its photo is deleted, unless the blob is acquired again meanwhile.
+// The blob is selected for update, so it can't be acquired again until the object is deleted.
+func dropStoredObject(key string) error {
+	if !strings.HasPrefix(key, constant.BLOB_KEY_PREFIX) {
+		return nil	// the key of a photo uploaded before content addressing may be shared
+	}
+	trx := db.Begin()
+	blob := Blob{}
+	trx.Set("gorm:query_option", "FOR UPDATE").Where("hash = ?", objectHash(key)).First(&blob)
+	if blob.ID == 0 {
+		if err := utils.Store.Delete(key); err != nil {
+			trx.Rollback()
+			utils.AppLogger.Info(err.Error(), zap.String("service", "dropStoredObject()"))
+			return err
+		}
+	}
+	return trx.Commit().Error
+}
+
+// Delete an object which is no longer referenced.
+func deleteBlobObject(key string) {
+	if err := utils.Store.Delete(key); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "deleteBlobObject()"))
+	}
+}
@@ -14,7 +14,10 @@ type Bucket struct {
 	Name 		string	`json:"bucket_name" gorm:"type:varchar(64)" form:"bucket_name"`
 	State 		int		`json:"state" gorm:"type:tinyint(1)" form:"state"`
 	Size 		int		`json:"size" gorm:"type:int" form:"bucket_size"`
+	Bytes 		int64	`json:"bytes" gorm:"type:bigint" form:"-"`
 	Description string	`json:"description" gorm:"type:text" form:"description"`
+	Privacy 	PrivacyMode	`json:"privacy" gorm:"type:varchar(16)" form:"privacy"`	// empty to follow the user
+	KeepExif 	*bool	`json:"keep_exif" gorm:"type:tinyint(1)" form:"keep_exif"`	// nil to follow the user
 }
 
 var BucketExistsError = errors.New("bucket already exists")
@@ -38,7 +41,10 @@ func AddBucket(bucketToAdd *Bucket) error {
 	bucket.Name = bucketToAdd.Name
 	bucket.State = 1
 	bucket.Size = 0
+	bucket.Bytes = 0
 	bucket.Description = bucketToAdd.Description
+	bucket.Privacy = bucketToAdd.Privacy
+	bucket.KeepExif = bucketToAdd.KeepExif
 	if err := trx.Create(&bucket).Error; err != nil {
 		//log.Println(err)
 		utils.AppLogger.Info(err.Error(), zap.String("service", "AddBucket()"))
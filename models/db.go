@@ -1,7 +1,6 @@
 package models
 
 import (
-	"errors"
 	"fmt"
 	"gin-photo-storage/conf"
 	"gin-photo-storage/constant"
@@ -9,13 +8,10 @@ import (
 	_ "github.com/go-sql-driver/mysql" // remember to import mysql driver
 	"github.com/jinzhu/gorm"
 	"go.uber.org/zap"
-	"strconv"
-	"strings"
 	"time"
 )
 
 var db *gorm.DB
-var CallbackUpdateError = errors.New("callback update error")
 
 // The base model of all models, including ID & CreatedAt & UpdatedAt.
 type BaseModel struct {
@@ -24,8 +20,8 @@ type BaseModel struct {
 	UpdatedAt 	time.Time 	`json:"updated_at" gorm:"default: CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP" form:"updated_at"`
 }
 
-// Init the database connection.
-func init() {
+// Init the database connection, it's called once before the db is used.
+func InitDB() {
 	dbType := conf.ServerCfg.Get(constant.DB_TYPE)
 	dbHost := conf.ServerCfg.Get(constant.DB_HOST)
 	dbPort := conf.ServerCfg.Get(constant.DB_PORT)
@@ -37,7 +33,7 @@ func init() {
 	db, err = gorm.Open(dbType, fmt.Sprintf(constant.DB_CONNECT, dbUser, dbPwd, dbHost, dbPort, dbName))
 	if err != nil {
 		//log.Fatalln("Fail to connect database!")
-		utils.AppLogger.Fatal(err.Error(), zap.String("service", "init()"))
+		utils.AppLogger.Fatal(err.Error(), zap.String("service", "InitDB()"))
 	}
 
 	db.SingularTable(true)
@@ -47,48 +43,33 @@ func init() {
 	if !db.HasTable(&Bucket{}) {
 		db.CreateTable(&Bucket{})
 	}
-	if !db.HasTable(&Photo{}) {
-		db.CreateTable(&Photo{})
+	if !db.HasTable(&Blob{}) {
+		db.CreateTable(&Blob{})
+	}
+	if !db.HasTable(&Quota{}) {
+		db.CreateTable(&Quota{})
+	}
+	if !db.HasTable(&Derivative{}) {
+		db.CreateTable(&Derivative{})
+	}
+	if !db.HasTable(&Exif{}) {
+		db.CreateTable(&Exif{})
+	}
+	if !db.HasTable(&OutboxEntry{}) {
+		db.CreateTable(&OutboxEntry{})
 	}
 
-	go ListenRedisCallback()	// launch a background goroutine to listen to callbacks from redis
-}
-
-// Listen to callback messages from redis channels.
-// 1. When a photo is uploaded successfully, the callback asks to update the photo url in the db.
-// 2. When it fails to upload a photo, the callback asks to delete the photo record in the db.
-func ListenRedisCallback() {
-
-	// wait until utils package is initialized
-	<- utils.InitComplete
-
-	// subscribe redis channels
-	updateChan := utils.RedisClient.Subscribe(constant.URL_UPDATE_CHANNEL).Channel()
-	deleteChan := utils.RedisClient.Subscribe(constant.PHOTO_DELETE_CHANNEL).Channel()
+	// auto migration creates the table or adds the columns introduced later
+	db.AutoMigrate(&Auth{}, &Bucket{}, &Photo{})
 
-	// loop and listen
-	for {
-		select {
-		case msg := <-updateChan:
-			photoID, _ := strconv.Atoi(msg.Payload[:strings.Index(msg.Payload, "-")])
-			photoUrl := msg.Payload[strings.Index(msg.Payload, "-") + 1:]
-			dbErr := UpdatePhotoUrl(uint(photoID), photoUrl)
-			esErr := AddPhotoUrl(uint(photoID), photoUrl)
-			if dbErr != nil || esErr != nil {
-				//log.Println(CallbackUpdateError)
-				utils.AppLogger.Info(CallbackUpdateError.Error(), zap.String("service", "ListenRedisCallBack()"))
-			} else {
-				utils.SetUploadStatus(fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photoID), 0)
-			}
-		case msg := <- deleteChan:
-			photoID, _ := strconv.Atoi(msg.Payload)
-			if err := DeletePhotoByID(uint(photoID)); err != nil {
-				//log.Println(err)
-				utils.AppLogger.Info(err.Error(), zap.String("service", "ListenRedisCallBack()"))
-			} else {
-				utils.SetUploadStatus(fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photoID), -1)
-			}
-		default:
+	// the perceptual hash bands are introduced later, index them & fill them for the photos hashed before
+	for band := 0;band < hashBandCount;band++ {
+		column := fmt.Sprintf("phash_band%d", band)
+		if index := "idx_aid_" + column; !db.Dialect().HasIndex("photo", index) {
+			db.Model(&Photo{}).AddIndex(index, "auth_id", column)
 		}
 	}
-}
\ No newline at end of file
+	db.Exec("UPDATE photo SET phash_band0 = SUBSTRING(perceptual_hash, 1, 4), " +
+		"phash_band1 = SUBSTRING(perceptual_hash, 5, 4), phash_band2 = SUBSTRING(perceptual_hash, 9, 4), " +
+		"phash_band3 = SUBSTRING(perceptual_hash, 13, 4) WHERE perceptual_hash <> '' AND phash_band0 = ''")
+}
@@ -8,6 +8,8 @@ create table if not exists `auth`
 	user_name varchar(16) unique not null,
 	password varchar(255) not null,
 	email varchar(128) not null,
+	privacy varchar(16) default '',
+	keep_exif tinyint(1) default null,
 	created_at timestamp default CURRENT_TIMESTAMP,
 	updated_at timestamp default CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 ) CHARSET=utf8mb4;
@@ -19,7 +21,10 @@ create table if not exists `bucket`
 	name varchar(64) not null,
 	state tinyint(1) default 1,
 	size int default 0,
+	bytes bigint default 0,
 	description text,
+	privacy varchar(16) default '',
+	keep_exif tinyint(1) default null,
 	created_at timestamp default CURRENT_TIMESTAMP,
 	updated_at timestamp default CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 	CONSTRAINT UC_bucket UNIQUE(auth_id, name),
@@ -36,8 +41,98 @@ create table if not exists `photo`
 	url varchar(255) not null,
 	description text,
 	state tinyint(1) default 1,
+	hash char(64),
+	size bigint default 0,
+	perceptual_hash char(16) default '',
+	phash_band0 char(4) default '',
+	phash_band1 char(4) default '',
+	phash_band2 char(4) default '',
+	phash_band3 char(4) default '',
+	duplicate_of int default 0,
+	mime_type varchar(32) default '',
+	width int default 0,
+	height int default 0,
+	blur_hash varchar(64) default '',
+	dominant_color char(7) default '',
+	palette varchar(64) default '',
 	created_at timestamp default CURRENT_TIMESTAMP,
 	updated_at timestamp default CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 	constraint UC_photo UNIQUE(bucket_id, name),
-	INDEX idx_bid_name (bucket_id, name)
+	INDEX idx_bid_name (bucket_id, name),
+	INDEX idx_hash (hash),
+	INDEX idx_aid_phash (auth_id, perceptual_hash),
+	INDEX idx_aid_phash_band0 (auth_id, phash_band0),
+	INDEX idx_aid_phash_band1 (auth_id, phash_band1),
+	INDEX idx_aid_phash_band2 (auth_id, phash_band2),
+	INDEX idx_aid_phash_band3 (auth_id, phash_band3)
+) CHARSET=utf8mb4;
+
+create table if not exists `photo_blob`
+(
+	id int primary key auto_increment,
+	hash char(64) unique not null,
+	size bigint default 0,
+	ref_count int default 0,
+	state tinyint(1) default 0,
+	created_at timestamp default CURRENT_TIMESTAMP,
+	updated_at timestamp default CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) CHARSET=utf8mb4;
+
+create table if not exists `quota`
+(
+	id int primary key auto_increment,
+	auth_id int not null,
+	bucket_id int default 0,
+	max_photos int default 0,
+	max_bytes bigint default 0,
+	created_at timestamp default CURRENT_TIMESTAMP,
+	updated_at timestamp default CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+	constraint UC_quota UNIQUE(auth_id, bucket_id)
+) CHARSET=utf8mb4;
+
+create table if not exists `photo_derivative`
+(
+	id int primary key auto_increment,
+	hash char(64) not null,
+	name varchar(16) not null,
+	width int default 0,
+	height int default 0,
+	object_key varchar(255) not null,
+	size bigint default 0,
+	created_at timestamp default CURRENT_TIMESTAMP,
+	updated_at timestamp default CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+	INDEX idx_hash (hash)
+) CHARSET=utf8mb4;
+
+create table if not exists `photo_exif`
+(
+	id int primary key auto_increment,
+	hash char(64) unique not null,
+	make varchar(64),
+	model varchar(64),
+	lens_model varchar(128),
+	exposure_time varchar(16),
+	f_number double default 0,
+	iso int default 0,
+	focal_length double default 0,
+	taken_at datetime,
+	orientation tinyint default 0,
+	latitude double,
+	longitude double,
+	created_at timestamp default CURRENT_TIMESTAMP,
+	updated_at timestamp default CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) CHARSET=utf8mb4;
+
+create table if not exists `outbox`
+(
+	id int primary key auto_increment,
+	photo_id int not null,
+	operation varchar(16) not null,
+	attempts int default 0,
+	next_attempt_at timestamp default CURRENT_TIMESTAMP,
+	last_error varchar(255) default '',
+	created_at timestamp default CURRENT_TIMESTAMP,
+	updated_at timestamp default CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+	INDEX idx_pid (photo_id),
+	INDEX idx_next_attempt (next_attempt_at)
 ) CHARSET=utf8mb4;
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A scaled-down copy of a blob, e.g. a thumbnail for grid views.
+// Derivatives belong to the blob, so photos sharing a file share them as well.
+type Derivative struct {
+	BaseModel
+	Hash 		string	`json:"hash" gorm:"type:char(64);index"`
+	Name 		string	`json:"name" gorm:"type:varchar(16)"`	// the configured size, e.g. "256"
+	Width 		int		`json:"width" gorm:"type:int"`
+	Height 		int		`json:"height" gorm:"type:int"`
+	ObjectKey 	string	`json:"object_key" gorm:"type:varchar(255)"`
+	Size 		int64	`json:"size" gorm:"type:bigint"`
+}
+
+// Keep the table name in line with the blob table.
+func (Derivative) TableName() string {
+	return "photo_derivative"
+}
+
+// Get the configured derivative sizes, each one is the max width & height of a derivative.
+func derivativeSizes() []int {
+	sizes := make([]int, 0)
+	for _, field := range strings.Split(conf.ServerCfg.Get(constant.DERIVATIVE_SIZES), ",") {
+		if size, err := strconv.Atoi(strings.TrimSpace(field)); err == nil && size > 0 {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
+
+// Generate the missing derivatives of an uploaded photo.
+func GenerateDerivatives(photoID uint) error {
+	photo, err := GetPhotoByID(photoID)
+	if err != nil {
+		return err
+	}
+	if photo.Hash == "" {
+		return nil	// photos uploaded before content addressing have no blob
+	}
+
+	lockKey := fmt.Sprintf(constant.DERIVATIVE_LOCK_FORMAT, photo.Hash)
+	lock := utils.AcquireLock(lockKey, constant.DERIVATIVE_LOCK_MINUTE * time.Minute)
+	if lock == nil {
+		return nil	// being generated by another upload of the same file
+	}
+	defer lock.Release()
+	defer lock.KeepAlive(constant.DERIVATIVE_LOCK_MINUTE * time.Minute)()
+
+	existed := make(map[string]bool)
+	for name := range getThumbnails([]string{photo.Hash})[photo.Hash] {
+		existed[name] = true
+	}
+	missing := make([]int, 0)
+	for _, size := range derivativeSizes() {
+		if !existed[strconv.Itoa(size)] {
+			missing = append(missing, size)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := generateDerivatives(photo, missing); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "GenerateDerivatives()"))
+		return err
+	}
+	return nil
+}
+
+// Decode the original file once & generate the derivatives of the given sizes.
+func generateDerivatives(photo *Photo, sizes []int) error {
+	object, err := utils.Store.Stat(photo.ObjectKey())
+	if err != nil {
+		return err
+	}
+	reader := utils.NewObjectReader(object.Key, object.Size)
+	defer reader.Close()
+	img, srcFormat, err := utils.DecodeImage(reader, constant.IMAGE_MAX_PIXELS)
+	if err != nil {
+		return err
+	}
+
+	format := utils.DerivativeFormat(srcFormat)
+	for _, size := range sizes {
+		scaled := utils.FitImage(img, size, size)
+		buffer := bytes.Buffer{}
+		if err := utils.EncodeImage(&buffer, scaled, format, constant.DERIVATIVE_QUALITY); err != nil {
+			return err
+		}
+
+		derivative := Derivative{
+			Hash: photo.Hash,
+			Name: strconv.Itoa(size),
+			Width: scaled.Bounds().Dx(),
+			Height: scaled.Bounds().Dy(),
+			ObjectKey: fmt.Sprintf(constant.DERIVATIVE_KEY_FORMAT, photo.Hash, size, format),
+			Size: int64(buffer.Len()),
+		}
+		if err := utils.Store.Put(derivative.ObjectKey, &buffer, derivative.Size); err != nil {
+			return err
+		}
+		if err := db.Create(&derivative).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the thumbnail urls of the given blobs, grouped by hash & then by size name.
+func getThumbnails(hashes []string) map[string]map[string]string {
+	thumbnails := make(map[string]map[string]string)
+	if len(hashes) == 0 {
+		return thumbnails
+	}
+
+	derivatives := make([]Derivative, 0)
+	if err := db.Where("hash IN (?)", hashes).Find(&derivatives).Error; err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "getThumbnails()"))
+		return thumbnails
+	}
+	for _, derivative := range derivatives {
+		if derivative.Name == sharedDerivativeName {
+			continue	// not a thumbnail, it's the photo url
+		}
+		if _, ok := thumbnails[derivative.Hash]; !ok {
+			thumbnails[derivative.Hash] = make(map[string]string)
+		}
+		thumbnails[derivative.Hash][derivative.Name] = utils.Store.Url(derivative.ObjectKey)
+	}
+	return thumbnails
+}
+
+// Fill in the thumbnail urls of the given photos.
+func loadThumbnails(photos []Photo) {
+	hashes := make([]string, 0, len(photos))
+	for _, photo := range photos {
+		if photo.Hash != "" {
+			hashes = append(hashes, photo.Hash)
+		}
+	}
+	thumbnails := getThumbnails(hashes)
+	for i := 0;i < len(photos);i++ {
+		photos[i].Thumbnails = thumbnails[photos[i].Hash]
+	}
+}
+
+// Delete the derivative records of a blob, their keys are returned,
+// the caller deletes the objects after the transaction commits.
+func releaseDerivatives(trx *gorm.DB, hash string) ([]string, error) {
+	keys := make([]string, 0)
+	if err := trx.Model(&Derivative{}).Where("hash = ?", hash).Pluck("object_key", &keys).Error; err != nil {
+		return nil, err
+	}
+	if err := trx.Where("hash = ?", hash).Delete(Derivative{}).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,241 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var NoSuchUploadError = errors.New("no such upload")
+var UploadVerifyError = errors.New("uploaded file does not match")
+var UploadStatusError = errors.New("fail to save upload status")
+var UploadAccessError = errors.New("no permission to access the upload")
+
+// The info of a direct upload, saved until the client confirms it.
+// The client uploads to a staging key of its own, the object is promoted to its blob key once it's verified.
+type DirectUpload struct {
+	PhotoID 	uint	`json:"photo_id"`
+	Key 		string	`json:"key"`
+	Size 		int64	`json:"size"`
+	Checksum 	string	`json:"checksum"`
+}
+
+// Add a new photo whose file is uploaded by the client directly to the storage.
+// Returns the photo, the upload id & the presigned upload url.
+// The checksum is only trusted after the uploaded object is verified, so the file is always uploaded,
+// even if the same content is stored already.
+// Buckets stripping the original files can't take direct uploads.
+func AddPhotoDirect(photoToAdd *Photo, size int64, checksum string) (*Photo, string, string, error) {
+	if size > MaxUploadBytes() {
+		return nil, "", "", UploadTooLargeError
+	}
+	if err := checkDirectUploadPrivacy(photoToAdd.AuthID, photoToAdd.BucketID); err != nil {
+		return nil, "", "", err
+	}
+
+	randomKey := make([]byte, 16)
+	if _, err := rand.Read(randomKey); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhotoDirect()"))
+		return nil, "", "", err
+	}
+	key := fmt.Sprintf(constant.DIRECT_UPLOAD_OBJECT_FORMAT, randomKey)
+
+	// sign the url first, so no photo is created if the storage can't do it
+	uploadUrl, err := utils.PresignPut(key, constant.DIRECT_UPLOAD_EXPIRE_MINUTE * time.Minute)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhotoDirect()"))
+		return nil, "", "", err
+	}
+
+	photo, _, err := createPhoto(photoToAdd, size,
+		resolvePrivacy(photoToAdd.AuthID, photoToAdd.BucketID).Mode)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	uploadID := fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photo.ID)
+	info, _ := json.Marshal(&DirectUpload{
+		PhotoID: photo.ID,
+		Key: key,
+		Size: size,
+		Checksum: strings.ToLower(checksum),
+	})
+	if !utils.SetUploadStatus(uploadID, 1) ||
+		!utils.SetDirectUploadInfo(uploadID, string(info), constant.DIRECT_UPLOAD_INFO_EXPIRE_HOUR * time.Hour) {
+		return nil, "", "", UploadStatusError
+	}
+	return photo, uploadID, uploadUrl, nil
+}
+
+// Confirm a direct upload of the given auth, the uploaded object is verified by its size & SHA-256 checksum,
+// then its content is inspected like other uploads. If it's accepted, the object is promoted to its blob
+// & the photo is marked as uploaded, otherwise the photo is deleted.
+// The object is read once into a local file, which is hashed on the way & inspected afterwards.
+func ConfirmDirectUpload(uploadID string, authID uint) error {
+	info := utils.GetDirectUploadInfo(uploadID)
+	if info == "" {
+		return NoSuchUploadError
+	}
+	upload := DirectUpload{}
+	if err := json.Unmarshal([]byte(info), &upload); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ConfirmDirectUpload()"))
+		return NoSuchUploadError
+	}
+
+	// upload ids are predictable, only the owner of the photo can confirm it
+	photo, err := GetPhotoByID(upload.PhotoID)
+	if err == NoSuchPhotoError {
+		return NoSuchUploadError
+	} else if err != nil {
+		return err
+	}
+	if photo.AuthID != authID {
+		return UploadAccessError
+	}
+
+	// check the size first, it's much cheaper than the checksum
+	object, err := utils.Store.Stat(upload.Key)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ConfirmDirectUpload()"))
+		if err == utils.ObjectNotExistError {
+			return UploadVerifyError
+		}
+		return err
+	}
+	// the checksum kept by the storage saves downloading a mismatched object
+	if object.Size != upload.Size || (object.SHA256 != "" && object.SHA256 != upload.Checksum) {
+		return UploadVerifyError
+	}
+
+	file, checksum, err := downloadDirectUpload(upload.Key)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ConfirmDirectUpload()"))
+		return err
+	}
+	defer removeDownload(file)
+	if checksum != upload.Checksum {
+		return UploadVerifyError
+	}
+
+	content, err := inspectPhotoFile(file, object.Size)
+	if err == PhotoContentError {
+		utils.RemoveDirectUploadInfo(uploadID)
+		utils.SetUploadStatus(uploadID, -1)
+		if err := DeletePhotoByID(upload.PhotoID); err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "ConfirmDirectUpload()"))
+		}
+		deleteBlobObject(upload.Key)
+		return err
+	} else if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ConfirmDirectUpload()"))
+		return err
+	}
+
+	if err := promoteDirectUpload(&upload, content); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ConfirmDirectUpload()"))
+		return err
+	}
+
+	// verified, the photo gets its url, the upload can be confirmed again until then
+	err = completePhotoUpload(upload.PhotoID, utils.Store.Url(BlobKey(upload.Checksum)))
+	if err == NoSuchPhotoError {
+		err = dropStoredObject(BlobKey(upload.Checksum))
+	}
+	if err != nil {
+		return UploadStatusError
+	}
+	utils.RemoveDirectUploadInfo(uploadID)
+	deleteBlobObject(upload.Key)
+	return nil
+}
+
+// Download the object of a direct upload to a temp file in the spool dir, the file is rewound
+// & returned with the SHA-256 checksum of the object.
+func downloadDirectUpload(key string) (*os.File, string, error) {
+	spoolDir := conf.ServerCfg.Get(constant.UPLOAD_SPOOL_DIR)
+	if err := os.MkdirAll(spoolDir, 0755); err != nil {
+		return nil, "", err
+	}
+	file, err := ioutil.TempFile(spoolDir, "direct-")
+	if err != nil {
+		return nil, "", err
+	}
+
+	reader, err := utils.Store.Get(key)
+	if err == nil {
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(file, hash), reader)
+		reader.Close()
+		if err == nil {
+			if _, err = file.Seek(0, io.SeekStart); err == nil {
+				return file, fmt.Sprintf("%x", hash.Sum(nil)), nil
+			}
+		}
+	}
+	removeDownload(file)
+	return nil, "", err
+}
+
+// Close & remove a downloaded temp file.
+func removeDownload(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// Link the photo of a verified direct upload to the blob of its checksum,
+// the object is copied to the blob key by the storage unless the blob is stored already.
+// It can run again if the copy fails, the photo is linked only once.
+func promoteDirectUpload(upload *DirectUpload, content *photoContent) error {
+	trx := db.Begin()
+
+	photo := Photo{}
+	trx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", upload.PhotoID).First(&photo)
+	if photo.ID == 0 {
+		trx.Rollback()
+		return NoSuchUploadError
+	}
+
+	blob := &Blob{}
+	var err error
+	if photo.Hash == "" {
+		if blob, err = acquireBlob(trx, upload.Checksum, upload.Size); err != nil {
+			trx.Rollback()
+			return err
+		}
+		fields := perceptualHashFields(content.PerceptualHash)
+		fields["hash"] = upload.Checksum
+		fields["mime_type"] = content.MimeType
+		fields["width"] = content.Width
+		fields["height"] = content.Height
+		fields["blur_hash"] = content.Colors.BlurHash
+		fields["dominant_color"] = content.Colors.DominantColor
+		fields["palette"] = content.Colors.Palette
+		err = trx.Model(&photo).Updates(fields).Error
+		if err != nil {
+			trx.Rollback()
+			return err
+		}
+	} else {
+		trx.Where("hash = ?", photo.Hash).First(blob)
+	}
+	if err = trx.Commit().Error; err != nil {
+		return err
+	}
+	if blob.State == 1 {
+		return nil
+	}
+
+	// the content is verified, so it's the same as the blob of other uploads in progress
+	return utils.Store.Copy(upload.Key, BlobKey(upload.Checksum))
+}
@@ -0,0 +1,284 @@
+package models
+
+import (
+	"fmt"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var DuplicatePhotoError = errors.New("duplicate photo")
+
+// What to do when an added photo looks like an existing one of the user.
+type DuplicatePolicy string
+
+const (
+	DuplicateAllow 		DuplicatePolicy = ""
+	DuplicateReject 	DuplicatePolicy = "reject"	// the photo is not added
+	DuplicateFlag 		DuplicatePolicy = "flag"	// the photo is added with "duplicate_of" set
+)
+
+// Check if the policy is a known one.
+func (policy DuplicatePolicy) Valid() bool {
+	return policy == DuplicateAllow || policy == DuplicateReject || policy == DuplicateFlag
+}
+
+// Calculate the perceptual hash of a photo file in hex, then rewind the file.
+// A file which is not an image gets an empty hash.
+func perceptualHashFile(file io.ReadSeeker) (string, error) {
+	img, _, err := utils.DecodeImage(file, constant.IMAGE_MAX_PIXELS)
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		return "", seekErr
+	}
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "perceptualHashFile()"))
+		return "", nil
+	}
+	return fmt.Sprintf("%016x", utils.DifferenceHash(img)), nil
+}
+
+// Calculate the perceptual hash of an uploaded photo which doesn't have one,
+// e.g. a photo uploaded directly to the storage.
+func HashPhoto(photoID uint) error {
+	photo, err := GetPhotoByID(photoID)
+	if err != nil {
+		return err
+	}
+	if photo.PerceptualHash != "" {
+		return nil
+	}
+
+	object, err := utils.Store.Stat(photo.ObjectKey())
+	if err != nil {
+		return err
+	}
+	reader := utils.NewObjectReader(object.Key, object.Size)
+	defer reader.Close()
+	hash, err := perceptualHashFile(reader)
+	if err != nil || hash == "" {
+		return err
+	}
+	return db.Model(&Photo{}).Where("id = ?", photoID).Updates(perceptualHashFields(hash)).Error
+}
+
+// A perceptual hash is split into bands of 16 bits, saved apart & indexed. By the pigeonhole principle,
+// two hashes within a hamming distance d have a band within d / 4 bits, so the photos near a hash are
+// looked up by the band values near its bands, instead of comparing the hash to every photo.
+const hashBandCount = 4
+
+// Get the bands of a perceptual hash in hex, they are empty if there is no hash.
+func perceptualHashBands(perceptualHash string) [hashBandCount]string {
+	bands := [hashBandCount]string{}
+	if len(perceptualHash) == 16 {
+		for i := 0;i < hashBandCount;i++ {
+			bands[i] = perceptualHash[i * 4:i * 4 + 4]
+		}
+	}
+	return bands
+}
+
+// Get the fields to update the perceptual hash of a photo, with its bands.
+func perceptualHashFields(perceptualHash string) map[string]interface{} {
+	fields := map[string]interface{}{"perceptual_hash": perceptualHash}
+	for i, band := range perceptualHashBands(perceptualHash) {
+		fields[fmt.Sprintf("phash_band%d", i)] = band
+	}
+	return fields
+}
+
+// Get the band of a hash, the first band holds the highest bits.
+func hashBand(hash uint64, band int) uint16 {
+	return uint16(hash >> uint((hashBandCount - 1 - band) * 16))
+}
+
+// Get the band values within the hamming distance of a band value, including the value itself.
+func nearBandValues(value uint16, distance int) []uint16 {
+	values := []uint16{value}
+	var flip func(value uint16, from uint, left int)
+	flip = func(value uint16, from uint, left int) {
+		for bit := from;bit < 16 && left > 0;bit++ {
+			flipped := value ^ (1 << bit)
+			values = append(values, flipped)
+			flip(flipped, bit + 1, left - 1)
+		}
+	}
+	flip(value, 0, distance)
+	return values
+}
+
+// Find the most similar photo of the user to the given perceptual hash,
+// within the max hamming distance. Nil is returned if there is none.
+func findDuplicate(authID uint, perceptualHash string, maxDistance int) (*Photo, error) {
+	target, err := strconv.ParseUint(perceptualHash, 16, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the photos with a near band are compared
+	conditions := make([]string, 0, hashBandCount)
+	args := make([]interface{}, 0, hashBandCount)
+	for band := 0;band < hashBandCount;band++ {
+		values := make([]string, 0)
+		for _, value := range nearBandValues(hashBand(target, band), maxDistance / hashBandCount) {
+			values = append(values, fmt.Sprintf("%04x", value))
+		}
+		conditions = append(conditions, fmt.Sprintf("phash_band%d IN (?)", band))
+		args = append(args, values)
+	}
+	photos := make([]Photo, 0)
+	err = db.Select("id, perceptual_hash").
+		Where("auth_id = ?", authID).
+		Where(strings.Join(conditions, " OR "), args...).
+		Find(&photos).Error
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "findDuplicate()"))
+		return nil, err
+	}
+
+	var nearest *Photo
+	nearestDistance := maxDistance + 1
+	for i := 0;i < len(photos);i++ {
+		hash, err := strconv.ParseUint(photos[i].PerceptualHash, 16, 64)
+		if err != nil {
+			continue
+		}
+		if distance := utils.HammingDistance(target, hash); distance < nearestDistance {
+			nearest, nearestDistance = &photos[i], distance
+		}
+	}
+	return nearest, nil
+}
+
+// Find the duplicate photos of a user, photos within the max hamming distance are grouped together.
+// Only groups of more than one photo are returned, the groups & the photos in them are sorted by photo id,
+// a page of groups from the offset is returned.
+func GetDuplicatePhotos(authID uint, maxDistance int, offset int) ([][]Photo, error) {
+	photos := make([]Photo, 0)
+	err := db.Select("id, perceptual_hash").
+		Where("auth_id = ? AND perceptual_hash <> ?", authID, "").
+		Order("id").
+		Find(&photos).Error
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "GetDuplicatePhotos()"))
+		return nil, err
+	}
+
+	photoIDs := make([]uint, len(photos))
+	hashes := make([]uint64, len(photos))
+	for i, photo := range photos {
+		photoIDs[i] = photo.ID
+		hashes[i], _ = strconv.ParseUint(photo.PerceptualHash, 16, 64)
+	}
+	groups := groupDuplicates(hashes, maxDistance)
+
+	duplicates := make([][]Photo, 0, constant.PAGE_SIZE)
+	if offset >= len(groups) {
+		return duplicates, nil
+	}
+	if offset + constant.PAGE_SIZE < len(groups) {
+		groups = groups[:offset + constant.PAGE_SIZE]
+	}
+	pageIDs := make([]uint, 0)
+	for _, group := range groups[offset:] {
+		for _, i := range group {
+			pageIDs = append(pageIDs, photoIDs[i])
+		}
+	}
+	pagePhotos := make([]Photo, 0, len(pageIDs))
+	if err := db.Where("id IN (?)", pageIDs).Find(&pagePhotos).Error; err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "GetDuplicatePhotos()"))
+		return nil, err
+	}
+	photoByID := make(map[uint]Photo)
+	for _, photo := range pagePhotos {
+		photoByID[photo.ID] = photo
+	}
+
+	for _, group := range groups[offset:] {
+		duplicate := make([]Photo, 0, len(group))
+		for _, i := range group {
+			if photo, ok := photoByID[photoIDs[i]]; ok {
+				duplicate = append(duplicate, photo)
+			}
+		}
+		loadThumbnails(duplicate)
+		duplicates = append(duplicates, duplicate)
+	}
+	return duplicates, nil
+}
+
+// Group the hashes within the max hamming distance, near duplicates chain up into one group.
+// The groups of more than one hash are returned as indexes, in the order of their first hashes.
+// Equal hashes are grouped at once, the distinct ones are compared to those with a near band only.
+func groupDuplicates(hashes []uint64, maxDistance int) [][]int {
+	parents := make([]int, len(hashes))
+	for i := range parents {
+		parents[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parents[i] != i {
+			parents[i] = find(parents[i])
+		}
+		return parents[i]
+	}
+	union := func(i, j int) {
+		if rootI, rootJ := find(i), find(j); rootI < rootJ {
+			parents[rootJ] = rootI
+		} else {
+			parents[rootI] = rootJ
+		}
+	}
+
+	first := make(map[uint64]int)
+	distinct := make([]int, 0)
+	bands := make([]map[uint16][]int, hashBandCount)
+	for band := range bands {
+		bands[band] = make(map[uint16][]int)
+	}
+	for i, hash := range hashes {
+		if j, ok := first[hash]; ok {
+			union(j, i)
+			continue
+		}
+		first[hash] = i
+		distinct = append(distinct, i)
+		for band := 0;band < hashBandCount;band++ {
+			bands[band][hashBand(hash, band)] = append(bands[band][hashBand(hash, band)], i)
+		}
+	}
+	for _, i := range distinct {
+		for band := 0;band < hashBandCount;band++ {
+			for _, value := range nearBandValues(hashBand(hashes[i], band), maxDistance / hashBandCount) {
+				for _, j := range bands[band][value] {
+					if j > i && utils.HammingDistance(hashes[i], hashes[j]) <= maxDistance {
+						union(i, j)
+					}
+				}
+			}
+		}
+	}
+
+	groupIndex := make(map[int]int)
+	groups := make([][]int, 0)
+	for i := range hashes {
+		root := find(i)
+		if _, ok := groupIndex[root]; !ok {
+			groupIndex[root] = len(groups)
+			groups = append(groups, make([]int, 0))
+		}
+		groups[groupIndex[root]] = append(groups[groupIndex[root]], i)
+	}
+
+	duplicates := make([][]int, 0)
+	for _, group := range groups {
+		if len(group) > 1 {
+			duplicates = append(duplicates, group)
+		}
+	}
+	return duplicates
+}
@@ -8,45 +8,25 @@ import (
 	"fmt"
 	"gin-photo-storage/conf"
 	"gin-photo-storage/constant"
+	"gin-photo-storage/search"
 	"gin-photo-storage/utils"
 	"github.com/elastic/go-elasticsearch"
 	"github.com/elastic/go-elasticsearch/esapi"
 	"go.uber.org/zap"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var ESClient *elasticsearch.Client
 var PhotoIndexingError = errors.New("photo indexing error")
 var PhotoSearchError = errors.New("photo search error")
-var PhotoUpdateError = errors.New("photo update error")
-
-var SearchRequest = `{
-	"query": {
-		"bool": {
-			"must": [
-				{
-					"match": {
-						"%s": "%s"
-					}
-				},
-				{
-					"term": {
-						"auth_id": %d
-					}
-				}
-			]
-		}
-	}
-}`
-
-var AddPhotoUrlRequest = `{
-	"doc": {
-		"url": "%s"
-	}
-}`
-
-// search type which indicates if we are searching by tag or by description
-type SearchType string
+var PhotoDeleteIndexError = errors.New("photo delete index error")
+var PhotoScrollError = errors.New("photo scroll error")
+var PhotoIndexManageError = errors.New("photo index management error")
+var PhotoSearchRejectedError = errors.New("photo search is rejected by elasticsearch")
+var PhotoSearchUnavailableError = errors.New("photo search is unavailable")
 
 // Photo struct used in elasticsearch.
 type PhotoToIndex struct {
@@ -57,6 +37,225 @@ type PhotoToIndex struct {
 	Tags 		[]string	`json:"tags"`
 	Url			string		`json:"url"`
 	Description string		`json:"description"`
+	Thumbnails 	map[string]string	`json:"thumbnails,omitempty"`
+	PerceptualHash string	`json:"perceptual_hash,omitempty"`
+	BlurHash 	string		`json:"blur_hash,omitempty"`
+	DominantColor string	`json:"dominant_color,omitempty"`
+	Palette 	[]string	`json:"palette,omitempty"`
+	PaletteCodes []string	`json:"palette_codes,omitempty"`
+	Camera 		string		`json:"camera,omitempty"`
+	LensModel 	string		`json:"lens_model,omitempty"`
+	ExposureTime string		`json:"exposure_time,omitempty"`
+	FNumber 	float64		`json:"f_number,omitempty"`
+	ISO 		int			`json:"iso,omitempty"`
+	FocalLength float64		`json:"focal_length,omitempty"`
+	TakenAt 	*time.Time	`json:"taken_at,omitempty"`
+	CreatedAt 	time.Time	`json:"created_at"`
+	Location 	*GeoPoint	`json:"location,omitempty"`
+}
+
+// A geo point in elasticsearch.
+type GeoPoint struct {
+	Lat 	float64		`json:"lat"`
+	Lon 	float64		`json:"lon"`
+}
+
+// The requests & the responses of elasticsearch are typed & marshalled by encoding/json,
+// so the values from users are always escaped & never change the structure of a request.
+
+// A query clause, exactly one of the fields is set.
+// The field maps are keyed by the field searched.
+type esQuery struct {
+	Bool 		*esBoolQuery			`json:"bool,omitempty"`
+	Term 		map[string]interface{}	`json:"term,omitempty"`
+	Terms 		*esTermsQuery			`json:"terms,omitempty"`
+	Wildcard 	map[string]string		`json:"wildcard,omitempty"`
+	Match 		map[string]esMatch		`json:"match,omitempty"`
+	MatchPhrase map[string]string		`json:"match_phrase,omitempty"`
+	MultiMatch 	*esMultiMatch			`json:"multi_match,omitempty"`
+	Range 		map[string]esRange		`json:"range,omitempty"`
+	Script 		*esScriptQuery			`json:"script,omitempty"`
+}
+
+type esBoolQuery struct {
+	Must 				[]esQuery	`json:"must,omitempty"`
+	Filter 				[]esQuery	`json:"filter,omitempty"`
+	Should 				[]esQuery	`json:"should,omitempty"`
+	MustNot 			[]esQuery	`json:"must_not,omitempty"`
+	MinimumShouldMatch 	int			`json:"minimum_should_match,omitempty"`
+}
+
+// A terms query, the field & the boost share one object.
+type esTermsQuery struct {
+	Field 	string
+	Values 	[]string
+	Boost 	int
+}
+
+func (query esTermsQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{query.Field: query.Values, "boost": query.Boost})
+}
+
+type esScriptQuery struct {
+	Script 	esScript	`json:"script"`
+}
+
+// A painless script, the params are passed apart so the compiled script is cached.
+type esScript struct {
+	Source 	string					`json:"source"`
+	Params 	map[string]interface{}	`json:"params,omitempty"`
+}
+
+type esMatch struct {
+	Query 		string	`json:"query"`
+	Operator 	string	`json:"operator,omitempty"`
+}
+
+type esMultiMatch struct {
+	Query 	string		`json:"query"`
+	Type 	string		`json:"type"`
+	Fields 	[]string	`json:"fields"`
+}
+
+type esRange struct {
+	Gte 	string	`json:"gte,omitempty"`
+	Lt 		string	`json:"lt,omitempty"`
+	Format 	string	`json:"format,omitempty"`
+}
+
+// A sort field, "_score" sorts by relevance, a sort with a script sorts by the number it returns.
+type esSort struct {
+	Field 	string
+	Order 	string
+	Script 	*esScript
+}
+
+func (sort esSort) MarshalJSON() ([]byte, error) {
+	if sort.Script != nil {
+		return json.Marshal(map[string]interface{}{
+			"_script": map[string]interface{}{"type": "number", "script": sort.Script, "order": sort.Order},
+		})
+	}
+	if sort.Field == "_score" {
+		return json.Marshal(sort.Field)
+	}
+	// photos without the field go last, & an index without it yet is not an error
+	return json.Marshal(map[string]interface{}{
+		sort.Field: map[string]string{"order": sort.Order, "missing": "_last", "unmapped_type": "date"},
+	})
+}
+
+type esSearchRequest struct {
+	Query 			esQuery						`json:"query"`
+	Sort 			[]esSort					`json:"sort,omitempty"`
+	Aggregations 	map[string]esAggregation	`json:"aggs,omitempty"`
+}
+
+type esAggregation struct {
+	Terms 	*esTermsAggregation	`json:"terms,omitempty"`
+}
+
+// A terms aggregation, the buckets are ordered by the document count.
+type esTermsAggregation struct {
+	Field 	string	`json:"field"`
+	Size 	int		`json:"size"`
+	Include string	`json:"include,omitempty"`	// a regular expression of the terms
+}
+
+type esSearchResponse struct {
+	ScrollID 	string	`json:"_scroll_id"`
+	Hits 		struct {
+		Hits 	[]esHit		`json:"hits"`
+	}	`json:"hits"`
+	Aggregations 	map[string]esAggregationResult	`json:"aggregations"`
+}
+
+type esAggregationResult struct {
+	Buckets 	[]struct {
+		Key 		string	`json:"key"`
+		DocCount 	int		`json:"doc_count"`
+	}	`json:"buckets"`
+}
+
+type esHit struct {
+	ID 		string				`json:"_id"`
+	Source 	json.RawMessage		`json:"_source"`
+}
+
+// The action line of a bulk request.
+type esBulkAction struct {
+	Index 	*esBulkTarget	`json:"index,omitempty"`
+}
+
+type esBulkTarget struct {
+	Index 	string	`json:"_index"`
+	Type 	string	`json:"_type"`
+	ID 		string	`json:"_id"`
+}
+
+type esBulkResponse struct {
+	Items 	[]map[string]struct {
+		ID 		string		`json:"_id"`
+		Status 	int			`json:"status"`
+		Error 	*esErrorCause	`json:"error"`
+	}	`json:"items"`
+}
+
+// An action of an alias update, exactly one of the fields is set.
+type esAliasAction struct {
+	Add 		*esAliasTarget	`json:"add,omitempty"`
+	Remove 		*esAliasTarget	`json:"remove,omitempty"`
+	RemoveIndex *esAliasTarget	`json:"remove_index,omitempty"`
+}
+
+type esAliasTarget struct {
+	Index 	string	`json:"index"`
+	Alias 	string	`json:"alias,omitempty"`
+}
+
+type esErrorCause struct {
+	Type 	string	`json:"type"`
+	Reason 	string	`json:"reason"`
+}
+
+// An error replied by elasticsearch.
+type ESError struct {
+	Status 	int
+	esErrorCause
+}
+
+func (err *ESError) Error() string {
+	return fmt.Sprintf("elasticsearch error %d %s: %s", err.Status, err.Type, err.Reason)
+}
+
+// Decode the error of a failed response, the body is consumed.
+// The error is an object in most responses, but a string in some, e.g. a missing alias.
+func decodeESError(res *esapi.Response) *ESError {
+	esErr := &ESError{Status: res.StatusCode}
+	errorRes := struct {
+		Error 	json.RawMessage		`json:"error"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&errorRes); err != nil || len(errorRes.Error) == 0 {
+		esErr.Reason = http.StatusText(res.StatusCode)
+		return esErr
+	}
+	if err := json.Unmarshal(errorRes.Error, &esErr.esErrorCause); err != nil {
+		json.Unmarshal(errorRes.Error, &esErr.Reason)
+	}
+	return esErr
+}
+
+// Translate the error of a failed search, a bad request is rejected by elasticsearch,
+// i.e. the query is invalid or too large, & a missing index or an overloaded cluster is unavailable.
+func searchError(esErr *ESError) error {
+	switch {
+	case esErr.Status == http.StatusBadRequest:
+		return PhotoSearchRejectedError
+	case esErr.Status == http.StatusNotFound || esErr.Status == http.StatusTooManyRequests ||
+		esErr.Status >= http.StatusInternalServerError:
+		return PhotoSearchUnavailableError
+	}
+	return PhotoSearchError
 }
 
 // Init elasticsearch client.
@@ -81,15 +280,7 @@ func init() {
 func IndexPhoto(photo *Photo) error {
 
 	// the document we want to index
-	photoToIndex := PhotoToIndex{
-		AuthID: photo.AuthID,
-		BucketID: photo.BucketID,
-		ID: photo.ID,
-		Name: photo.Name,
-		Tags: strings.Split(photo.Tag, ";"),
-		Url: photo.Url,
-		Description: photo.Description,
-	}
+	photoToIndex := newPhotoToIndex(photo)
 	body, _ := json.Marshal(&photoToIndex)
 
 	// set up index request
@@ -103,8 +294,7 @@ func IndexPhoto(photo *Photo) error {
 	if res, err := request.Do(context.Background(), ESClient); err == nil {
 		defer res.Body.Close()
 		if res.IsError() {
-			//log.Println("Photo indexing error")
-			utils.AppLogger.Info(PhotoIndexingError.Error(), zap.String("service", "IndexPhoto()"))
+			utils.AppLogger.Info(decodeESError(res).Error(), zap.String("service", "IndexPhoto()"))
 			return PhotoIndexingError
 		}
 	} else {
@@ -115,84 +305,483 @@ func IndexPhoto(photo *Photo) error {
 	return nil
 }
 
-// Add the photo url in elasticsearch.
-func AddPhotoUrl(photoID uint, url string) error {
-	queryBody := fmt.Sprintf(AddPhotoUrlRequest, url)
+// Build the document of a photo, its thumbnails & EXIF are expected to be loaded.
+func newPhotoToIndex(photo *Photo) PhotoToIndex {
+	photoToIndex := PhotoToIndex{
+		AuthID: photo.AuthID,
+		BucketID: photo.BucketID,
+		ID: photo.ID,
+		Name: photo.Name,
+		Tags: strings.Split(photo.Tag, ";"),
+		Url: photo.Url,
+		Description: photo.Description,
+		Thumbnails: photo.Thumbnails,
+		PerceptualHash: photo.PerceptualHash,
+		BlurHash: photo.BlurHash,
+		DominantColor: photo.DominantColor,
+		PaletteCodes: paletteCodes(photo.Palette),
+		CreatedAt: photo.CreatedAt,
+	}
+	if photo.Palette != "" {
+		photoToIndex.Palette = strings.Split(photo.Palette, ",")
+	}
+	if photoExif := photo.Exif; photoExif != nil {
+		photoToIndex.Camera = photoExif.Camera()
+		photoToIndex.LensModel = photoExif.LensModel
+		photoToIndex.ExposureTime = photoExif.ExposureTime
+		photoToIndex.FNumber = photoExif.FNumber
+		photoToIndex.ISO = photoExif.ISO
+		photoToIndex.FocalLength = photoExif.FocalLength
+		photoToIndex.TakenAt = photoExif.TakenAt
+		if photoExif.Latitude != nil && photoExif.Longitude != nil {
+			photoToIndex.Location = &GeoPoint{Lat: *photoExif.Latitude, Lon: *photoExif.Longitude}
+		}
+	}
+	return photoToIndex
+}
 
-	res, err := ESClient.Update(
-		conf.ServerCfg.Get(constant.ES_PHOTO_INDEX),
-		fmt.Sprintf("%d", photoID),
-		strings.NewReader(queryBody),
-		)
+// Search photo(s) of a user by a parsed query, see search/query.go for the syntax.
+// The photos are sorted by relevance, or by the given sort field ("-" prefix for descending order).
+func SearchPhoto(root *search.Node, authID uint, offset int, sort string) ([]PhotoToIndex, error) {
+	boolQuery := &esBoolQuery{Filter: []esQuery{{Term: map[string]interface{}{"auth_id": authID}}}}
+	addBoolClause(boolQuery, root)
+	request := esSearchRequest{Query: esQuery{Bool: boolQuery}, Sort: searchSort(sort)}
+	return searchPhotos(&request, offset, "SearchPhoto()")
+}
 
+// Search photo(s) with a palette color near the given hex color, i.e. the CIE76 difference is
+// within the tolerance. The photos with the nearest colors go first, unless a sort field is given.
+func SearchPhotoByColor(color string, tolerance float64, authID uint, offset int, sort string) ([]PhotoToIndex, error) {
+	lab, err := utils.ParseHexColor(color)
 	if err != nil {
-		//log.Println(err)
-		utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhotoUrl()"))
-		return PhotoUpdateError
+		return make([]PhotoToIndex, 0), err
 	}
 
-	if res.IsError() {
-		//log.Println(PhotoUpdateError)
-		utils.AppLogger.Info(PhotoUpdateError.Error(), zap.String("service", "AddPhotoUrl()"))
-		return PhotoUpdateError
-	} else {
-		defer res.Body.Close()
-		resMap := make(map[string]interface{})
-		if err := json.NewDecoder(res.Body).Decode(&resMap); err != nil {
-			//log.Println(err)
-			utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhotoUrl()"))
-			return PhotoUpdateError
-		} else {
-			if fmt.Sprintf("%d", resMap["updated"]) != "0" {
-				return nil	// update success
-			}
-		}
+	// the palette of a photo should have a color in any of the near cells, but a near cell may have colors
+	// a little beyond the tolerance, so the photos are filtered by the exact distance too
+	params := map[string]interface{}{"l": lab.L, "a": lab.A, "b": lab.B, "tolerance": tolerance}
+	boolQuery := &esBoolQuery{
+		Filter: []esQuery{
+			{Term: map[string]interface{}{"auth_id": authID}},
+			{Terms: &esTermsQuery{Field: constant.SEARCH_BY_COLOR, Values: nearPaletteCodes(lab, tolerance), Boost: 1}},
+			{Script: &esScriptQuery{Script: esScript{
+				Source: paletteDistanceScript + "return nearest <= params.tolerance;",
+				Params: params,
+			}}},
+		},
+	}
+	sortBy := searchSort(sort)
+	if sort == "" {
+		sortBy = []esSort{{Order: "asc", Script: &esScript{Source: paletteDistanceScript + "return nearest;", Params: params}}}
 	}
-	return PhotoUpdateError
+	request := esSearchRequest{Query: esQuery{Bool: boolQuery}, Sort: sortBy}
+	return searchPhotos(&request, offset, "SearchPhotoByColor()")
 }
 
-// Search photo(s) by the given field
-// 1. searchType = SEARCH_BY_TAG, the field is a tag
-// 2. searchType = SEARCH_BY_DESC, the field is a description
-func SearchPhoto(field string, authID uint, offset int, searchType SearchType) ([]PhotoToIndex, error) {
-	queryBody := fmt.Sprintf(SearchRequest, searchType, field, authID)
+// Run a search request, the hits are returned as photos.
+// A hit which can't be decoded is skipped, so one broken document doesn't break the whole page.
+func searchPhotos(request *esSearchRequest, offset int, service string) ([]PhotoToIndex, error) {
 	photos := make([]PhotoToIndex, 0, constant.PAGE_SIZE)
+	body, err := json.Marshal(request)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", service))
+		return photos, PhotoSearchError
+	}
 
 	res, err := ESClient.Search(
 		ESClient.Search.WithContext(context.Background()),
 		ESClient.Search.WithIndex(conf.ServerCfg.Get(constant.ES_PHOTO_INDEX)),
-		ESClient.Search.WithBody(strings.NewReader(queryBody)),
+		ESClient.Search.WithBody(bytes.NewReader(body)),
 		ESClient.Search.WithFrom(offset),
 		ESClient.Search.WithSize(constant.PAGE_SIZE),
 		)
-
 	if err != nil {
-		//log.Println(err)
-		utils.AppLogger.Info(err.Error(), zap.String("service", "SearchPhoto()"))
-		return photos, PhotoSearchError
+		utils.AppLogger.Info(err.Error(), zap.String("service", service))
+		return photos, PhotoSearchUnavailableError
 	}
+	defer res.Body.Close()
 
 	if res.IsError() {
-		//log.Println(PhotoSearchError)
-		utils.AppLogger.Info(PhotoSearchError.Error(), zap.String("service", "SearchPhoto()"))
+		esErr := decodeESError(res)
+		utils.AppLogger.Info(esErr.Error(), zap.String("service", service))
+		return photos, searchError(esErr)
+	}
+	searchRes := esSearchResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&searchRes); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", service))
 		return photos, PhotoSearchError
-	} else {
-		defer res.Body.Close()
-		resMap := make(map[string]interface{})
-		if err := json.NewDecoder(res.Body).Decode(&resMap); err != nil {
-			//log.Println(err)
-			utils.AppLogger.Info(err.Error(), zap.String("service", "SearchPhoto()"))
-			return photos, PhotoSearchError
+	}
+	for _, hit := range searchRes.Hits.Hits {
+		photo := PhotoToIndex{}
+		if err := json.Unmarshal(hit.Source, &photo); err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", service), zap.String("id", hit.ID))
+			continue
+		}
+		photos = append(photos, photo)
+	}
+	return photos, nil
+}
+
+// A tag suggested by a prefix, with the number of photos having it.
+type TagSuggestion struct {
+	Tag 	string	`json:"tag"`
+	Count 	int		`json:"count"`
+}
+
+// Suggest the tags of a user starting with the given prefix, optionally within a bucket (0 for all buckets).
+// The photos with a tag of the prefix are found by the edge n-grams of the tags, & their tags of the prefix
+// are counted, so the most used tags go first. The tags are suggested normalized as they are matched,
+// i.e. in lowercase & folded to ASCII.
+func SuggestTags(prefix string, authID uint, bucketID uint) ([]TagSuggestion, error) {
+	suggestions := make([]TagSuggestion, 0, constant.TAG_SUGGEST_SIZE)
+	// the tags are counted by their normalized values, so the prefix is normalized the same way
+	normalizedPrefix, err := analyzeTagPrefix(prefix)
+	if err != nil {
+		return suggestions, err
+	}
+	boolQuery := &esBoolQuery{
+		Filter: []esQuery{
+			{Term: map[string]interface{}{"auth_id": authID}},
+			{Match: map[string]esMatch{constant.SEARCH_BY_TAG + ".prefix": {Query: prefix}}},
+		},
+	}
+	if bucketID > 0 {
+		boolQuery.Filter = append(boolQuery.Filter, esQuery{Term: map[string]interface{}{"bucket_id": bucketID}})
+	}
+	request := esSearchRequest{
+		Query: esQuery{Bool: boolQuery},
+		Aggregations: map[string]esAggregation{
+			"tags": {Terms: &esTermsAggregation{
+				Field: constant.SEARCH_BY_TAG,
+				Size: constant.TAG_SUGGEST_SIZE,
+				Include: quoteRegexp(normalizedPrefix) + ".*",	// a photo has other tags too
+			}},
+		},
+	}
+	body, _ := json.Marshal(&request)
+
+	res, err := ESClient.Search(
+		ESClient.Search.WithContext(context.Background()),
+		ESClient.Search.WithIndex(conf.ServerCfg.Get(constant.ES_PHOTO_INDEX)),
+		ESClient.Search.WithBody(bytes.NewReader(body)),
+		ESClient.Search.WithSize(0),
+		)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "SuggestTags()"))
+		return suggestions, PhotoSearchUnavailableError
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		esErr := decodeESError(res)
+		utils.AppLogger.Info(esErr.Error(), zap.String("service", "SuggestTags()"))
+		return suggestions, searchError(esErr)
+	}
+	searchRes := esSearchResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&searchRes); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "SuggestTags()"))
+		return suggestions, PhotoSearchError
+	}
+	for _, bucket := range searchRes.Aggregations["tags"].Buckets {
+		suggestions = append(suggestions, TagSuggestion{Tag: bucket.Key, Count: bucket.DocCount})
+	}
+	return suggestions, nil
+}
+
+// Normalize a tag prefix by the search analyzer of the tag prefixes, which folds it as the tags are normalized.
+func analyzeTagPrefix(prefix string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"analyzer": "tag_prefix_search", "text": prefix})
+	res, err := ESClient.Indices.Analyze(
+		ESClient.Indices.Analyze.WithContext(context.Background()),
+		ESClient.Indices.Analyze.WithIndex(conf.ServerCfg.Get(constant.ES_PHOTO_INDEX)),
+		ESClient.Indices.Analyze.WithBody(bytes.NewReader(body)),
+		)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "analyzeTagPrefix()"))
+		return "", PhotoSearchUnavailableError
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		esErr := decodeESError(res)
+		utils.AppLogger.Info(esErr.Error(), zap.String("service", "analyzeTagPrefix()"))
+		return "", searchError(esErr)
+	}
+	analyzeRes := struct {
+		Tokens 	[]struct {
+			Token 	string	`json:"token"`
+		}	`json:"tokens"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&analyzeRes); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "analyzeTagPrefix()"))
+		return "", PhotoSearchError
+	}
+	// the keyword tokenizer keeps the prefix as one token
+	if len(analyzeRes.Tokens) == 0 {
+		return "", nil
+	}
+	return analyzeRes.Tokens[0].Token, nil
+}
+
+// Escape the reserved characters of a Lucene regular expression.
+func quoteRegexp(text string) string {
+	quoted := strings.Builder{}
+	for _, c := range text {
+		if strings.ContainsRune(`.?+*|{}[]()"\#@&<>~`, c) {
+			quoted.WriteRune('\\')
+		}
+		quoted.WriteRune(c)
+	}
+	return quoted.String()
+}
+
+// Build the sort of a search, by relevance after the sort field if any.
+func searchSort(sort string) []esSort {
+	if sort == "" {
+		return []esSort{{Field: "_score"}}
+	}
+	order := "asc"
+	if strings.HasPrefix(sort, "-") {
+		sort, order = sort[1:], "desc"
+	}
+	return []esSort{{Field: sort, Order: order}, {Field: "_score"}}
+}
+
+// Delete a photo from elasticsearch, deleting a non-existed photo is not an error.
+func DeletePhotoIndex(photoID uint) error {
+	res, err := ESClient.Delete(
+		conf.ServerCfg.Get(constant.ES_PHOTO_INDEX),
+		fmt.Sprintf("%d", photoID),
+		ESClient.Delete.WithRefresh("true"),
+		)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "DeletePhotoIndex()"))
+		return PhotoDeleteIndexError
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		utils.AppLogger.Info(decodeESError(res).Error(), zap.String("service", "DeletePhotoIndex()"))
+		return PhotoDeleteIndexError
+	}
+	return nil
+}
+
+// Scroll through the photos in elasticsearch created before the given time,
+// the ids are passed to the handler batch by batch.
+func ScrollPhotoIDs(batchSize int, before time.Time, handler func(photoIDs []uint) error) error {
+	request := esSearchRequest{Query: esQuery{Range: map[string]esRange{
+		"created_at": {Lt: before.UTC().Format(time.RFC3339)},
+	}}}
+	body, err := json.Marshal(&request)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ScrollPhotoIDs()"))
+		return PhotoScrollError
+	}
+
+	res, err := ESClient.Search(
+		ESClient.Search.WithContext(context.Background()),
+		ESClient.Search.WithIndex(conf.ServerCfg.Get(constant.ES_PHOTO_INDEX)),
+		ESClient.Search.WithBody(bytes.NewReader(body)),
+		ESClient.Search.WithScroll(time.Minute),
+		ESClient.Search.WithSize(batchSize),
+		ESClient.Search.WithSource("id"),
+		)
+
+	scrollID := ""
+	defer func() {
+		if scrollID != "" {
+			ESClient.ClearScroll(ESClient.ClearScroll.WithScrollID(scrollID))
+		}
+	}()
+	for {
+		if err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "ScrollPhotoIDs()"))
+			return PhotoScrollError
+		}
+
+		// the ids are taken from the document ids, which are the photo ids
+		scrollRes := esSearchResponse{}
+		if res.IsError() {
+			err = decodeESError(res)
 		} else {
-			// for each hit in the response, we marshal the source into the photo object
-			for _, hit := range resMap["hits"].(map[string]interface{})["hits"].([]interface{}) {
-				source, _ := json.Marshal(hit.(map[string]interface{})["_source"])
-				photo := PhotoToIndex{}
-				json.Unmarshal(source, &photo)
-				photos = append(photos, photo)
+			err = json.NewDecoder(res.Body).Decode(&scrollRes)
+		}
+		res.Body.Close()
+		if err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "ScrollPhotoIDs()"))
+			return PhotoScrollError
+		}
+
+		scrollID = scrollRes.ScrollID
+		if len(scrollRes.Hits.Hits) == 0 {
+			return nil
+		}
+		photoIDs := make([]uint, 0, len(scrollRes.Hits.Hits))
+		for _, hit := range scrollRes.Hits.Hits {
+			if photoID, err := strconv.Atoi(hit.ID); err == nil {
+				photoIDs = append(photoIDs, uint(photoID))
 			}
 		}
+		if err = handler(photoIDs); err != nil {
+			return err
+		}
+
+		res, err = ESClient.Scroll(
+			ESClient.Scroll.WithContext(context.Background()),
+			ESClient.Scroll.WithScrollID(scrollID),
+			ESClient.Scroll.WithScroll(time.Minute),
+			)
 	}
+}
 
-	return photos, nil
-}
\ No newline at end of file
+// Create an index for photos.
+func createPhotoIndex(index string) error {
+	res, err := ESClient.Indices.Create(index, ESClient.Indices.Create.WithBody(photoIndexRequestBody()))
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "createPhotoIndex()"))
+		return PhotoIndexManageError
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		utils.AppLogger.Info(decodeESError(res).Error(), zap.String("service", "createPhotoIndex()"))
+		return PhotoIndexManageError
+	}
+	return nil
+}
+
+// Delete indices, deleting a non-existed index is not an error.
+func deletePhotoIndices(indices []string) error {
+	if len(indices) == 0 {
+		return nil
+	}
+	res, err := ESClient.Indices.Delete(indices)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "deletePhotoIndices()"))
+		return PhotoIndexManageError
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		utils.AppLogger.Info(decodeESError(res).Error(), zap.String("service", "deletePhotoIndices()"))
+		return PhotoIndexManageError
+	}
+	return nil
+}
+
+// Make the latest changes of an index searchable.
+func refreshPhotoIndex(index string) error {
+	res, err := ESClient.Indices.Refresh(ESClient.Indices.Refresh.WithIndex(index))
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "refreshPhotoIndex()"))
+		return PhotoIndexManageError
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		utils.AppLogger.Info(decodeESError(res).Error(), zap.String("service", "refreshPhotoIndex()"))
+		return PhotoIndexManageError
+	}
+	return nil
+}
+
+// Index a batch of photos into the given index in one bulk request, the number of failed photos is returned.
+// Their thumbnails & EXIF are expected to be loaded.
+func bulkIndexPhotos(index string, photos []Photo) (int, error) {
+	body := bytes.Buffer{}
+	for i := 0;i < len(photos);i++ {
+		action, _ := json.Marshal(esBulkAction{
+			Index: &esBulkTarget{Index: index, Type: "_doc", ID: fmt.Sprintf("%d", photos[i].ID)},
+		})
+		document, _ := json.Marshal(newPhotoToIndex(&photos[i]))
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(document)
+		body.WriteByte('\n')
+	}
+
+	res, err := ESClient.Bulk(&body)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "bulkIndexPhotos()"))
+		return 0, PhotoIndexingError
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		utils.AppLogger.Info(decodeESError(res).Error(), zap.String("service", "bulkIndexPhotos()"))
+		return 0, PhotoIndexingError
+	}
+
+	// every item reports its own status
+	bulkRes := esBulkResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&bulkRes); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "bulkIndexPhotos()"))
+		return 0, PhotoIndexingError
+	}
+	failed := 0
+	for _, item := range bulkRes.Items {
+		for _, result := range item {
+			if result.Status >= http.StatusMultipleChoices {
+				esErr := &ESError{Status: result.Status}
+				if result.Error != nil {
+					esErr.esErrorCause = *result.Error
+				}
+				utils.AppLogger.Info(esErr.Error(), zap.String("service", "bulkIndexPhotos()"), zap.String("id", result.ID))
+				failed++
+			}
+		}
+	}
+	return failed, nil
+}
+
+// Point the alias to the given index in one atomic request, the indices it pointed to are returned.
+// An index named as the alias, i.e. one created before aliases are used, is removed in the same request.
+func swapPhotoAlias(alias string, index string) ([]string, error) {
+	oldIndices := make([]string, 0)
+	actions := make([]esAliasAction, 0)
+
+	res, err := ESClient.Indices.GetAlias(ESClient.Indices.GetAlias.WithName(alias))
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "swapPhotoAlias()"))
+		return nil, PhotoIndexManageError
+	}
+	aliasRes := make(map[string]json.RawMessage)	// keyed by the index names
+	if res.StatusCode == http.StatusOK {
+		err = json.NewDecoder(res.Body).Decode(&aliasRes)
+	}
+	res.Body.Close()
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "swapPhotoAlias()"))
+		return nil, PhotoIndexManageError
+	}
+	for oldIndex := range aliasRes {
+		if oldIndex != index {
+			oldIndices = append(oldIndices, oldIndex)
+			actions = append(actions, esAliasAction{Remove: &esAliasTarget{Index: oldIndex, Alias: alias}})
+		}
+	}
+
+	if len(oldIndices) == 0 {
+		res, err := ESClient.Indices.Exists([]string{alias})
+		if err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "swapPhotoAlias()"))
+			return nil, PhotoIndexManageError
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			actions = append(actions, esAliasAction{RemoveIndex: &esAliasTarget{Index: alias}})
+		}
+	}
+	actions = append(actions, esAliasAction{Add: &esAliasTarget{Index: index, Alias: alias}})
+
+	body, _ := json.Marshal(struct {
+		Actions 	[]esAliasAction	`json:"actions"`
+	}{actions})
+	res, err = ESClient.Indices.UpdateAliases(bytes.NewReader(body))
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "swapPhotoAlias()"))
+		return nil, PhotoIndexManageError
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		utils.AppLogger.Info(decodeESError(res).Error(), zap.String("service", "swapPhotoAlias()"))
+		return nil, PhotoIndexManageError
+	}
+	return oldIndices, nil
+}
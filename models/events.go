@@ -0,0 +1,93 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/events"
+	"gin-photo-storage/utils"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+var CallbackUpdateError = errors.New("callback update error")
+
+// Applies the results of the upload jobs to the photos, the jobs are acked only after that.
+// 1. When a photo is uploaded successfully, its url is updated in the db (& elasticsearch by the outbox),
+//    then the photo is processed, e.g. its EXIF is extracted.
+// 2. When it fails to upload a photo, the photo record is deleted from the db.
+// The events are published afterwards, as notifications only.
+type uploadResults struct{}
+
+// Run the upload workers of the instance in background.
+func RunUploadWorkers() {
+	utils.RunUploadWorkers(uploadResults{})
+}
+
+func (uploadResults) UploadStored(job *utils.UploadJob) error {
+	err := completePhotoUpload(job.PhotoID, utils.Store.Url(job.Key))
+	if err == NoSuchPhotoError {
+		return dropStoredObject(job.Key)
+	}
+	return err
+}
+
+func (uploadResults) UploadFailed(job *utils.UploadJob) error {
+	return failPhotoUpload(job.PhotoID, job.LastError)
+}
+
+// Process the uploaded photos on the events until the context is done, every photo is processed once
+// by one of the PHOTO_PROCESS_WORKERS subscribers of all instances.
+func ListenPhotoEvents(ctx context.Context) error {
+	workers, _ := strconv.Atoi(conf.ServerCfg.Get(constant.PHOTO_PROCESS_WORKERS))
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0;i < workers;i++ {
+		err := utils.Events.SubscribeGroup(ctx, constant.PHOTO_PROCESS_GROUP, handlePhotoEvent, events.TopicPhotoUploaded)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handlePhotoEvent(event events.Event) error {
+	if event, ok := event.(events.PhotoUploaded); ok {
+		ProcessPhoto(event.PhotoID)
+	}
+	return nil
+}
+
+// The file of a photo is stored, the photo gets its url & is processed on the event.
+// NoSuchPhotoError is returned if the photo is deleted before its file is stored.
+func completePhotoUpload(photoID uint, url string) error {
+	uploadID := fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photoID)
+	photoUrl, err := UpdatePhotoUrl(photoID, url)
+	if err == NoSuchPhotoError {
+		return err
+	}
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "completePhotoUpload()"))
+		return CallbackUpdateError
+	}
+	utils.SetUploadStatus(uploadID, 0)
+	utils.PublishUploadStage(uploadID, utils.UploadIndexed, photoUrl, "")
+	if err := utils.Events.Publish(events.PhotoUploaded{PhotoID: photoID, Url: photoUrl}); err != nil {
+		go ProcessPhoto(photoID)	// the bus is down, process it here
+	}
+	return nil
+}
+
+// The file of a photo fails to be stored, the photo is deleted.
+func failPhotoUpload(photoID uint, reason string) error {
+	if err := DeletePhotoByID(photoID); err != nil && err != NoSuchPhotoError {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "failPhotoUpload()"))
+		return err
+	}
+	utils.SetUploadStatus(fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photoID), -1)
+	utils.Events.Publish(events.PhotoUploadFailed{PhotoID: photoID, Reason: reason})
+	return nil
+}
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"fmt"
+	"gin-photo-storage/utils"
+	"github.com/jinzhu/gorm"
+	"github.com/rwcarlsen/goexif/exif"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+// The EXIF metadata of a blob, it's extracted once the file is uploaded.
+type Exif struct {
+	BaseModel
+	Hash 			string		`json:"-" gorm:"type:char(64);unique_index"`
+	Make 			string		`json:"make" gorm:"type:varchar(64)"`
+	Model 			string		`json:"model" gorm:"type:varchar(64)"`
+	LensModel 		string		`json:"lens_model" gorm:"type:varchar(128)"`
+	ExposureTime 	string		`json:"exposure_time" gorm:"type:varchar(16)"`	// e.g. "1/250"
+	FNumber 		float64		`json:"f_number" gorm:"type:double"`
+	ISO 			int			`json:"iso" gorm:"column:iso;type:int"`
+	FocalLength 	float64		`json:"focal_length" gorm:"type:double"`
+	TakenAt 		*time.Time	`json:"taken_at" gorm:"type:datetime"`
+	Orientation 	int			`json:"orientation" gorm:"type:tinyint"`
+	Latitude 		*float64	`json:"latitude" gorm:"type:double"`
+	Longitude 		*float64	`json:"longitude" gorm:"type:double"`
+}
+
+// Keep the table name in line with the blob table.
+func (Exif) TableName() string {
+	return "photo_exif"
+}
+
+// Get the camera of the photo, i.e. the make & the model.
+func (photoExif *Exif) Camera() string {
+	// the model often repeats the make, e.g. "Canon" & "Canon EOS 5D"
+	if strings.HasPrefix(strings.ToLower(photoExif.Model), strings.ToLower(photoExif.Make)) {
+		return photoExif.Model
+	}
+	return strings.TrimSpace(photoExif.Make + " " + photoExif.Model)
+}
+
+// Extract the EXIF metadata of an uploaded photo.
+// A photo without EXIF is not an error, nothing is saved for it.
+// The location is dropped if the photo is stripped & the privacy setting doesn't keep it.
+func ExtractExif(photoID uint) error {
+	photo, err := GetPhotoByID(photoID)
+	if err != nil {
+		return err
+	}
+	if photo.Hash == "" || photo.Exif != nil {
+		return nil	// no blob, or extracted already
+	}
+
+	object, err := utils.Store.Stat(photo.ObjectKey())
+	if err != nil {
+		return err
+	}
+	reader := utils.NewObjectReader(object.Key, object.Size)
+	defer reader.Close()
+	decoded, err := exif.Decode(reader)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ExtractExif()"))
+		return nil
+	}
+
+	photoExif := parseExif(decoded)
+	photoExif.Hash = photo.Hash
+	if privacy := resolvePrivacy(photo.AuthID, photo.BucketID); privacy.Mode != PrivacyKeep && !privacy.KeepExif {
+		photoExif.Latitude, photoExif.Longitude = nil, nil
+	}
+	if err := db.Create(photoExif).Error; err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ExtractExif()"))
+		return err
+	}
+	return nil
+}
+
+// Pick the fields we care about, missing or broken tags are left empty.
+func parseExif(decoded *exif.Exif) *Exif {
+	photoExif := Exif{}
+	stringTag := func(name exif.FieldName) string {
+		if tag, err := decoded.Get(name); err == nil {
+			if value, err := tag.StringVal(); err == nil {
+				return strings.TrimSpace(strings.Trim(value, "\x00"))
+			}
+		}
+		return ""
+	}
+	intTag := func(name exif.FieldName) int {
+		if tag, err := decoded.Get(name); err == nil {
+			if value, err := tag.Int(0); err == nil {
+				return value
+			}
+		}
+		return 0
+	}
+	ratTag := func(name exif.FieldName) float64 {
+		if tag, err := decoded.Get(name); err == nil {
+			if num, den, err := tag.Rat2(0); err == nil && den != 0 {
+				return float64(num) / float64(den)
+			}
+		}
+		return 0
+	}
+
+	photoExif.Make = stringTag(exif.Make)
+	photoExif.Model = stringTag(exif.Model)
+	photoExif.LensModel = stringTag(exif.LensModel)
+	photoExif.FNumber = ratTag(exif.FNumber)
+	photoExif.ISO = intTag(exif.ISOSpeedRatings)
+	photoExif.FocalLength = ratTag(exif.FocalLength)
+	photoExif.Orientation = intTag(exif.Orientation)
+	if tag, err := decoded.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && num > 0 && den > 0 {
+			if num >= den {
+				photoExif.ExposureTime = fmt.Sprintf("%g", float64(num) / float64(den))
+			} else {
+				photoExif.ExposureTime = fmt.Sprintf("1/%g", float64(den) / float64(num))
+			}
+		}
+	}
+	if takenAt, err := decoded.DateTime(); err == nil {
+		photoExif.TakenAt = &takenAt
+	}
+	if latitude, longitude, err := decoded.LatLong(); err == nil {
+		photoExif.Latitude = &latitude
+		photoExif.Longitude = &longitude
+	}
+	return &photoExif
+}
+
+// Get the EXIF metadata of the given blobs, grouped by hash.
+func getExifs(hashes []string) map[string]*Exif {
+	exifs := make(map[string]*Exif)
+	if len(hashes) == 0 {
+		return exifs
+	}
+
+	found := make([]Exif, 0)
+	if err := db.Where("hash IN (?)", hashes).Find(&found).Error; err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "getExifs()"))
+		return exifs
+	}
+	for i := 0;i < len(found);i++ {
+		exifs[found[i].Hash] = &found[i]
+	}
+	return exifs
+}
+
+// Fill in the EXIF metadata of the given photos.
+func loadExifs(photos []Photo) {
+	hashes := make([]string, 0, len(photos))
+	for _, photo := range photos {
+		if photo.Hash != "" {
+			hashes = append(hashes, photo.Hash)
+		}
+	}
+	exifs := getExifs(hashes)
+	for i := 0;i < len(photos);i++ {
+		photos[i].Exif = exifs[photos[i].Hash]
+	}
+}
+
+// Delete the EXIF metadata of a deleted blob.
+func releaseExif(trx *gorm.DB, hash string) error {
+	return trx.Where("hash = ?", hash).Delete(Exif{}).Error
+}
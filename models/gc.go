@@ -0,0 +1,334 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The garbage found (and deleted unless it's a dry run) by the garbage collector.
+type GarbageReport struct {
+	DryRun 				bool		`json:"dry_run"`
+	StalePhotos 		[]uint		`json:"stale_photos"`		// photos whose upload never completed
+	OrphanObjects 		[]string	`json:"orphan_objects"`		// objects in the storage without a blob or a photo, & expired direct uploads
+	OrphanDocuments 	[]uint		`json:"orphan_documents"`	// photos in elasticsearch without a db record
+	StaleSpoolFiles 	[]string	`json:"stale_spool_files"`	// chunks of abandoned resumable uploads & files of lost jobs
+	Errors 				[]string	`json:"errors"`
+}
+
+// Run the garbage collector in background periodically until the context is done.
+// The collection is locked for the whole interval, so only one instance runs it each time.
+func RunGarbageCollector(ctx context.Context) {
+	interval, _ := strconv.Atoi(conf.ServerCfg.Get(constant.GC_INTERVAL_MINUTE))
+	grace, _ := strconv.Atoi(conf.ServerCfg.Get(constant.GC_GRACE_MINUTE))
+	dryRun := conf.ServerCfg.Get(constant.GC_DRY_RUN) == "true"
+	if interval <= 0 {
+		return	// disabled
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// the lock is left to expire, so the garbage is collected once an interval among all instances
+		if utils.AcquireLock(constant.GC_LOCK, time.Duration(interval) * time.Minute) == nil {
+			continue
+		}
+		CollectGarbage(ctx, dryRun, time.Duration(grace) * time.Minute)
+	}
+}
+
+// Collect the garbage left by deleted photos & failed uploads once.
+// Anything younger than the grace period is kept, since it may still be in use.
+// The collection stops between batches once the context is done.
+func CollectGarbage(ctx context.Context, dryRun bool, grace time.Duration) *GarbageReport {
+	report := GarbageReport{
+		DryRun: dryRun,
+		StalePhotos: make([]uint, 0),
+		OrphanObjects: make([]string, 0),
+		OrphanDocuments: make([]uint, 0),
+		StaleSpoolFiles: make([]string, 0),
+		Errors: make([]string, 0),
+	}
+	deadline := time.Now().Add(-grace)
+
+	// stale photos go first, deleting them produces orphan documents
+	for _, collect := range []func(context.Context, *GarbageReport, time.Time) error{
+		collectStalePhotos,
+		collectOrphanObjects,
+		collectStaleDirectUploads,
+		collectOrphanLegacyObjects,
+		collectOrphanDocuments,
+		collectStaleSpoolFiles,
+	} {
+		if err := collect(ctx, &report, deadline); err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "CollectGarbage()"))
+			report.Errors = append(report.Errors, err.Error())
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	utils.AppLogger.Info("Garbage collected.", zap.String("service", "CollectGarbage()"),
+		zap.Bool("dry_run", dryRun),
+		zap.Int("stale_photos", len(report.StalePhotos)),
+		zap.Int("orphan_objects", len(report.OrphanObjects)),
+		zap.Int("orphan_documents", len(report.OrphanDocuments)),
+		zap.Int("stale_spool_files", len(report.StaleSpoolFiles)))
+	return &report
+}
+
+// Delete photos which never got a url, their uploads failed without a callback.
+func collectStalePhotos(ctx context.Context, report *GarbageReport, deadline time.Time) error {
+	// direct uploads may wait for confirmation a long time, don't delete them too early
+	if directDeadline := time.Now().Add(-constant.DIRECT_UPLOAD_INFO_EXPIRE_HOUR * time.Hour); directDeadline.Before(deadline) {
+		deadline = directDeadline
+	}
+
+	// photos shared stripped have no url until their stripped copy is generated, but their blob is stored
+	photos := make([]Photo, 0)
+	err := db.Where("url = ? AND created_at < ?", "", deadline).
+		Where("hash IS NULL OR hash NOT IN (?)", db.Model(&Blob{}).Select("hash").Where("state = ?", 1).QueryExpr()).
+		Find(&photos).Error
+	if err != nil {
+		return err
+	}
+	for _, photo := range photos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.StalePhotos = append(report.StalePhotos, photo.ID)
+		if report.DryRun {
+			continue
+		}
+		if err := deletePhoto("id = ? AND url = ?", photo.ID, ""); err != nil && err != NoSuchPhotoError {
+			return err
+		}
+		utils.SetUploadStatus(fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photo.ID), -1)
+	}
+	return nil
+}
+
+// Delete objects in the storage which are not referenced by any blob,
+// i.e. blob files, derivatives & cached renders whose blob has been deleted.
+func collectOrphanObjects(ctx context.Context, report *GarbageReport, deadline time.Time) error {
+	for _, prefix := range []string{constant.BLOB_KEY_PREFIX, constant.DERIVATIVE_KEY_PREFIX, constant.RENDER_KEY_PREFIX} {
+		err := scanObjects(ctx, prefix, func(objects []utils.ObjectInfo) error {
+			hashes := make([]string, 0, len(objects))
+			for _, object := range objects {
+				hashes = append(hashes, objectHash(object.Key))
+			}
+			existed := make([]string, 0, len(hashes))
+			if err := db.Model(&Blob{}).Where("hash IN (?)", hashes).Pluck("hash", &existed).Error; err != nil {
+				return err
+			}
+			existedSet := make(map[string]bool)
+			for _, hash := range existed {
+				existedSet[hash] = true
+			}
+
+			for _, object := range objects {
+				if existedSet[objectHash(object.Key)] || object.LastModified.After(deadline) {
+					continue
+				}
+				if err := collectObject(report, object.Key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete objects uploaded directly by clients but never confirmed, they can't be confirmed once the info expires.
+func collectStaleDirectUploads(ctx context.Context, report *GarbageReport, deadline time.Time) error {
+	if directDeadline := time.Now().Add(-constant.DIRECT_UPLOAD_INFO_EXPIRE_HOUR * time.Hour); directDeadline.Before(deadline) {
+		deadline = directDeadline
+	}
+
+	return scanObjects(ctx, constant.DIRECT_UPLOAD_OBJECT_PREFIX, func(objects []utils.ObjectInfo) error {
+		for _, object := range objects {
+			if object.LastModified.After(deadline) {
+				continue
+			}
+			if err := collectObject(report, object.Key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete objects uploaded before content addressing which no photo refers to any more,
+// they are keyed by the photo name & are found by the name or the url of the photo.
+// Only the prefixes in GC_LEGACY_PREFIXES are scanned ("*" for the whole storage), since the storage
+// may hold objects of other apps. It's disabled if there is none.
+func collectOrphanLegacyObjects(ctx context.Context, report *GarbageReport, deadline time.Time) error {
+	for _, prefix := range strings.Split(conf.ServerCfg.Get(constant.GC_LEGACY_PREFIXES), ",") {
+		if prefix = strings.TrimSpace(prefix); prefix == "" {
+			continue
+		}
+		if prefix == "*" {
+			prefix = ""
+		}
+		err := scanObjects(ctx, prefix, func(objects []utils.ObjectInfo) error {
+			names := make([]string, 0, len(objects))
+			urls := make([]string, 0, len(objects))
+			for _, object := range objects {
+				names = append(names, object.Key)
+				urls = append(urls, utils.Store.Url(object.Key))
+			}
+			photos := make([]Photo, 0)
+			if err := db.Select("name, url").Where("name IN (?) OR url IN (?)", names, urls).Find(&photos).Error; err != nil {
+				return err
+			}
+			referencedSet := make(map[string]bool)
+			for _, photo := range photos {
+				referencedSet[photo.Name] = true
+				referencedSet[photo.Url] = true
+			}
+
+			for _, object := range objects {
+				if isContentObject(object.Key) || referencedSet[object.Key] ||
+					referencedSet[utils.Store.Url(object.Key)] || object.LastModified.After(deadline) {
+					continue
+				}
+				if err := collectObject(report, object.Key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan the objects of a prefix a batch at a time, the scan stops once the context is done.
+func scanObjects(ctx context.Context, prefix string, scan func(objects []utils.ObjectInfo) error) error {
+	after := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		objects, err := utils.Store.ListPage(prefix, after, constant.GC_BATCH_SIZE)
+		if err != nil || len(objects) == 0 {
+			return err
+		}
+		if err := scan(objects); err != nil {
+			return err
+		}
+		after = objects[len(objects) - 1].Key
+	}
+}
+
+// Report an orphan object & delete it unless it's a dry run.
+func collectObject(report *GarbageReport, key string) error {
+	report.OrphanObjects = append(report.OrphanObjects, key)
+	if report.DryRun {
+		return nil
+	}
+	return utils.Store.Delete(key)
+}
+
+// Check if an object is keyed by content, i.e. it's a blob, a derivative, a render or a direct upload.
+func isContentObject(key string) bool {
+	for _, prefix := range []string{constant.BLOB_KEY_PREFIX, constant.DERIVATIVE_KEY_PREFIX,
+		constant.RENDER_KEY_PREFIX, constant.DIRECT_UPLOAD_OBJECT_PREFIX} {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the blob hash of an object, it's the last part of a blob key
+// & the second last part of a derivative or render key.
+func objectHash(key string) string {
+	if strings.HasPrefix(key, constant.DERIVATIVE_KEY_PREFIX) || strings.HasPrefix(key, constant.RENDER_KEY_PREFIX) {
+		return path.Base(path.Dir(key))
+	}
+	return path.Base(key)
+}
+
+// Delete photos in elasticsearch which are not in the db, photos created in the grace period are kept.
+func collectOrphanDocuments(ctx context.Context, report *GarbageReport, deadline time.Time) error {
+	return ScrollPhotoIDs(constant.GC_BATCH_SIZE, deadline, func(photoIDs []uint) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		existed := make([]uint, 0, len(photoIDs))
+		if err := db.Model(&Photo{}).Where("id IN (?)", photoIDs).Pluck("id", &existed).Error; err != nil {
+			return err
+		}
+		existedSet := make(map[uint]bool)
+		for _, photoID := range existed {
+			existedSet[photoID] = true
+		}
+
+		for _, photoID := range photoIDs {
+			if existedSet[photoID] {
+				continue
+			}
+			report.OrphanDocuments = append(report.OrphanDocuments, photoID)
+			if !report.DryRun {
+				if err := DeletePhotoIndex(photoID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Delete spool files of resumable uploads & upload jobs which have expired.
+func collectStaleSpoolFiles(ctx context.Context, report *GarbageReport, deadline time.Time) error {
+	spoolExpires := map[string]time.Duration{
+		conf.ServerCfg.Get(constant.TUS_SPOOL_DIR): constant.RESUMABLE_UPLOAD_EXPIRE_HOUR * time.Hour,
+		conf.ServerCfg.Get(constant.UPLOAD_SPOOL_DIR): constant.UPLOAD_SPOOL_EXPIRE_HOUR * time.Hour,
+	}
+	for spoolDir, expire := range spoolExpires {
+		files, err := ioutil.ReadDir(spoolDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		expiredDeadline := time.Now().Add(-expire)
+		for _, file := range files {
+			if file.IsDir() || file.ModTime().After(expiredDeadline) || file.ModTime().After(deadline) {
+				continue
+			}
+			report.StaleSpoolFiles = append(report.StaleSpoolFiles, filepath.Join(spoolDir, file.Name()))
+			if !report.DryRun {
+				if err := os.Remove(filepath.Join(spoolDir, file.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package models
+
+import "testing"
+
+func TestObjectHash(t *testing.T) {
+	hash := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	cases := []struct {
+		key 	string
+		want 	string
+	}{
+		{BlobKey(hash), hash},
+		{"derivatives/" + hash + "/320.webp", hash},
+		{"derivatives/" + hash + "/shared.jpg", hash},
+		{"renders/" + hash + "/100x100-fit-q80.jpg", hash},
+	}
+	for _, c := range cases {
+		if got := objectHash(c.key); got != c.want {
+			t.Errorf("objectHash(%q) = %q, want %q", c.key, got, c.want)
+		}
+	}
+}
+
+func TestIsContentObject(t *testing.T) {
+	cases := []struct {
+		key 	string
+		want 	bool
+	}{
+		{"blobs/9f/9f86d081", true},
+		{"derivatives/9f86d081/320.webp", true},
+		{"renders/9f86d081/100x100-fit-q80.jpg", true},
+		{"uploads/9f86d081", true},
+		{"cat.jpg", false},
+		{"photos/cat.jpg", false},
+		{"backup/blobs/9f/9f86d081", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := isContentObject(c.key); got != c.want {
+			t.Errorf("isContentObject(%q) = %v, want %v", c.key, got, c.want)
+		}
+	}
+}
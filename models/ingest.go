@@ -0,0 +1,91 @@
+package models
+
+import (
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var PhotoContentError = errors.New("photo content is not accepted")
+
+// What we learn about a photo file by decoding it.
+type photoContent struct {
+	MimeType 		string
+	Width 			int
+	Height 			int
+	PerceptualHash 	string
+	Colors 			imageColors
+}
+
+// Get the max bytes of an uploaded photo.
+func MaxUploadBytes() int64 {
+	maxBytes, _ := strconv.ParseInt(conf.ServerCfg.Get(constant.UPLOAD_MAX_BYTES), 10, 64)
+	return maxBytes
+}
+
+// Inspect an uploaded photo file before accepting it, then rewind the file.
+// The type is sniffed by the magic bytes & checked against the allow-list,
+// then the dimensions are checked & the whole image is decoded to make sure it's not broken.
+// The decoded image gives the perceptual hash, the placeholder & the palette as well.
+func inspectPhotoFile(file io.ReadSeeker, size int64) (*photoContent, error) {
+	if size > MaxUploadBytes() {
+		return nil, UploadTooLargeError
+	}
+
+	mimeType, err := utils.SniffContentType(file)
+	if err != nil {
+		return nil, err
+	}
+	allowed := false
+	for _, allowedType := range strings.Split(conf.ServerCfg.Get(constant.UPLOAD_ALLOWED_TYPES), ",") {
+		if strings.TrimSpace(allowedType) == mimeType {
+			allowed = true
+		}
+	}
+	if !allowed {
+		utils.AppLogger.Info(fmt.Sprintf("Type %s is not allowed.", mimeType),
+			zap.String("service", "inspectPhotoFile()"))
+		return nil, PhotoContentError
+	}
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "inspectPhotoFile()"))
+		return nil, PhotoContentError
+	}
+	maxWidth, _ := strconv.Atoi(conf.ServerCfg.Get(constant.UPLOAD_MAX_WIDTH))
+	maxHeight, _ := strconv.Atoi(conf.ServerCfg.Get(constant.UPLOAD_MAX_HEIGHT))
+	if config.Width < 1 || config.Height < 1 || config.Width > maxWidth || config.Height > maxHeight {
+		utils.AppLogger.Info(fmt.Sprintf("Dimensions %dx%d are not allowed.", config.Width, config.Height),
+			zap.String("service", "inspectPhotoFile()"))
+		return nil, PhotoContentError
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// a truncated or corrupted image fails to decode
+	img, _, err := utils.DecodeImage(file, constant.IMAGE_MAX_PIXELS)
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		return nil, seekErr
+	}
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "inspectPhotoFile()"))
+		return nil, PhotoContentError
+	}
+
+	return &photoContent{
+		MimeType: mimeType,
+		Width: config.Width,
+		Height: config.Height,
+		PerceptualHash: fmt.Sprintf("%016x", utils.DifferenceHash(img)),
+		Colors: getImageColors(img),
+	}, nil
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+// The photo index is read & written through the alias ES_PHOTO_INDEX, which points to a versioned index.
+// Once the mapping changes, PHOTO_INDEX_VERSION is bumped & the index is rebuilt by a reindex,
+// which swaps the alias to an index of the new version.
+
+// The settings & the mapping of the photo index, its version is kept in "_meta".
+var photoIndexBody = map[string]interface{}{
+	"settings": map[string]interface{}{
+		"analysis": map[string]interface{}{
+			"normalizer": map[string]interface{}{
+				"lowercase_normalizer": map[string]interface{}{
+					"type": "custom",
+					"filter": []string{"lowercase", "asciifolding"},
+				},
+			},
+			"filter": map[string]interface{}{
+				"tag_edge_ngram": map[string]interface{}{
+					"type": "edge_ngram",
+					"min_gram": 1,
+					"max_gram": constant.TAG_PREFIX_MAX_LENGTH,
+				},
+			},
+			"analyzer": map[string]interface{}{
+				"photo_text": map[string]interface{}{
+					"type": "custom",
+					"tokenizer": "standard",
+					"filter": []string{"lowercase", "asciifolding"},
+				},
+				// a whole tag is indexed with all its prefixes, & a prefix is searched as it is
+				"tag_prefix": map[string]interface{}{
+					"type": "custom",
+					"tokenizer": "keyword",
+					"filter": []string{"lowercase", "asciifolding", "tag_edge_ngram"},
+				},
+				"tag_prefix_search": map[string]interface{}{
+					"type": "custom",
+					"tokenizer": "keyword",
+					"filter": []string{"lowercase", "asciifolding"},
+				},
+			},
+		},
+	},
+	"mappings": map[string]interface{}{
+		"_doc": map[string]interface{}{
+			"_meta": map[string]interface{}{"version": constant.PHOTO_INDEX_VERSION},
+			"dynamic": "false",	// unknown fields are kept in the source but never mapped by guess
+			"properties": map[string]interface{}{
+				"id": map[string]string{"type": "long"},
+				"auth_id": map[string]string{"type": "long"},
+				"bucket_id": map[string]string{"type": "long"},
+				"name": map[string]interface{}{
+					"type": "keyword",
+					"fields": map[string]interface{}{
+						"text": map[string]string{"type": "text", "analyzer": "photo_text"},
+					},
+				},
+				"tags": map[string]interface{}{
+					"type": "keyword",
+					"normalizer": "lowercase_normalizer",
+					"fields": map[string]interface{}{
+						"prefix": map[string]string{
+							"type": "text",
+							"analyzer": "tag_prefix",
+							"search_analyzer": "tag_prefix_search",
+						},
+					},
+				},
+				"url": map[string]interface{}{"type": "keyword", "index": false},
+				"description": map[string]string{"type": "text", "analyzer": "photo_text"},
+				"thumbnails": map[string]interface{}{"type": "object", "enabled": false},
+				"perceptual_hash": map[string]string{"type": "keyword"},
+				"blur_hash": map[string]interface{}{"type": "keyword", "index": false},
+				"dominant_color": map[string]string{"type": "keyword"},
+				"palette": map[string]string{"type": "keyword"},
+				"palette_codes": map[string]string{"type": "keyword"},
+				"camera": map[string]interface{}{
+					"type": "text",
+					"analyzer": "photo_text",
+					"fields": map[string]interface{}{
+						"keyword": map[string]string{"type": "keyword"},
+					},
+				},
+				"lens_model": map[string]string{"type": "keyword"},
+				"exposure_time": map[string]string{"type": "keyword"},
+				"f_number": map[string]string{"type": "float"},
+				"iso": map[string]string{"type": "integer"},
+				"focal_length": map[string]string{"type": "float"},
+				"taken_at": map[string]string{"type": "date"},
+				"created_at": map[string]string{"type": "date"},
+				"location": map[string]string{"type": "geo_point"},
+			},
+		},
+	},
+}
+
+// Get the name of a fresh photo index of the current version.
+func newPhotoIndexName(alias string, createdAt int64) string {
+	return fmt.Sprintf(constant.PHOTO_INDEX_NAME_FORMAT, alias, constant.PHOTO_INDEX_VERSION, createdAt)
+}
+
+// Make sure the photo alias points to an index of the current mapping version, it's called at startup.
+// 1. No index at all, an index of the current version is created & aliased.
+// 2. An index of an older version, or one created before aliases are used, a reindex is started
+//    in background, & the old index serves until the alias is swapped.
+func EnsurePhotoIndex() error {
+	alias := conf.ServerCfg.Get(constant.ES_PHOTO_INDEX)
+	version, exists, err := getPhotoIndexVersion(alias)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		index := newPhotoIndexName(alias, time.Now().Unix())
+		if err := createPhotoIndex(index); err != nil {
+			return err
+		}
+		_, err := swapPhotoAlias(alias, index)
+		return err
+	}
+
+	if version < constant.PHOTO_INDEX_VERSION {
+		utils.AppLogger.Info("Photo index is outdated, reindexing.", zap.String("service", "EnsurePhotoIndex()"),
+			zap.Int("version", version), zap.Int("current_version", constant.PHOTO_INDEX_VERSION))
+		if _, err := StartReindex(); err != nil && err != ReindexRunningError {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the mapping version of the index behind the alias, 0 if it has no version, i.e. it's mapped dynamically.
+// The version is the lowest one if the alias points to several indices.
+func getPhotoIndexVersion(alias string) (int, bool, error) {
+	res, err := ESClient.Indices.GetMapping(ESClient.Indices.GetMapping.WithIndex(alias))
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "getPhotoIndexVersion()"))
+		return 0, false, PhotoIndexManageError
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return 0, false, nil
+	}
+	if res.IsError() {
+		utils.AppLogger.Info(decodeESError(res).Error(), zap.String("service", "getPhotoIndexVersion()"))
+		return 0, false, PhotoIndexManageError
+	}
+
+	// index name -> "mappings" -> type name -> "_meta"
+	mappingRes := make(map[string]struct {
+		Mappings 	map[string]struct {
+			Meta 	struct {
+				Version 	int		`json:"version"`
+			}	`json:"_meta"`
+		}	`json:"mappings"`
+	})
+	if err := json.NewDecoder(res.Body).Decode(&mappingRes); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "getPhotoIndexVersion()"))
+		return 0, false, PhotoIndexManageError
+	}
+	version := -1
+	for _, index := range mappingRes {
+		indexVersion := 0
+		for _, mapping := range index.Mappings {
+			indexVersion = mapping.Meta.Version
+		}
+		if version < 0 || indexVersion < version {
+			version = indexVersion
+		}
+	}
+	if version < 0 {
+		version = 0
+	}
+	return version, true, nil
+}
+
+// Get the body creating a photo index.
+func photoIndexRequestBody() *bytes.Reader {
+	body, _ := json.Marshal(photoIndexBody)
+	return bytes.NewReader(body)
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+	"time"
+)
+
+// The operations applied to elasticsearch by the outbox relay.
+// Indexing rebuilds the whole document from the db, so it's idempotent & serves both creation & update.
+const (
+	OutboxIndex 	= "index"
+	OutboxDelete 	= "delete"
+)
+
+// An elasticsearch operation written in the same transaction as the photo change,
+// the relay applies it afterwards & retries until it succeeds, so elasticsearch always converges with the db.
+type OutboxEntry struct {
+	BaseModel
+	PhotoID 		uint		`json:"photo_id" gorm:"type:int;index"`
+	Operation 		string		`json:"operation" gorm:"type:varchar(16)"`
+	Attempts 		int			`json:"attempts" gorm:"type:int"`
+	NextAttemptAt 	time.Time	`json:"next_attempt_at" gorm:"default: CURRENT_TIMESTAMP;index"`
+	LastError 		string		`json:"last_error" gorm:"type:varchar(255)"`
+}
+
+func (OutboxEntry) TableName() string {
+	return "outbox"
+}
+
+// wakes up the relay of this instance once an entry is written
+var outboxNotify = make(chan struct{}, 1)
+
+// Write an elasticsearch operation of a photo in the given transaction.
+func addOutboxEntry(trx *gorm.DB, photoID uint, operation string) error {
+	entry := OutboxEntry{PhotoID: photoID, Operation: operation, NextAttemptAt: time.Now()}
+	if err := trx.Create(&entry).Error; err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "addOutboxEntry()"))
+		return err
+	}
+	return nil
+}
+
+// Wake up the relay, it's called after the transaction writing the entries commits.
+func notifyOutbox() {
+	select {
+	case outboxNotify <- struct{}{}:
+	default:	// the relay is woken up already
+	}
+}
+
+// Run the outbox relay until the context is done.
+// It's woken up by the entries written by this instance, & polls for the others & the retries.
+// The relay is locked for each batch, so only one instance applies the same entries.
+func RunOutboxRelay(ctx context.Context) {
+	for {
+		relayed := 0
+		if lock := utils.AcquireLock(constant.OUTBOX_LOCK, constant.OUTBOX_LOCK_MINUTE * time.Minute);lock != nil {
+			// a batch slow against elasticsearch keeps the lock, so no other instance relays the same entries
+			stop := lock.KeepAlive(constant.OUTBOX_LOCK_MINUTE * time.Minute)
+			relayed = relayOutbox()
+			stop()
+			lock.Release()
+		}
+		if relayed == constant.OUTBOX_BATCH_SIZE {
+			continue	// more entries are waiting
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-outboxNotify:
+		case <-time.After(constant.OUTBOX_POLL_SECOND * time.Second):
+		}
+	}
+}
+
+// Apply a batch of due entries, the number of entries in the batch is returned.
+// The entries of the same photo are applied once, the latest operation wins.
+func relayOutbox() int {
+	entries := make([]OutboxEntry, 0, constant.OUTBOX_BATCH_SIZE)
+	err := db.Where("next_attempt_at <= ?", time.Now()).
+		Order("id").
+		Limit(constant.OUTBOX_BATCH_SIZE).
+		Find(&entries).Error
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "relayOutbox()"))
+		return 0
+	}
+	// a running reindex replays the entries after the swap, they're kept for the next batch if it can't
+	if err := recordReindexChanges(entries); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "relayOutbox()"))
+		return 0
+	}
+
+	photoIDs := make([]uint, 0, len(entries))
+	latest := make(map[uint]OutboxEntry)
+	entryIDs := make(map[uint][]uint)
+	for _, entry := range entries {
+		if _, ok := latest[entry.PhotoID]; !ok {
+			photoIDs = append(photoIDs, entry.PhotoID)
+		}
+		latest[entry.PhotoID] = entry
+		entryIDs[entry.PhotoID] = append(entryIDs[entry.PhotoID], entry.ID)
+	}
+
+	for _, photoID := range photoIDs {
+		entry := latest[photoID]
+		if err := applyOutboxEntry(entry); err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "relayOutbox()"),
+				zap.Uint("photo_id", photoID), zap.Int("attempts", entry.Attempts + 1))
+			err = db.Model(&OutboxEntry{}).Where("id IN (?)", entryIDs[photoID]).Updates(map[string]interface{}{
+				"attempts": entry.Attempts + 1,
+				"next_attempt_at": time.Now().Add(outboxRetryDelay(entry.Attempts + 1)),
+				"last_error": err.Error(),
+			}).Error
+		} else {
+			err = db.Where("id IN (?)", entryIDs[photoID]).Delete(&OutboxEntry{}).Error
+		}
+		if err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "relayOutbox()"))
+		}
+	}
+	return len(entries)
+}
+
+// Apply an entry to elasticsearch. A photo no longer in the db is deleted whatever the operation is,
+// so an entry applied late never brings back a deleted photo.
+func applyOutboxEntry(entry OutboxEntry) error {
+	if entry.Operation == OutboxDelete {
+		return DeletePhotoIndex(entry.PhotoID)
+	}
+
+	photos := make([]Photo, 0, 1)
+	if err := db.Where("id = ?", entry.PhotoID).Find(&photos).Error; err != nil {
+		return err
+	}
+	if len(photos) == 0 {
+		return DeletePhotoIndex(entry.PhotoID)
+	}
+	loadThumbnails(photos)
+	loadExifs(photos)
+	return IndexPhoto(&photos[0])
+}
+
+// Get the delay before the next attempt of an entry, doubled after each attempt.
+func outboxRetryDelay(attempts int) time.Duration {
+	delay := constant.OUTBOX_RETRY_BASE_SECOND * time.Second
+	for i := 1;i < attempts && delay < constant.OUTBOX_RETRY_MAX_SECOND * time.Second;i++ {
+		delay *= 2
+	}
+	if delay > constant.OUTBOX_RETRY_MAX_SECOND * time.Second {
+		delay = constant.OUTBOX_RETRY_MAX_SECOND * time.Second
+	}
+	return delay
+}
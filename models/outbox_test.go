@@ -0,0 +1,26 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxRetryDelay(t *testing.T) {
+	cases := []struct {
+		attempts 	int
+		want 		time.Duration
+	}{
+		{0, 5 * time.Second},
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{10, 2560 * time.Second},
+		{11, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, c := range cases {
+		if got := outboxRetryDelay(c.attempts); got != c.want {
+			t.Errorf("outboxRetryDelay(%d) = %v, want %v", c.attempts, got, c.want)
+		}
+	}
+}
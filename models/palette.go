@@ -0,0 +1,97 @@
+package models
+
+import (
+	"fmt"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"math"
+	"strings"
+)
+
+// Palette colors are indexed by the cells of the CIELAB space they fall in,
+// so a color search looks up the cells near the color instead of comparing every palette.
+
+// Get the code of the cell a color falls in, e.g. "l5a18b25".
+// The a & b axes are shifted to keep the codes alphanumeric, so they are never split by an analyzer.
+func paletteCode(lab utils.Lab) string {
+	return cellCode(paletteCell(lab.L), paletteCell(lab.A), paletteCell(lab.B))
+}
+
+func cellCode(l, a, b int) string {
+	return fmt.Sprintf("l%da%db%d", l, a + constant.PALETTE_CELL_OFFSET, b + constant.PALETTE_CELL_OFFSET)
+}
+
+func paletteCell(value float64) int {
+	return int(math.Floor(value / constant.PALETTE_CELL_SIZE))
+}
+
+// Get the cell codes of a palette, the palette is saved as comma separated hex colors.
+func paletteCodes(palette string) []string {
+	codes := make([]string, 0)
+	if palette == "" {
+		return codes
+	}
+	for _, hex := range strings.Split(palette, ",") {
+		if lab, err := utils.ParseHexColor(hex); err == nil {
+			codes = append(codes, paletteCode(lab))
+		}
+	}
+	return codes
+}
+
+// The painless script of the CIE76 difference between the nearest palette color of a photo & a color
+// (the l, a & b params), the hex colors are converted to CIELAB as utils.RGBToLab does.
+const paletteDistanceScript = `
+double nearest = Double.MAX_VALUE;
+for (String hex : doc['palette']) {
+	double[] linear = new double[3];
+	for (int i = 0; i < 3; ++i) {
+		double v = Integer.parseInt(hex.substring(1 + 2 * i, 3 + 2 * i), 16) / 255.0;
+		linear[i] = v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4);
+	}
+	double[] xyz = new double[3];
+	xyz[0] = (0.4124564 * linear[0] + 0.3575761 * linear[1] + 0.1804375 * linear[2]) / 0.95047;
+	xyz[1] = 0.2126729 * linear[0] + 0.7151522 * linear[1] + 0.0721750 * linear[2];
+	xyz[2] = (0.0193339 * linear[0] + 0.1191920 * linear[1] + 0.9503041 * linear[2]) / 1.08883;
+	for (int i = 0; i < 3; ++i) {
+		xyz[i] = xyz[i] > 216.0 / 24389 ? Math.cbrt(xyz[i]) : (24389.0 / 27 * xyz[i] + 16) / 116;
+	}
+	double dL = 116 * xyz[1] - 16 - params.l;
+	double dA = 500 * (xyz[0] - xyz[1]) - params.a;
+	double dB = 200 * (xyz[1] - xyz[2]) - params.b;
+	nearest = Math.min(nearest, Math.sqrt(dL * dL + dA * dA + dB * dB));
+}
+`
+
+// Get the codes of the cells within the tolerance of a color.
+func nearPaletteCodes(lab utils.Lab, tolerance float64) []string {
+	codes := make([]string, 0)
+	span := int(tolerance / constant.PALETTE_CELL_SIZE) + 1	// cells to scan on each side of the color
+
+	// the distance from a value to the nearest point of a cell along one axis
+	axisDistance := func(value float64, cell int) float64 {
+		low := float64(cell) * constant.PALETTE_CELL_SIZE
+		high := low + constant.PALETTE_CELL_SIZE
+		if value < low {
+			return low - value
+		}
+		if value > high {
+			return value - high
+		}
+		return 0
+	}
+
+	lCell, aCell, bCell := paletteCell(lab.L), paletteCell(lab.A), paletteCell(lab.B)
+	for l := lCell - span;l <= lCell + span;l++ {
+		for a := aCell - span;a <= aCell + span;a++ {
+			for b := bCell - span;b <= bCell + span;b++ {
+				dL, dA, dB := axisDistance(lab.L, l), axisDistance(lab.A, a), axisDistance(lab.B, b)
+				distance := math.Sqrt(dL * dL + dA * dA + dB * dB)
+				if distance <= tolerance {
+					codes = append(codes, cellCode(l, a, b))
+				}
+			}
+		}
+	}
+	return codes
+}
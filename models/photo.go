@@ -1,13 +1,14 @@
 package models
 
 import (
-	"bufio"
+	"fmt"
 	"gin-photo-storage/constant"
+	"gin-photo-storage/events"
 	"gin-photo-storage/utils"
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
-	"mime/multipart"
+	"io"
 )
 
 var NoSuchPhotoError = errors.New("no such photo")
@@ -25,12 +26,138 @@ type Photo struct {
 	Url 		string		`json:"url" gorm:"type:varchar(255)" form:"url"`
 	Description string		`json:"description" gorm:"type:text" form:"description"`
 	State 		int 		`json:"state" gorm:"type:tinyint(1)" form:"state"`
+	Hash 		string		`json:"hash" gorm:"type:char(64)" form:"-"`
+	Size 		int64		`json:"size" gorm:"type:bigint" form:"-"`
+	PerceptualHash 	string	`json:"perceptual_hash" gorm:"type:char(16)" form:"-"`
+	PHashBand0 	string		`json:"-" gorm:"column:phash_band0;type:char(4)" form:"-"`
+	PHashBand1 	string		`json:"-" gorm:"column:phash_band1;type:char(4)" form:"-"`
+	PHashBand2 	string		`json:"-" gorm:"column:phash_band2;type:char(4)" form:"-"`
+	PHashBand3 	string		`json:"-" gorm:"column:phash_band3;type:char(4)" form:"-"`
+	MimeType 	string		`json:"mime_type" gorm:"type:varchar(32)" form:"-"`
+	Width 		int			`json:"width" gorm:"type:int" form:"-"`
+	Height 		int			`json:"height" gorm:"type:int" form:"-"`
+	DuplicateOf 	uint	`json:"duplicate_of" gorm:"type:int" form:"-"`
+	BlurHash 	string		`json:"blur_hash" gorm:"type:varchar(64)" form:"-"`
+	DominantColor 	string	`json:"dominant_color" gorm:"type:char(7)" form:"-"`
+	Palette 	string		`json:"palette" gorm:"type:varchar(64)" form:"-"`
+	Thumbnails 	map[string]string	`json:"thumbnails" gorm:"-" form:"-"`
+	Exif 		*Exif		`json:"exif" gorm:"-" form:"-"`
 }
 
-// Add a new photo
-func AddPhoto(photoToAdd *Photo, photoFileHeader *multipart.FileHeader) (*Photo, string, error) {
+// An uploaded photo file, it's read once for hashing & once more for uploading.
+type PhotoFile interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Get the key of the photo file in the storage.
+func (photo *Photo) ObjectKey() string {
+	if photo.Hash == "" {
+		return photo.Name	// photos uploaded before content addressing
+	}
+	return BlobKey(photo.Hash)
+}
+
+// Add a new photo, the file is closed once it's uploaded.
+// The file is rejected if it's not an allowed image, see inspectPhotoFile.
+// The private EXIF tags are stripped by the privacy setting of the bucket, see resolvePrivacy.
+// If a file with identical content is stored already, it's not uploaded again.
+// If the photo looks like an existing one of the user, it's handled by the duplicate policy.
+func AddPhoto(photoToAdd *Photo, photoFile PhotoFile, fileSize int64, policy DuplicatePolicy) (*Photo, string, error) {
+	content, err := inspectPhotoFile(photoFile, fileSize)
+	if err == PhotoContentError || err == UploadTooLargeError {
+		photoFile.Close()
+		return nil, "", err
+	}
+
+	// strip the file before hashing, the stripped file is a blob of its own,
+	// a file which can't be stripped is never stored
+	privacy := resolvePrivacy(photoToAdd.AuthID, photoToAdd.BucketID)
+	var originalExif *Exif
+	if err == nil && privacy.Mode == PrivacyStripOriginal {
+		if !strippable(content.MimeType) {
+			photoFile.Close()
+			return nil, "", PrivacyStripError
+		}
+		photoFile, originalExif, err = stripPhotoFile(photoFile, privacy.KeepExif)
+		if err == PrivacyStripError {
+			return nil, "", err
+		}
+	}
+	hash := ""
+	if err == nil {
+		hash, err = hashFile(photoFile)
+	}
+	if err != nil {
+		photoFile.Close()
+		utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhoto()"))
+		return nil, "", PhotoFileBrokenError
+	}
+	if originalExif != nil {
+		// saved before the upload, so the stripped file is not extracted again
+		if err := saveStrippedExif(originalExif, hash); err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhoto()"))
+		}
+	}
+	photoToAdd.Hash = hash
+	photoToAdd.MimeType = content.MimeType
+	photoToAdd.Width = content.Width
+	photoToAdd.Height = content.Height
+	photoToAdd.PerceptualHash = content.PerceptualHash
+	photoToAdd.BlurHash = content.Colors.BlurHash
+	photoToAdd.DominantColor = content.Colors.DominantColor
+	photoToAdd.Palette = content.Colors.Palette
+
+	if policy != DuplicateAllow && photoToAdd.PerceptualHash != "" {
+		duplicate, err := findDuplicate(photoToAdd.AuthID, photoToAdd.PerceptualHash,
+			constant.DUPLICATE_MAX_DISTANCE)
+		if err != nil {
+			photoFile.Close()
+			return nil, "", err
+		}
+		if duplicate != nil && policy == DuplicateReject {
+			photoFile.Close()
+			return duplicate, "", DuplicatePhotoError
+		}
+		if duplicate != nil {
+			photoToAdd.DuplicateOf = duplicate.ID
+		}
+	}
+
+	photo, blob, err := createPhoto(photoToAdd, fileSize, privacy.Mode)
+	if err != nil {
+		photoFile.Close()
+		return nil, "", err
+	}
+
+	if blob.State == 1 {
+		photoFile.Close()
+		uploadID := fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photo.ID)
+		utils.SetUploadStatus(uploadID, 0)
+		if photo.Url == "" {
+			utils.PublishUploadStage(uploadID, utils.UploadIndexed, "", "")
+			go ProcessPhoto(photo.ID)	// the stripped copy is not generated yet
+		} else {
+			utils.PublishUploadStage(uploadID, utils.UploadThumbnailed, photo.Url, "")
+		}
+		return photo, uploadID, nil
+	}
+
+	// upload to the storage, the photo is never stored if the upload can't be queued
+	uploadID, err := utils.Upload(photo.ID, photo.ObjectKey(), photoFile, int(fileSize))
+	if err != nil {
+		if err := failPhotoUpload(photo.ID, err.Error()); err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhoto()"))
+		}
+		return nil, "", err
+	}
+	return photo, uploadID, nil
+}
+
+// Create the photo record in the db & elasticsearch, the file is uploaded afterwards.
+// The blob of the photo is returned, if it's stored already the photo gets its url at once.
+func createPhoto(photoToAdd *Photo, fileSize int64, mode PrivacyMode) (*Photo, *Blob, error) {
 	trx := db.Begin()
-	defer trx.Commit()
 
 	// check if the photo exists, select with a WRITE LOCK
 	photo := Photo{}
@@ -38,7 +165,26 @@ func AddPhoto(photoToAdd *Photo, photoFileHeader *multipart.FileHeader) (*Photo,
 		Where("bucket_id = ? AND name = ?", photoToAdd.BucketID, photoToAdd.Name).
 		First(&photo)
 	if photo.ID > 0 {
-		return nil, "", PhotoExistsError
+		trx.Rollback()
+		return nil, nil, PhotoExistsError
+	}
+
+	// every photo counts in the quotas, even if its file is shared
+	if err := checkQuota(trx, photoToAdd.AuthID, photoToAdd.BucketID, fileSize); err != nil {
+		trx.Rollback()
+		return nil, nil, err
+	}
+
+	// the hash of a direct upload is unknown until its object is verified, see ConfirmDirectUpload
+	blob := &Blob{}
+	var err error
+	if photoToAdd.Hash != "" {
+		blob, err = acquireBlob(trx, photoToAdd.Hash, fileSize)
+		if err != nil {
+			trx.Rollback()
+			utils.AppLogger.Info(err.Error(), zap.String("service", "createPhoto()"))
+			return nil, nil, err
+		}
 	}
 
 	photo.AuthID = photoToAdd.AuthID
@@ -47,114 +193,219 @@ func AddPhoto(photoToAdd *Photo, photoFileHeader *multipart.FileHeader) (*Photo,
 	photo.Tag = photoToAdd.Tag
 	photo.Description = photoToAdd.Description
 	photo.State = 1
+	photo.Hash = photoToAdd.Hash
+	photo.Size = fileSize
+	photo.PerceptualHash = photoToAdd.PerceptualHash
+	bands := perceptualHashBands(photo.PerceptualHash)
+	photo.PHashBand0, photo.PHashBand1, photo.PHashBand2, photo.PHashBand3 = bands[0], bands[1], bands[2], bands[3]
+	photo.MimeType = photoToAdd.MimeType
+	photo.Width = photoToAdd.Width
+	photo.Height = photoToAdd.Height
+	photo.DuplicateOf = photoToAdd.DuplicateOf
+	photo.BlurHash = photoToAdd.BlurHash
+	photo.DominantColor = photoToAdd.DominantColor
+	photo.Palette = photoToAdd.Palette
+	if blob.State == 1 {
+		photo.Url = sharedPhotoUrl(trx, &photo, mode)
+		photo.Thumbnails = getThumbnails([]string{photo.Hash})[photo.Hash]
+		photo.Exif = getExifs([]string{photo.Hash})[photo.Hash]
+	}
 
-	err := trx.Create(&photo).Error
+	err = trx.Create(&photo).Error
 	if err != nil {
+		trx.Rollback()
 		//log.Println(err)
-		utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhoto()"))
-		return nil, "", err
+		utils.AppLogger.Info(err.Error(), zap.String("service", "createPhoto()"))
+		return nil, nil, err
 	}
 
 	err = trx.Model(&Bucket{}).Where("id = ?", photoToAdd.BucketID).
-		Update("size", gorm.Expr("size + ?", 1)).
-		Error
+		Updates(map[string]interface{}{
+			"size": gorm.Expr("size + ?", 1),
+			"bytes": gorm.Expr("bytes + ?", fileSize),
+		}).Error
 	if err != nil {
 		trx.Rollback()
 		//log.Println(err)
-		utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhoto()"))
-		return nil, "", err
+		utils.AppLogger.Info(err.Error(), zap.String("service", "createPhoto()"))
+		return nil, nil, err
 	}
 
-	// index a photo in elasticsearch
-	if err = IndexPhoto(&photo); err != nil {
-		//log.Println(err)
-		utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhoto()"))
-		return nil, "", err
+	// index a photo in elasticsearch once the transaction commits
+	if err = addOutboxEntry(trx, photo.ID, OutboxIndex); err != nil {
+		trx.Rollback()
+		return nil, nil, err
 	}
-
-	// upload to the tencent cloud COS
-	if photoFile, err := photoFileHeader.Open(); err == nil {
-		uploadID := utils.Upload(photo.ID, photo.Name, bufio.NewReader(photoFile), int(photoFileHeader.Size))
-		return &photo, uploadID, nil
-	} else {
-		//log.Println(err)
-		utils.AppLogger.Info(err.Error(), zap.String("service", "AddPhoto()"))
-		return nil, "", PhotoFileBrokenError
+	if err = trx.Commit().Error; err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "createPhoto()"))
+		return nil, nil, err
 	}
+	notifyOutbox()
+	return &photo, blob, nil
 }
 
 // Delete a photo by photo id.
 func DeletePhotoByID(photoID uint) error {
+	return deletePhoto("id = ? AND state = ?", photoID, 1)
+}
+
+// Delete a photo by its bucket id & its name.
+func DeletePhotoByBucketAndName(bucketID uint, name string) error {
+	return deletePhoto("bucket_id = ? AND name = ?", bucketID, name)
+}
+
+// Delete the photo matching the given condition,
+// its file is deleted as well if no other photo shares it.
+func deletePhoto(query string, args ...interface{}) error {
 	trx := db.Begin()
-	defer trx.Commit()
 
-	result := trx.Where("id = ? AND state = ?", photoID, 1).Delete(Photo{})
-	if err := result.Error; err != nil {
+	photo := Photo{}
+	trx.Set("gorm:query_option", "FOR UPDATE").Where(query, args...).First(&photo)
+	if photo.ID == 0 {
+		trx.Rollback()
+		return NoSuchPhotoError
+	}
+
+	if err := trx.Delete(&photo).Error; err != nil {
+		trx.Rollback()
 		//log.Println(err)
-		utils.AppLogger.Info(err.Error(), zap.String("service", "DeletePhotoByID()"))
+		utils.AppLogger.Info(err.Error(), zap.String("service", "deletePhoto()"))
 		return err
 	}
-	if affected := result.RowsAffected; affected == 0 {
-		return NoSuchPhotoError
+	err := trx.Model(&Bucket{}).Where("id = ?", photo.BucketID).
+		Updates(map[string]interface{}{
+			"size": gorm.Expr("size - ?", 1),
+			"bytes": gorm.Expr("bytes - ?", photo.Size),
+		}).Error
+	if err != nil {
+		trx.Rollback()
+		utils.AppLogger.Info(err.Error(), zap.String("service", "deletePhoto()"))
+		return err
+	}
+	keysToDelete, err := releaseBlob(trx, photo.Hash)
+	if err != nil {
+		trx.Rollback()
+		utils.AppLogger.Info(err.Error(), zap.String("service", "deletePhoto()"))
+		return err
+	}
+	if err := addOutboxEntry(trx, photo.ID, OutboxDelete); err != nil {
+		trx.Rollback()
+		return err
+	}
+	if err := trx.Commit().Error; err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "deletePhoto()"))
+		return err
+	}
+	notifyOutbox()
+
+	for _, key := range keysToDelete {
+		deleteBlobObject(key)
 	}
+	utils.Events.Publish(events.PhotoDeleted{
+		PhotoID: photo.ID, AuthID: photo.AuthID, BucketID: photo.BucketID, Hash: photo.Hash})
 	return nil
 }
 
-// Delete a photo by its bucket id & its name.
-func DeletePhotoByBucketAndName(bucketID uint, name string) error {
-	trx := db.Begin()
-	defer trx.Commit()
+// Process an uploaded photo, i.e. hash it, generate its placeholder & palette, extract its EXIF,
+// generate its derivatives & its stripped copy, then index the results for all photos sharing its file.
+func ProcessPhoto(photoID uint) {
+	if err := HashPhoto(photoID); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ProcessPhoto()"))
+	}
+	if err := GeneratePlaceholder(photoID); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ProcessPhoto()"))
+	}
+	if err := ExtractExif(photoID); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ProcessPhoto()"))
+	}
+	if err := GenerateDerivatives(photoID); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ProcessPhoto()"))
+	}
+	if err := ShareStrippedPhoto(photoID); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "ProcessPhoto()"))
+	}
 
-	result := trx.Where("bucket_id = ? AND name = ?", bucketID, name).Delete(Photo{})
-	if err := result.Error; err != nil {
-		return err
+	photo, err := GetPhotoByID(photoID)
+	if err != nil {
+		return
 	}
-	if affected := result.RowsAffected; affected == 0 {
-		return NoSuchPhotoError
+	if photo.Hash != "" {
+		if err := indexBlobPhotos(photo.Hash); err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "ProcessPhoto()"))
+		}
 	}
-	return nil
+	utils.PublishUploadStage(fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photoID), utils.UploadThumbnailed, photo.Url, "")
+	utils.Events.Publish(events.PhotoProcessed{PhotoID: photoID, Url: photo.Url})
 }
 
 // Update a photo.
 func UpdatePhoto(photoToUpdate *Photo) (*Photo, error) {
 	trx := db.Begin()
-	defer trx.Commit()
 
 	photo := Photo{}
 	photo.ID = photoToUpdate.ID
 
 	result := trx.Model(&photo).Updates(*photoToUpdate)
 	if err := result.Error; err != nil {
+		trx.Rollback()
 		//log.Println(err)
 		utils.AppLogger.Info(err.Error(), zap.String("service", "UpdatePhoto()"))
 		return &photo, err
 	}
 	if affected := result.RowsAffected; affected == 0 {
+		trx.Rollback()
 		return &photo, NoSuchPhotoError
 	}
 
-	// update elasticsearch
+	// update elasticsearch once the transaction commits
+	if err := addOutboxEntry(trx, photo.ID, OutboxIndex); err != nil {
+		trx.Rollback()
+		return &photo, err
+	}
 	updated := Photo{}
 	trx.Where("id = ?", photoToUpdate.ID).First(&updated)
-	if err := IndexPhoto(&updated); err != nil {
+	if err := trx.Commit().Error; err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "UpdatePhoto()"))
 		return &photo, err
 	}
+	notifyOutbox()
 
+	updated.Thumbnails = getThumbnails([]string{updated.Hash})[updated.Hash]
+	updated.Exif = getExifs([]string{updated.Hash})[updated.Hash]
 	return &updated, nil
 }
 
-// Update the url for a photo.
-func UpdatePhotoUrl(photoID uint, url string) error {
+// Update the url for a photo, its blob is marked as stored as well.
+// The url saved is returned, it's empty if the photo is shared stripped but the stripped copy is not ready.
+func UpdatePhotoUrl(photoID uint, url string) (string, error) {
 	trx := db.Begin()
-	defer trx.Commit()
 
 	photo := Photo{}
-	photo.ID = photoID
+	trx.Where("id = ?", photoID).First(&photo)
+	if photo.ID == 0 {
+		trx.Rollback()
+		return "", NoSuchPhotoError
+	}
+	if mode := resolvePrivacy(photo.AuthID, photo.BucketID).Mode; mode == PrivacyStripShared {
+		url = sharedPhotoUrl(trx, &photo, mode)
+	}
 	err := trx.Model(&photo).Update("url", url).Error
+	if err == nil && photo.Hash != "" {
+		err = markBlobStored(trx, photo.Hash)
+	}
+	if err == nil {
+		err = addOutboxEntry(trx, photo.ID, OutboxIndex)
+	}
+	if err == nil {
+		err = trx.Commit().Error
+	} else {
+		trx.Rollback()
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	notifyOutbox()
+	return url, nil
 }
 
 // Get a photo by its photo id.
@@ -164,14 +415,17 @@ func GetPhotoByID(photoID uint) (*Photo, error) {
 
 	photo := Photo{}
 	err := trx.Where("id = ?", photoID).First(&photo).Error
-	found := NoSuchPhotoError
-	if err != nil || photo.ID == 0 {
+	if gorm.IsRecordNotFoundError(err) {
+		return &photo, NoSuchPhotoError
+	}
+	if err != nil {
 		//log.Println(err)
 		utils.AppLogger.Info(err.Error(), zap.String("service", "GetPhotoByID()"))
-		found = err
+		return &photo, err
 	}
-	found = nil
-	return &photo, found
+	photo.Thumbnails = getThumbnails([]string{photo.Hash})[photo.Hash]
+	photo.Exif = getExifs([]string{photo.Hash})[photo.Hash]
+	return &photo, nil
 }
 
 // Get photos by bucket id.
@@ -188,11 +442,17 @@ func GetPhotoByBucketID(bucketID uint, offset int) ([]Photo, error) {
 	if err != nil {
 		return photos, err
 	}
+	loadThumbnails(photos)
+	loadExifs(photos)
 	return photos, nil
 }
 
 // Check photo upload status.
 func GetPhotoUploadStatus(uploadID string) int {
+	// a completed resumable upload continues as a normal photo upload
+	if upload, err := GetResumableUpload(uploadID); err == nil && upload.PhotoUploadID != "" {
+		uploadID = upload.PhotoUploadID
+	}
 	status := utils.GetUploadStatus(uploadID)
 	switch status {
 	case -2:
@@ -206,4 +466,39 @@ func GetPhotoUploadStatus(uploadID string) int {
 	default:
 		return constant.INVALID_PARAMS
 	}
+}
+
+// Get the bytes transferred & the total bytes of an upload if it's tracked.
+func GetPhotoUploadProgress(uploadID string) (int64, int64, bool) {
+	return utils.GetUploadProgress(uploadID)
+}
+
+// Watch the progress of an upload of the user through all its stages, see utils.WatchUploadProgress.
+// The upload is either a resumable one, or the upload of a photo which is checked before subscribing.
+func WatchPhotoUploadProgress(uploadID string, authID uint) (*utils.UploadProgress, <-chan *utils.UploadProgress, func(), error) {
+	if upload, err := GetResumableUpload(uploadID); err == nil {
+		if upload.Photo.AuthID != authID {
+			return nil, nil, nil, UploadAccessError
+		}
+		// a completed resumable upload continues as a normal photo upload
+		if upload.PhotoUploadID != "" {
+			uploadID = upload.PhotoUploadID
+		}
+	} else {
+		var photoID uint
+		_, err := fmt.Sscanf(uploadID, constant.PHOTO_UPDATE_ID_FORMAT, &photoID)
+		if err != nil || fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photoID) != uploadID {
+			return nil, nil, nil, NoSuchUploadError
+		}
+		photo, err := GetPhotoByID(photoID)
+		if err == NoSuchPhotoError {
+			return nil, nil, nil, NoSuchUploadError
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+		if photo.AuthID != authID {
+			return nil, nil, nil, UploadAccessError
+		}
+	}
+	return utils.WatchUploadProgress(uploadID)
 }
\ No newline at end of file
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"go.uber.org/zap"
+	"image"
+	"strings"
+)
+
+// The colors of an image, i.e. its placeholder & its palette.
+type imageColors struct {
+	BlurHash 		string
+	DominantColor 	string
+	Palette 		string	// comma separated hex colors, the most common one first
+}
+
+// Get the colors of a decoded image.
+// They are calculated on a tiny copy, more pixels make no difference to a blurred placeholder or a palette.
+func getImageColors(img image.Image) imageColors {
+	small := utils.ResizeImage(img, constant.PLACEHOLDER_SAMPLE_SIZE, constant.PLACEHOLDER_SAMPLE_SIZE)
+
+	// more components along the longer side, so the blur keeps the layout of the photo
+	xComponents, yComponents := constant.BLURHASH_COMPONENTS, constant.BLURHASH_COMPONENTS - 1
+	if bounds := img.Bounds(); bounds.Dy() > bounds.Dx() {
+		xComponents, yComponents = yComponents, xComponents
+	}
+	return imageColors{
+		BlurHash: utils.BlurHash(small, xComponents, yComponents),
+		DominantColor: utils.DominantColor(small),
+		Palette: strings.Join(utils.ColorPalette(small, constant.PALETTE_MAX_COLORS, constant.PALETTE_MIN_SHARE), ","),
+	}
+}
+
+// Generate the placeholder & the palette of an uploaded photo which doesn't have them,
+// e.g. a photo uploaded before they are generated.
+func GeneratePlaceholder(photoID uint) error {
+	photo, err := GetPhotoByID(photoID)
+	if err != nil {
+		return err
+	}
+	if photo.BlurHash != "" && photo.Palette != "" {
+		return nil
+	}
+
+	object, err := utils.Store.Stat(photo.ObjectKey())
+	if err != nil {
+		return err
+	}
+	reader := utils.NewObjectReader(object.Key, object.Size)
+	defer reader.Close()
+	img, _, err := utils.DecodeImage(reader, constant.IMAGE_MAX_PIXELS)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "GeneratePlaceholder()"))
+		return nil	// not an image, no placeholder
+	}
+
+	colors := getImageColors(img)
+	return db.Model(&Photo{}).Where("id = ?", photoID).Updates(map[string]interface{}{
+		"blur_hash": colors.BlurHash,
+		"dominant_color": colors.DominantColor,
+		"palette": colors.Palette,
+	}).Error
+}
@@ -0,0 +1,240 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/rwcarlsen/goexif/exif"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var PrivacyDirectUploadError = errors.New("direct upload is not allowed by the privacy setting")
+var PrivacyStripError = errors.New("photo can not be stripped by the privacy setting")
+
+// What to do with the GPS & serial number tags in the EXIF of uploaded photos.
+type PrivacyMode string
+
+const (
+	PrivacyInherit 			PrivacyMode = ""				// follow the user, or the default
+	PrivacyKeep 			PrivacyMode = "keep"			// store the file as it is
+	PrivacyStripOriginal 	PrivacyMode = "strip_original"	// strip the stored original
+	PrivacyStripShared 		PrivacyMode = "strip_shared"	// keep the original, the photo url serves a stripped copy
+)
+
+// The name of the stripped copy among the derivatives of a blob.
+const sharedDerivativeName = "shared"
+
+// Check if the mode is a known one.
+func (mode PrivacyMode) Valid() bool {
+	return mode == PrivacyInherit || mode == PrivacyKeep || mode == PrivacyStripOriginal || mode == PrivacyStripShared
+}
+
+// The privacy setting of a photo, resolved from its bucket, its user & the default.
+type Privacy struct {
+	Mode 		PrivacyMode
+	KeepExif 	bool	// if the stripped location is still kept in the db
+}
+
+// Resolve the privacy setting of the photos in a bucket,
+// the bucket setting goes first, then the user setting, then the default.
+func resolvePrivacy(authID, bucketID uint) Privacy {
+	privacy := Privacy{}
+	var keepExif *bool
+
+	bucket := Bucket{}
+	db.Select("privacy, keep_exif").Where("id = ?", bucketID).First(&bucket)
+	privacy.Mode, keepExif = bucket.Privacy, bucket.KeepExif
+	if privacy.Mode == PrivacyInherit || keepExif == nil {
+		auth := Auth{}
+		db.Select("privacy, keep_exif").Where("id = ?", authID).First(&auth)
+		if privacy.Mode == PrivacyInherit {
+			privacy.Mode = auth.Privacy
+		}
+		if keepExif == nil {
+			keepExif = auth.KeepExif
+		}
+	}
+
+	if privacy.Mode == PrivacyInherit {
+		privacy.Mode = PrivacyMode(conf.ServerCfg.Get(constant.PRIVACY_DEFAULT))
+	}
+	if keepExif == nil {
+		privacy.KeepExif, _ = strconv.ParseBool(conf.ServerCfg.Get(constant.PRIVACY_KEEP_EXIF))
+	} else {
+		privacy.KeepExif = *keepExif
+	}
+	return privacy
+}
+
+// Check if the privacy setting lets a bucket take direct uploads,
+// a file uploaded directly can not be stripped before it's stored.
+func checkDirectUploadPrivacy(authID, bucketID uint) error {
+	if resolvePrivacy(authID, bucketID).Mode == PrivacyStripOriginal {
+		return PrivacyDirectUploadError
+	}
+	return nil
+}
+
+// An in-memory photo file.
+type memoryPhotoFile struct {
+	*bytes.Reader
+}
+
+func (memoryPhotoFile) Close() error {
+	return nil
+}
+
+// Strip the private EXIF tags of a photo file before it's stored.
+// The stripped file is returned in place of the given one, which is closed,
+// with the EXIF of the original if it's to be kept.
+func stripPhotoFile(photoFile PhotoFile, keepExif bool) (PhotoFile, *Exif, error) {
+	data, err := ioutil.ReadAll(photoFile)
+	if err != nil {
+		return photoFile, nil, err
+	}
+	photoFile.Close()
+
+	var photoExif *Exif
+	if keepExif {
+		if decoded, err := exif.Decode(bytes.NewReader(data)); err == nil {
+			photoExif = parseExif(decoded)
+		}
+	}
+	if _, err := utils.StripPrivateExif(data); err != nil {
+		// never store an original which may still have the location
+		utils.AppLogger.Info(err.Error(), zap.String("service", "stripPhotoFile()"))
+		return memoryPhotoFile{bytes.NewReader(data)}, nil, PrivacyStripError
+	}
+	return memoryPhotoFile{bytes.NewReader(data)}, photoExif, nil
+}
+
+// Save the EXIF extracted from the original of a stripped blob,
+// unless the blob has its EXIF already.
+func saveStrippedExif(photoExif *Exif, hash string) error {
+	photoExif.Hash = hash
+	return db.Where(Exif{Hash: hash}).FirstOrCreate(photoExif).Error
+}
+
+// Get the url of a stored photo as it's shared, i.e. the url of the stripped copy if the photo is shared stripped.
+// An empty url is returned if the stripped copy is not generated yet, so the original never leaks.
+func sharedPhotoUrl(trx *gorm.DB, photo *Photo, mode PrivacyMode) string {
+	if mode != PrivacyStripShared || photo.Hash == "" {
+		return utils.Store.Url(photo.ObjectKey())
+	}
+	derivative := Derivative{}
+	trx.Where("hash = ? AND name = ?", photo.Hash, sharedDerivativeName).First(&derivative)
+	if derivative.ID > 0 {
+		return utils.Store.Url(derivative.ObjectKey)
+	}
+	if photo.MimeType != "" && !strippable(photo.MimeType) {
+		return utils.Store.Url(photo.ObjectKey())	// nothing we can strip
+	}
+	return ""
+}
+
+// Check if the private EXIF tags of a file type can be stripped.
+func strippable(mimeType string) bool {
+	return mimeType == "image/jpeg" || mimeType == "image/png" || mimeType == "image/webp"
+}
+
+// Generate the stripped copy of an uploaded photo if it's shared stripped,
+// then point the photo url to the copy.
+func ShareStrippedPhoto(photoID uint) error {
+	photo, err := GetPhotoByID(photoID)
+	if err != nil {
+		return err
+	}
+	if photo.Hash == "" || !strippable(photo.MimeType) ||
+		resolvePrivacy(photo.AuthID, photo.BucketID).Mode != PrivacyStripShared {
+		return nil
+	}
+
+	if sharedPhotoUrl(db, photo, PrivacyStripShared) == "" {
+		lockKey := fmt.Sprintf(constant.DERIVATIVE_LOCK_FORMAT, photo.Hash)
+		lock := utils.AcquireLock(lockKey, constant.DERIVATIVE_LOCK_MINUTE * time.Minute)
+		if lock == nil {
+			return nil	// being generated by another upload of the same file, which updates the url
+		}
+		stop := lock.KeepAlive(constant.DERIVATIVE_LOCK_MINUTE * time.Minute)
+		err := generateSharedCopy(photo)
+		stop()
+		lock.Release()
+		if err != nil {
+			utils.AppLogger.Info(err.Error(), zap.String("service", "ShareStrippedPhoto()"))
+			return err
+		}
+	}
+
+	// every photo of the blob shared stripped gets the url
+	photos := make([]Photo, 0)
+	if err := db.Where("hash = ?", photo.Hash).Find(&photos).Error; err != nil {
+		return err
+	}
+	for i := 0;i < len(photos);i++ {
+		if resolvePrivacy(photos[i].AuthID, photos[i].BucketID).Mode != PrivacyStripShared {
+			continue
+		}
+		url := sharedPhotoUrl(db, &photos[i], PrivacyStripShared)
+		if err := db.Model(&photos[i]).Update("url", url).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy the original file of a photo with its private EXIF tags stripped.
+func generateSharedCopy(photo *Photo) error {
+	object, err := utils.Store.Stat(photo.ObjectKey())
+	if err != nil {
+		return err
+	}
+	reader := utils.NewObjectReader(object.Key, object.Size)
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	if _, err := utils.StripPrivateExif(data); err != nil {
+		return err	// never share a copy which may still have the location
+	}
+
+	format := strings.TrimPrefix(photo.MimeType, "image/")	// the copy keeps the format of the original
+	derivative := Derivative{
+		Hash: photo.Hash,
+		Name: sharedDerivativeName,
+		Width: photo.Width,
+		Height: photo.Height,
+		ObjectKey: fmt.Sprintf(constant.DERIVATIVE_SHARED_KEY_FORMAT, photo.Hash, format),
+		Size: int64(len(data)),
+	}
+	if err := utils.Store.Put(derivative.ObjectKey, bytes.NewReader(data), derivative.Size); err != nil {
+		return err
+	}
+	return db.Create(&derivative).Error
+}
+
+// Update the privacy setting of a user, an empty mode or a nil keep-exif leaves it unchanged.
+func UpdateAuthPrivacy(username string, mode PrivacyMode, keepExif *bool) (*Auth, error) {
+	trx := db.Begin()
+	defer trx.Commit()
+
+	auth := Auth{}
+	trx.Set("gorm:query_option", "FOR UPDATE").Where("user_name = ?", username).First(&auth)
+	if auth.ID == 0 {
+		return nil, NoSuchAuthError
+	}
+	err := trx.Model(&auth).Updates(Auth{Privacy: mode, KeepExif: keepExif}).Error
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "UpdateAuthPrivacy()"))
+		return nil, err
+	}
+	return &auth, nil
+}
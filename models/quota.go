@@ -0,0 +1,136 @@
+package models
+
+import (
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+var QuotaExceededError = errors.New("quota exceeded")
+
+// A quota overriding the default limits of a user (bucket id is 0) or a bucket.
+// A limit of 0 means unlimited.
+type Quota struct {
+	BaseModel
+	AuthID 		uint	`json:"auth_id" gorm:"type:int"`
+	BucketID 	uint	`json:"bucket_id" gorm:"type:int"`
+	MaxPhotos 	int		`json:"max_photos" gorm:"type:int"`
+	MaxBytes 	int64	`json:"max_bytes" gorm:"type:bigint"`
+}
+
+// The consumption of a user or a bucket against its limits.
+type Usage struct {
+	Photos 		int		`json:"photos"`
+	Bytes 		int64	`json:"bytes"`
+	MaxPhotos 	int		`json:"max_photos"`
+	MaxBytes 	int64	`json:"max_bytes"`
+}
+
+// Check if adding a photo of the given size exceeds the usage limits.
+func (usage *Usage) exceeded(size int64) bool {
+	return (usage.MaxPhotos > 0 && usage.Photos + 1 > usage.MaxPhotos) ||
+		(usage.MaxBytes > 0 && usage.Bytes + size > usage.MaxBytes)
+}
+
+// Check the quotas of the user & the bucket before adding a photo of the given size.
+// It's checked again when the photo is created, this is for rejecting large uploads early.
+func CheckQuota(authID, bucketID uint, size int64) error {
+	trx := db.Begin()
+	defer trx.Commit()
+	return checkQuota(trx, authID, bucketID, size)
+}
+
+// Check the quotas of the user & the bucket in a transaction.
+// The bucket & the auth rows are locked, so that concurrent uploads don't exceed the quotas together.
+func checkQuota(trx *gorm.DB, authID, bucketID uint, size int64) error {
+	trx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", authID).First(&Auth{})
+	trx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", bucketID).First(&Bucket{})
+
+	userUsage, err := getUserUsage(trx, authID)
+	if err != nil {
+		return err
+	}
+	bucketUsage, err := getBucketUsage(trx, bucketID)
+	if err != nil {
+		return err
+	}
+	if userUsage.exceeded(size) || bucketUsage.exceeded(size) {
+		return QuotaExceededError
+	}
+	return nil
+}
+
+// Get the usage of a user, & of one of its buckets if the bucket id is given.
+func GetUsage(authID, bucketID uint) (*Usage, *Usage, error) {
+	trx := db.Begin()
+	defer trx.Commit()
+
+	userUsage, err := getUserUsage(trx, authID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bucketID == 0 {
+		return userUsage, nil, nil
+	}
+
+	bucket := Bucket{}
+	trx.Where("id = ? AND auth_id = ?", bucketID, authID).First(&bucket)
+	if bucket.ID == 0 {
+		return nil, nil, NoSuchBucketError
+	}
+	bucketUsage, err := getBucketUsage(trx, bucketID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return userUsage, bucketUsage, nil
+}
+
+// Get the usage of a user, summed up from all its photos.
+func getUserUsage(trx *gorm.DB, authID uint) (*Usage, error) {
+	auth := Auth{}
+	trx.Where("id = ?", authID).First(&auth)
+	if auth.ID == 0 {
+		return nil, NoSuchAuthError
+	}
+
+	usage := getQuota(trx, authID, 0, constant.QUOTA_USER_MAX_PHOTOS, constant.QUOTA_USER_MAX_BYTES)
+	row := trx.Model(&Photo{}).Where("auth_id = ?", authID).Select("COUNT(*), COALESCE(SUM(size), 0)").Row()
+	if err := row.Scan(&usage.Photos, &usage.Bytes); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "getUserUsage()"))
+		return nil, err
+	}
+	return usage, nil
+}
+
+// Get the usage of a bucket, which is counted in the bucket record.
+func getBucketUsage(trx *gorm.DB, bucketID uint) (*Usage, error) {
+	bucket := Bucket{}
+	trx.Where("id = ?", bucketID).First(&bucket)
+	if bucket.ID == 0 {
+		return nil, NoSuchBucketError
+	}
+
+	usage := getQuota(trx, bucket.AuthID, bucketID, constant.QUOTA_BUCKET_MAX_PHOTOS, constant.QUOTA_BUCKET_MAX_BYTES)
+	usage.Photos = bucket.Size
+	usage.Bytes = bucket.Bytes
+	return usage, nil
+}
+
+// Get the limits of a user or a bucket, the default ones are used if no quota is set.
+func getQuota(trx *gorm.DB, authID, bucketID uint, maxPhotosKey, maxBytesKey string) *Usage {
+	usage := Usage{}
+	quota := Quota{}
+	trx.Where("auth_id = ? AND bucket_id = ?", authID, bucketID).First(&quota)
+	if quota.ID > 0 {
+		usage.MaxPhotos = quota.MaxPhotos
+		usage.MaxBytes = quota.MaxBytes
+	} else {
+		usage.MaxPhotos, _ = strconv.Atoi(conf.ServerCfg.Get(maxPhotosKey))
+		usage.MaxBytes, _ = strconv.ParseInt(conf.ServerCfg.Get(maxBytesKey), 10, 64)
+	}
+	return &usage
+}
@@ -0,0 +1,25 @@
+package models
+
+import "testing"
+
+func TestUsageExceeded(t *testing.T) {
+	cases := []struct {
+		usage 	Usage
+		size 	int64
+		want 	bool
+	}{
+		{Usage{Photos: 100, Bytes: 1 << 30}, 1 << 20, false},	// no limits
+		{Usage{Photos: 9, MaxPhotos: 10}, 1, false},
+		{Usage{Photos: 10, MaxPhotos: 10}, 1, true},
+		{Usage{Bytes: 900, MaxBytes: 1000}, 100, false},
+		{Usage{Bytes: 900, MaxBytes: 1000}, 101, true},
+		{Usage{Bytes: 1000, MaxBytes: 1000}, 0, false},
+		{Usage{Photos: 10, MaxPhotos: 10, Bytes: 0, MaxBytes: 1000}, 1, true},
+		{Usage{Photos: 0, MaxPhotos: 10, Bytes: 1000, MaxBytes: 1000}, 1, true},
+	}
+	for i, c := range cases {
+		if got := c.usage.exceeded(c.size); got != c.want {
+			t.Errorf("case %d: %+v exceeded(%d) = %v, want %v", i, c.usage, c.size, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"go.uber.org/zap"
+	"time"
+)
+
+var ReindexRunningError = errors.New("reindex is running")
+var NoReindexError = errors.New("no reindex has run")
+
+// The states of a reindex.
+const (
+	ReindexRunning 	= "running"
+	ReindexDone 	= "done"
+	ReindexFailed 	= "failed"
+)
+
+// The progress of a full reindex, it's saved in redis so any instance can report it.
+type ReindexReport struct {
+	Alias 		string		`json:"alias"`
+	Index 		string		`json:"index"`
+	State 		string		`json:"state"`
+	Total 		int			`json:"total"`
+	Indexed 	int			`json:"indexed"`
+	Failed 		int			`json:"failed"`
+	CaughtUp 	int			`json:"caught_up"`	// photos changed during the reindex, indexed again after the swap
+	OutboxMark 	uint		`json:"outbox_mark"`	// the last outbox entry before the reindex
+	StartedAt 	time.Time	`json:"started_at"`
+	FinishedAt 	*time.Time	`json:"finished_at,omitempty"`
+	Error 		string		`json:"error,omitempty"`
+}
+
+// Rebuild the photo index from the db, it returns once the reindex finishes.
+// The progress is passed to the given function after each batch, if it's not nil.
+func Reindex(progress func(report *ReindexReport)) (*ReindexReport, error) {
+	report, lock, err := beginReindex()
+	if err != nil {
+		return nil, err
+	}
+	runReindex(report, lock, progress)
+	return report, nil
+}
+
+// Rebuild the photo index from the db in background, the report at the start is returned.
+func StartReindex() (*ReindexReport, error) {
+	report, lock, err := beginReindex()
+	if err != nil {
+		return nil, err
+	}
+	started := *report
+	go runReindex(report, lock, nil)
+	return &started, nil
+}
+
+// Get the report of the running or the last reindex.
+func GetReindexReport() (*ReindexReport, error) {
+	encoded := utils.GetReindexReport()
+	if encoded == "" {
+		return nil, NoReindexError
+	}
+	report := ReindexReport{}
+	if err := json.Unmarshal([]byte(encoded), &report); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "GetReindexReport()"))
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Lock the reindex & set up its report, only one reindex runs at a time among all instances.
+// The last outbox entry is marked, the photos of the entries after it are recorded by the relay
+// while the report is running, & replayed once the alias is swapped.
+func beginReindex() (*ReindexReport, *utils.Lock, error) {
+	lock := utils.AcquireLock(constant.REINDEX_LOCK, constant.REINDEX_LOCK_MINUTE * time.Minute)
+	if lock == nil {
+		return nil, nil, ReindexRunningError
+	}
+	mark := uint(0)
+	err := db.Model(&OutboxEntry{}).Select("COALESCE(MAX(id), 0)").Row().Scan(&mark)
+	if err == nil {
+		err = utils.ClearReindexChanges()
+	}
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "beginReindex()"))
+		lock.Release()
+		return nil, nil, err
+	}
+
+	alias := conf.ServerCfg.Get(constant.ES_PHOTO_INDEX)
+	startedAt := time.Now()
+	report := &ReindexReport{
+		Alias: alias,
+		Index: newPhotoIndexName(alias, startedAt.Unix()),
+		State: ReindexRunning,
+		StartedAt: startedAt,
+		OutboxMark: mark,
+	}
+	saveReindexReport(report)
+	return report, lock, nil
+}
+
+// Run a reindex, the photos are streamed from the db in batches & bulk indexed into a fresh index.
+// Once every photo is indexed the alias is swapped to the fresh index atomically, so search never stops,
+// then the photos changed in the meantime are indexed again & the old indices are deleted.
+func runReindex(report *ReindexReport, lock *utils.Lock, progress func(report *ReindexReport)) {
+	defer lock.Release()
+	defer lock.KeepAlive(constant.REINDEX_LOCK_MINUTE * time.Minute)()
+
+	err := fillPhotoIndex(report, progress)
+	if err == nil {
+		err = switchPhotoIndex(report)
+	}
+
+	finishedAt := time.Now()
+	report.FinishedAt = &finishedAt
+	report.State = ReindexDone
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "runReindex()"))
+		report.State = ReindexFailed
+		report.Error = err.Error()
+	}
+	saveReindexReport(report)
+	if progress != nil {
+		progress(report)
+	}
+}
+
+// Index all photos into the fresh index, it's deleted if any photo fails.
+func fillPhotoIndex(report *ReindexReport, progress func(report *ReindexReport)) error {
+	if err := db.Model(&Photo{}).Count(&report.Total).Error; err != nil {
+		return err
+	}
+	if err := createPhotoIndex(report.Index); err != nil {
+		return err
+	}
+
+	lastID := uint(0)
+	for {
+		photos := make([]Photo, 0, constant.REINDEX_BATCH_SIZE)
+		err := db.Where("id > ?", lastID).Order("id").Limit(constant.REINDEX_BATCH_SIZE).Find(&photos).Error
+		if err == nil && len(photos) == 0 {
+			break
+		}
+		failed := 0
+		if err == nil {
+			loadThumbnails(photos)
+			loadExifs(photos)
+			failed, err = bulkIndexPhotos(report.Index, photos)
+		}
+		if err != nil {
+			deletePhotoIndices([]string{report.Index})
+			return err
+		}
+
+		lastID = photos[len(photos) - 1].ID
+		report.Indexed += len(photos) - failed
+		report.Failed += failed
+		saveReindexReport(report)
+		if progress != nil {
+			progress(report)
+		}
+	}
+
+	if report.Failed > 0 {
+		deletePhotoIndices([]string{report.Index})
+		return fmt.Errorf("%d photos fail to be indexed", report.Failed)
+	}
+	return refreshPhotoIndex(report.Index)
+}
+
+// Swap the alias to the fresh index, then catch up with the changes made during the reindex,
+// which are applied to the old index by the outbox relay.
+func switchPhotoIndex(report *ReindexReport) error {
+	oldIndices, err := swapPhotoAlias(report.Alias, report.Index)
+	if err != nil {
+		deletePhotoIndices([]string{report.Index})
+		return err
+	}
+
+	// every photo changed after the mark is indexed again by the relay, a deleted one is deleted again
+	photoIDs, err := utils.GetReindexChanges()
+	if err != nil {
+		return err
+	}
+	trx := db.Begin()
+	for _, photoID := range photoIDs {
+		if err := addOutboxEntry(trx, photoID, OutboxIndex); err != nil {
+			trx.Rollback()
+			return err
+		}
+	}
+	if err := trx.Commit().Error; err != nil {
+		return err
+	}
+	notifyOutbox()
+	report.CaughtUp = len(photoIDs)
+	return deletePhotoIndices(oldIndices)
+}
+
+// Record the photos of the outbox entries after the mark of a running reindex, before they're applied
+// to the old index. An entry read before the reindex begins is covered by the reindex itself.
+func recordReindexChanges(entries []OutboxEntry) error {
+	report, err := GetReindexReport()
+	if err == NoReindexError || (err == nil && report.State != ReindexRunning) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	photoIDs := make([]uint, 0, len(entries))
+	for _, entry := range entries {
+		if entry.ID > report.OutboxMark {
+			photoIDs = append(photoIDs, entry.PhotoID)
+		}
+	}
+	if len(photoIDs) == 0 {
+		return nil
+	}
+	return utils.AddReindexChanges(photoIDs)
+}
+
+func saveReindexReport(report *ReindexReport) {
+	encoded, _ := json.Marshal(report)
+	utils.SetReindexReport(string(encoded))
+}
@@ -0,0 +1,125 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"image"
+	"strings"
+)
+
+var RenderSizeNotAllowedError = errors.New("render size is not allowed")
+var RenderOptionsError = errors.New("invalid render options")
+var RenderDecodeError = errors.New("photo can not be decoded")
+
+// Ways to fit a photo in the render size.
+const (
+	RenderFitContain 	= "contain"		// scale down to fit in the size, keep the aspect ratio
+	RenderFitCover 		= "cover"		// scale to cover the size, crop the overflow
+	RenderFitFill 		= "fill"		// stretch to exactly the size
+)
+
+// Options of rendering a photo.
+type RenderOptions struct {
+	Width 		int
+	Height 		int
+	Fit 		string
+	Format 		string	// empty to decide by the original format
+	Quality 	int
+}
+
+// Check the options, the size must be in the allow-list to prevent abuse.
+func (options *RenderOptions) validate() error {
+	if options.Fit != RenderFitContain && options.Fit != RenderFitCover && options.Fit != RenderFitFill {
+		return RenderOptionsError
+	}
+	if options.Format != "" && options.Format != utils.ImageFormatJPEG && options.Format != utils.ImageFormatPNG {
+		return RenderOptionsError
+	}
+	if options.Quality < 1 || options.Quality > 100 {
+		return RenderOptionsError
+	}
+
+	size := fmt.Sprintf("%dx%d", options.Width, options.Height)
+	for _, allowed := range strings.Split(conf.ServerCfg.Get(constant.RENDER_ALLOWED_SIZES), ",") {
+		if strings.TrimSpace(allowed) == size {
+			return nil
+		}
+	}
+	return RenderSizeNotAllowedError
+}
+
+// Get the key of a rendered photo in the storage, renders are cached by the photo content & the options.
+func (options *RenderOptions) key(photo *Photo, format string) string {
+	source := photo.Hash
+	if source == "" {
+		source = fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photo.ID)	// photos uploaded before content addressing
+	}
+	return fmt.Sprintf(constant.RENDER_KEY_FORMAT, source,
+		options.Width, options.Height, options.Fit, options.Quality, format)
+}
+
+// Render a photo with the given options, the cached render is used if it exists.
+// Renders are never tracked in the db, the garbage collector deletes them along with their blobs.
+func RenderPhoto(photo *Photo, options *RenderOptions) (*utils.ObjectInfo, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	// without an explicit format, the cached render of either format is fine
+	formats := []string{options.Format}
+	if options.Format == "" {
+		formats = []string{utils.ImageFormatJPEG, utils.ImageFormatPNG}
+	}
+	for _, format := range formats {
+		if object, err := utils.Store.Stat(options.key(photo, format)); err == nil {
+			return object, nil
+		} else if err != utils.ObjectNotExistError {
+			return nil, err
+		}
+	}
+
+	original, err := utils.Store.Stat(photo.ObjectKey())
+	if err != nil {
+		return nil, err
+	}
+	reader := utils.NewObjectReader(original.Key, original.Size)
+	defer reader.Close()
+	img, srcFormat, err := utils.DecodeImage(reader, constant.IMAGE_MAX_PIXELS)
+	if err == utils.ImageTooLargeError {
+		return nil, err
+	} else if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "RenderPhoto()"))
+		return nil, RenderDecodeError
+	}
+
+	format := options.Format
+	if format == "" {
+		format = utils.DerivativeFormat(srcFormat)
+	}
+	var rendered image.Image
+	switch options.Fit {
+	case RenderFitCover:
+		rendered = utils.CoverImage(img, options.Width, options.Height)
+	case RenderFitFill:
+		rendered = utils.ResizeImage(img, options.Width, options.Height)
+	default:
+		rendered = utils.FitImage(img, options.Width, options.Height)
+	}
+
+	buffer := bytes.Buffer{}
+	if err := utils.EncodeImage(&buffer, rendered, format, options.Quality); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "RenderPhoto()"))
+		return nil, err
+	}
+	key := options.key(photo, format)
+	if err := utils.Store.Put(key, &buffer, int64(buffer.Len())); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "RenderPhoto()"))
+		return nil, err
+	}
+	return utils.Store.Stat(key)
+}
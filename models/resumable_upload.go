@@ -0,0 +1,252 @@
+package models
+
+import (
+	"crypto/rand"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"gin-photo-storage/utils"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var UploadOffsetError = errors.New("upload offset does not match")
+var UploadLockedError = errors.New("upload is locked")
+var UploadTooLargeError = errors.New("upload is too large")
+var UploadInstanceError = errors.New("upload is spooled on another instance")
+
+// A resumable upload, chunks are appended to a spool file until it's complete,
+// then the assembled file is added as a normal photo.
+// The spool file is local, so the upload can only be written on the instance it's created on.
+type ResumableUpload struct {
+	ID 				string
+	Length 			int64
+	Offset 			int64
+	Photo 			Photo
+	Policy 			DuplicatePolicy
+	PhotoUploadID 	string
+	Instance 		string
+	Failed 			bool
+}
+
+// Check if the upload is spooled on this instance, an upload of an unknown instance is assumed local.
+func (upload *ResumableUpload) local() bool {
+	return upload.Instance == "" || upload.Instance == utils.UploadInstance()
+}
+
+// Check if all bytes of the upload are written but its photo is not added yet,
+// i.e. adding the photo failed for a temporary error & it should be added again.
+func (upload *ResumableUpload) pending() bool {
+	return upload.Offset == upload.Length && upload.PhotoUploadID == "" && !upload.Failed
+}
+
+// Create a resumable upload of the given length for the photo.
+func CreateResumableUpload(photoToAdd *Photo, length int64, policy DuplicatePolicy) (*ResumableUpload, error) {
+	if length > MaxUploadBytes() {
+		return nil, UploadTooLargeError
+	}
+
+	randomID := make([]byte, 16)
+	if _, err := rand.Read(randomID); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "CreateResumableUpload()"))
+		return nil, err
+	}
+	upload := ResumableUpload{
+		ID: fmt.Sprintf(constant.RESUMABLE_UPLOAD_ID_FORMAT, randomID),
+		Length: length,
+		Photo: *photoToAdd,
+		Policy: policy,
+		Instance: utils.UploadInstance(),
+	}
+
+	// create an empty spool file
+	spoolPath := resumableSpoolPath(upload.ID)
+	if err := os.MkdirAll(filepath.Dir(spoolPath), 0755); err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "CreateResumableUpload()"))
+		return nil, err
+	}
+	file, err := os.Create(spoolPath)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "CreateResumableUpload()"))
+		return nil, err
+	}
+	file.Close()
+
+	if !utils.SetResumableUpload(upload.ID, map[string]interface{}{
+		"length": upload.Length,
+		"offset": upload.Offset,
+		"auth_id": upload.Photo.AuthID,
+		"bucket_id": upload.Photo.BucketID,
+		"name": upload.Photo.Name,
+		"tag": upload.Photo.Tag,
+		"description": upload.Photo.Description,
+		"duplicate": string(upload.Policy),
+		"instance": upload.Instance,
+	}) || !utils.SetUploadStatus(upload.ID, 1) {
+		os.Remove(spoolPath)
+		return nil, UploadStatusError
+	}
+	utils.SetUploadProgress(upload.ID, upload.Offset, upload.Length)
+	return &upload, nil
+}
+
+// Get a resumable upload by its id.
+func GetResumableUpload(uploadID string) (*ResumableUpload, error) {
+	fields := utils.GetResumableUpload(uploadID)
+	if len(fields) == 0 {
+		return nil, NoSuchUploadError
+	}
+
+	upload := ResumableUpload{ID: uploadID, PhotoUploadID: fields["photo_upload_id"],
+		Instance: fields["instance"], Failed: fields["failed"] != ""}
+	upload.Length, _ = strconv.ParseInt(fields["length"], 10, 64)
+	upload.Offset, _ = strconv.ParseInt(fields["offset"], 10, 64)
+	authID, _ := strconv.Atoi(fields["auth_id"])
+	bucketID, _ := strconv.Atoi(fields["bucket_id"])
+	upload.Photo.AuthID = uint(authID)
+	upload.Photo.BucketID = uint(bucketID)
+	upload.Photo.Name = fields["name"]
+	upload.Photo.Tag = fields["tag"]
+	upload.Photo.Description = fields["description"]
+	upload.Policy = DuplicatePolicy(fields["duplicate"])
+	return &upload, nil
+}
+
+// Append a chunk to a resumable upload at the given offset.
+// When the last chunk arrives, the assembled file is added as a photo.
+// If it failed for a temporary error, an empty chunk at the end adds the photo again.
+func WriteResumableUpload(uploadID string, offset int64, chunk io.Reader) (*ResumableUpload, error) {
+	lock := utils.LockResumableUpload(uploadID)
+	if lock == nil {
+		return nil, UploadLockedError
+	}
+	defer lock.Release()
+	// a chunk may take longer than the lock lasts on a slow connection
+	defer lock.KeepAlive(constant.RESUMABLE_UPLOAD_LOCK_MINUTE * time.Minute)()
+
+	upload, err := GetResumableUpload(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if !upload.local() {
+		return upload, UploadInstanceError
+	}
+	if upload.pending() && offset == upload.Length {
+		return upload, completeResumableUpload(upload)
+	}
+	written, err := writeResumableSpool(upload, offset, chunk)
+	if err == UploadOffsetError {
+		return upload, err
+	}
+
+	// the bytes written are kept even if the request breaks, the client resumes from there
+	upload.Offset += written
+	utils.SetResumableUpload(uploadID, map[string]interface{}{"offset": upload.Offset})
+	utils.SetUploadProgress(uploadID, upload.Offset, upload.Length)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "WriteResumableUpload()"))
+		return upload, err
+	}
+
+	if upload.Offset == upload.Length {
+		err = completeResumableUpload(upload)
+	}
+	return upload, err
+}
+
+// Write a chunk to the spool file of a resumable upload at the given offset,
+// the chunk is cut at the length of the upload. It returns the number of bytes written.
+func writeResumableSpool(upload *ResumableUpload, offset int64, chunk io.Reader) (int64, error) {
+	if upload.Offset != offset || upload.Offset == upload.Length {
+		return 0, UploadOffsetError
+	}
+
+	file, err := os.OpenFile(resumableSpoolPath(upload.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	// drop the bytes written after the saved offset by an interrupted request
+	written := int64(0)
+	if err = file.Truncate(upload.Offset); err == nil {
+		if _, err = file.Seek(upload.Offset, io.SeekStart); err == nil {
+			written, err = io.Copy(file, io.LimitReader(chunk, upload.Length - upload.Offset))
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+// Complete a resumable upload again if its photo was not added for a temporary error,
+// otherwise the upload is returned as it is.
+func ResumeResumableUpload(uploadID string) (*ResumableUpload, error) {
+	upload, err := GetResumableUpload(uploadID)
+	if err != nil || !upload.pending() {
+		return upload, err
+	}
+	if !upload.local() {
+		return upload, UploadInstanceError
+	}
+
+	lock := utils.LockResumableUpload(uploadID)
+	if lock == nil {
+		return upload, UploadLockedError
+	}
+	defer lock.Release()
+	defer lock.KeepAlive(constant.RESUMABLE_UPLOAD_LOCK_MINUTE * time.Minute)()
+
+	// it may be completed before it's locked
+	if upload, err = GetResumableUpload(uploadID); err != nil || !upload.pending() {
+		return upload, err
+	}
+	return upload, completeResumableUpload(upload)
+}
+
+// Hand the assembled file of a complete resumable upload to the photo pipeline.
+// The spool file is kept if the photo is not added for a temporary error, so it can be added again.
+func completeResumableUpload(upload *ResumableUpload) error {
+	spoolPath := resumableSpoolPath(upload.ID)
+	file, err := os.Open(spoolPath)
+	if err != nil {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "completeResumableUpload()"))
+		return err
+	}
+
+	_, photoUploadID, err := AddPhoto(&upload.Photo, file, upload.Length, upload.Policy)
+	if err != nil && !permanentUploadError(err) {
+		utils.AppLogger.Info(err.Error(), zap.String("service", "completeResumableUpload()"))
+		return err
+	}
+	os.Remove(spoolPath)
+	if err != nil {
+		upload.Failed = true
+		utils.SetResumableUpload(upload.ID, map[string]interface{}{"failed": err.Error()})
+		utils.SetUploadStatus(upload.ID, -1)
+		return err
+	}
+	upload.PhotoUploadID = photoUploadID
+	utils.SetResumableUpload(upload.ID, map[string]interface{}{"photo_upload_id": photoUploadID})
+	return nil
+}
+
+// Check if a photo can never be added by the error of adding it, i.e. it's no use adding it again.
+func permanentUploadError(err error) bool {
+	switch err {
+	case PhotoContentError, UploadTooLargeError, PrivacyStripError, PhotoFileBrokenError,
+		PhotoExistsError, QuotaExceededError, DuplicatePhotoError:
+		return true
+	}
+	return false
+}
+
+// Get the path of the spool file of a resumable upload.
+func resumableSpoolPath(uploadID string) string {
+	return filepath.Join(conf.ServerCfg.Get(constant.TUS_SPOOL_DIR), uploadID)
+}
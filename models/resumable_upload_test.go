@@ -0,0 +1,59 @@
+package models
+
+import (
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteResumableSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spoolDir := conf.ServerCfg.ConfigMap[constant.TUS_SPOOL_DIR]
+	conf.ServerCfg.ConfigMap[constant.TUS_SPOOL_DIR] = dir
+	defer func() { conf.ServerCfg.ConfigMap[constant.TUS_SPOOL_DIR] = spoolDir }()
+
+	cases := []struct {
+		name 		string
+		spooled 	string	// the spool file before the chunk, longer than the offset after an interrupted request
+		upload 		ResumableUpload
+		offset 		int64
+		chunk 		string
+		written 	int64
+		want 		string
+		err 		error
+	}{
+		{"first chunk", "", ResumableUpload{Length: 10}, 0, "abcd", 4, "abcd", nil},
+		{"next chunk", "abcd", ResumableUpload{Length: 10, Offset: 4}, 4, "efgh", 4, "abcdefgh", nil},
+		{"cut at the length", "abcd", ResumableUpload{Length: 6, Offset: 4}, 4, "efgh", 2, "abcdef", nil},
+		{"truncated after an interruption", "abcdxx", ResumableUpload{Length: 10, Offset: 4}, 4, "ef", 2, "abcdef", nil},
+		{"offset behind", "abcd", ResumableUpload{Length: 10, Offset: 4}, 2, "cd", 0, "abcd", UploadOffsetError},
+		{"offset ahead", "abcd", ResumableUpload{Length: 10, Offset: 4}, 6, "gh", 0, "abcd", UploadOffsetError},
+		{"already complete", "abcd", ResumableUpload{Length: 4, Offset: 4}, 4, "e", 0, "abcd", UploadOffsetError},
+	}
+	for i, c := range cases {
+		c.upload.ID = string('a' + rune(i))
+		if err := ioutil.WriteFile(resumableSpoolPath(c.upload.ID), []byte(c.spooled), 0644); err != nil {
+			t.Fatal(err)
+		}
+		written, err := writeResumableSpool(&c.upload, c.offset, strings.NewReader(c.chunk))
+		if written != c.written || err != c.err {
+			t.Errorf("%s: writeResumableSpool() = %d, %v, want %d, %v", c.name, written, err, c.written, c.err)
+		}
+		if spooled, _ := ioutil.ReadFile(resumableSpoolPath(c.upload.ID)); string(spooled) != c.want {
+			t.Errorf("%s: spool file = %q, want %q", c.name, spooled, c.want)
+		}
+	}
+
+	// the spool file is gone, e.g. it's cleaned up
+	upload := ResumableUpload{ID: "missing", Length: 10}
+	if _, err := writeResumableSpool(&upload, 0, strings.NewReader("abcd")); !os.IsNotExist(err) {
+		t.Errorf("missing spool file: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"gin-photo-storage/constant"
+	"gin-photo-storage/search"
+	"strconv"
+	"strings"
+)
+
+// The elasticsearch query of a parsed search query, see search/query.go for the syntax.
+
+// Build the elasticsearch clause of a query node, filters (ids & dates) don't affect the relevance.
+func queryClause(node *search.Node) (clause esQuery, filter bool) {
+	switch node.Kind {
+	case search.NodeAnd:
+		query := &esBoolQuery{}
+		for _, child := range node.Children {
+			addBoolClause(query, child)
+		}
+		return esQuery{Bool: query}, false
+	case search.NodeOr:
+		query := &esBoolQuery{Should: make([]esQuery, 0, len(node.Children)), MinimumShouldMatch: 1}
+		for _, child := range node.Children {
+			childClause, _ := queryClause(child)
+			query.Should = append(query.Should, childClause)
+		}
+		return esQuery{Bool: query}, false
+	case search.NodeNot:
+		query := &esBoolQuery{}
+		addBoolClause(query, node)
+		return esQuery{Bool: query}, true
+	}
+	return termClause(node)
+}
+
+// Add a query node to a bool query as a must, filter or must_not clause.
+func addBoolClause(query *esBoolQuery, node *search.Node) {
+	if node.Kind == search.NodeNot {
+		clause, _ := queryClause(node.Children[0])
+		query.MustNot = append(query.MustNot, clause)
+		return
+	}
+	clause, filter := queryClause(node)
+	if filter {
+		query.Filter = append(query.Filter, clause)
+	} else {
+		query.Must = append(query.Must, clause)
+	}
+}
+
+// Build the elasticsearch clause of a term.
+func termClause(node *search.Node) (esQuery, bool) {
+	wildcard := strings.ContainsAny(node.Value, "*?")
+	switch node.Field {
+	case "tag":
+		if wildcard && !node.AnyWord {
+			// a wildcard value is not normalized, so it's lowercased as the tags are
+			return esQuery{Wildcard: map[string]string{constant.SEARCH_BY_TAG: strings.ToLower(node.Value)}}, false
+		}
+		return esQuery{Term: map[string]interface{}{constant.SEARCH_BY_TAG: node.Value}}, false
+	case "name":
+		if wildcard {
+			return esQuery{Wildcard: map[string]string{"name": node.Value}}, false
+		}
+		return textClause(node, "name.text"), false
+	case "desc":
+		return textClause(node, constant.SEARCH_BY_DESC), false
+	case "camera":
+		return textClause(node, constant.SEARCH_BY_CAMERA), false
+	case "bucket":
+		bucketID, _ := strconv.ParseUint(node.Value, 10, 32)
+		return esQuery{Term: map[string]interface{}{"bucket_id": bucketID}}, true
+	case "after":
+		return dateRangeClause(constant.SORT_BY_CREATED_AT, esRange{Gte: node.Value}), true
+	case "before":
+		return dateRangeClause(constant.SORT_BY_CREATED_AT, esRange{Lt: node.Value}), true
+	case "taken_after":
+		return dateRangeClause(constant.SORT_BY_TAKEN_AT, esRange{Gte: node.Value}), true
+	case "taken_before":
+		return dateRangeClause(constant.SORT_BY_TAKEN_AT, esRange{Lt: node.Value}), true
+	}
+
+	// a bare value is searched in all text fields, the tags match it exactly
+	matchType := "best_fields"
+	if node.Quoted {
+		matchType = "phrase"
+	}
+	return esQuery{MultiMatch: &esMultiMatch{
+		Query: node.Value,
+		Type: matchType,
+		Fields: []string{constant.SEARCH_BY_TAG + "^2", "name.text", constant.SEARCH_BY_DESC, constant.SEARCH_BY_CAMERA},
+	}}, false
+}
+
+// Build a match clause, a quoted value matches a phrase.
+func textClause(node *search.Node, field string) esQuery {
+	if node.Quoted {
+		return esQuery{MatchPhrase: map[string]string{field: node.Value}}
+	}
+	if node.AnyWord {
+		return esQuery{Match: map[string]esMatch{field: {Query: node.Value}}}
+	}
+	return esQuery{Match: map[string]esMatch{field: {Query: node.Value, Operator: "and"}}}
+}
+
+// Build a range clause of a date field.
+func dateRangeClause(field string, dateRange esRange) esQuery {
+	dateRange.Format = "yyyy-MM-dd"
+	return esQuery{Range: map[string]esRange{field: dateRange}}
+}
@@ -18,6 +18,7 @@ func init() {
 	checkAuthMdw := middleware.GetAuthMiddleware()			// middleware for authentication
 	refreshMdw := middleware.GetRefreshMiddleware()			// middleware for refresh auth token
 	paginationMdw := middleware.GetPaginationMiddleware()	// middleware for pagination
+	adminMdw := middleware.GetAdminMiddleware()				// middleware for admin permission
 
 	Router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
@@ -29,6 +30,7 @@ func init() {
 		{
 			authGroup.POST("/add", v1.AddAuth)
 			authGroup.POST("/check", v1.CheckAuth)
+			authGroup.PUT("/privacy", checkAuthMdw, refreshMdw, v1.UpdateAuthPrivacy)
 		}
 
 		// api group for bucket
@@ -40,6 +42,7 @@ func init() {
 			bucketGroup.PUT("/update", checkAuthMdw, refreshMdw, v1.UpdateBucket)
 			bucketGroup.GET("/get_by_id", checkAuthMdw, refreshMdw, v1.GetBucketByID)
 			bucketGroup.GET("/get_by_auth_id", checkAuthMdw, refreshMdw, paginationMdw, v1.GetBucketByAuthID)
+			bucketGroup.GET("/usage", checkAuthMdw, refreshMdw, v1.GetUsage)
 		}
 
 		// api group for photo
@@ -47,12 +50,35 @@ func init() {
 		{
 			// must check auth & refresh auth token before any operation
 			photoGroup.POST("/add", checkAuthMdw, refreshMdw, v1.AddPhoto)
+			photoGroup.POST("/confirm", checkAuthMdw, refreshMdw, v1.ConfirmPhotoUpload)
 			photoGroup.GET("/upload_status", checkAuthMdw, refreshMdw, v1.GetPhotoUploadStatus)
+			photoGroup.GET("/upload_progress", checkAuthMdw, refreshMdw, v1.StreamPhotoUploadProgress)
 			photoGroup.DELETE("/delete", checkAuthMdw, refreshMdw, v1.DeletePhoto)
 			photoGroup.PUT("/update", checkAuthMdw, refreshMdw, v1.UpdatePhoto)
 			photoGroup.GET("/get_by_id", checkAuthMdw, refreshMdw, v1.GetPhotoByID)
 			photoGroup.GET("/get_by_bucket_id", checkAuthMdw, refreshMdw, paginationMdw, v1.GetPhotoByBucketID)
 			photoGroup.GET("/search", checkAuthMdw, refreshMdw, paginationMdw, v1.SearchPhoto)
+			photoGroup.GET("/duplicates", checkAuthMdw, refreshMdw, paginationMdw, v1.GetDuplicatePhotos)
+			photoGroup.GET("/tags/suggest", checkAuthMdw, refreshMdw, v1.SuggestPhotoTags)
+			photoGroup.GET("/:id/content", checkAuthMdw, refreshMdw, v1.GetPhotoContent)
+			photoGroup.GET("/:id/render", checkAuthMdw, refreshMdw, v1.GetPhotoRender)
+
+			// resumable upload following the tus protocol
+			tusGroup := photoGroup.Group("/tus")
+			{
+				tusGroup.OPTIONS("", v1.OptionsResumableUpload)
+				tusGroup.POST("", checkAuthMdw, refreshMdw, v1.CreateResumableUpload)
+				tusGroup.HEAD("/:upload_id", checkAuthMdw, refreshMdw, v1.HeadResumableUpload)
+				tusGroup.PATCH("/:upload_id", checkAuthMdw, refreshMdw, v1.PatchResumableUpload)
+			}
+		}
+
+		// api group for admin, only the admin users are permitted
+		adminGroup := v1Group.Group("/admin")
+		{
+			adminGroup.GET("/jobs/failed", checkAuthMdw, refreshMdw, adminMdw, paginationMdw, v1.GetFailedUploadJobs)
+			adminGroup.POST("/reindex", checkAuthMdw, refreshMdw, adminMdw, v1.StartReindex)
+			adminGroup.GET("/reindex", checkAuthMdw, refreshMdw, adminMdw, v1.GetReindexProgress)
 		}
 	}
 }
@@ -0,0 +1,291 @@
+package search
+
+import (
+	"fmt"
+	"gin-photo-storage/constant"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A photo search query is a list of terms, which are all required unless joined by OR, e.g.
+//   tag:cat tag:beach bucket:12 name:"IMG_*" after:2023-01-01 -tag:private sunset
+// 1. field:value searches a field, a bare word searches the name, tags, description & camera
+// 2. "..." quotes a value with spaces (\" & \\ escape a quote & a backslash), a quoted bare value is a phrase
+// 3. * & ? are wildcards of tag & name values
+// 4. AND (optional), OR, NOT or a "-" prefix, & parentheses for grouping, NOT binds tightest, then AND, then OR
+// The fields:
+//   tag, name, desc (or description), camera
+//   bucket: a bucket id
+//   after & before: the creation date in yyyy-mm-dd, after includes the date, before excludes it
+//   taken_after & taken_before: the date taken in yyyy-mm-dd
+
+// An invalid search query, the position is the byte offset where the query goes wrong.
+type QueryError struct {
+	Position 	int
+	Message 	string
+}
+
+func (err *QueryError) Error() string {
+	return fmt.Sprintf("invalid search query at %d: %s", err.Position, err.Message)
+}
+
+// The kinds of the query tokens.
+const (
+	queryTerm 	= iota
+	queryAnd
+	queryOr
+	queryNot
+	queryOpen
+	queryClose
+	queryEnd
+)
+
+type queryToken struct {
+	kind 		int
+	position 	int
+	field 		string
+	value 		string
+	quoted 		bool
+}
+
+// The kinds of the query nodes.
+const (
+	NodeTerm 	= iota
+	NodeAnd
+	NodeOr
+	NodeNot
+)
+
+// A node of a parsed search query, a term has a field (empty for a bare value) & a value,
+// the others have children, a NOT node has one.
+// A term with AnyWord matches any word of its value, it's never parsed but built for the legacy parameters.
+type Node struct {
+	Kind 		int
+	Children 	[]*Node
+	Field 		string
+	Value 		string
+	Quoted 		bool
+	AnyWord 	bool
+}
+
+// Split a query into tokens.
+func tokenize(query string) ([]queryToken, error) {
+	tokens := make([]queryToken, 0)
+	for i := 0;i < len(query); {
+		switch c := query[i];{
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, queryToken{kind: queryOpen, position: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, queryToken{kind: queryClose, position: i})
+			i++
+		case c == '-' && i + 1 < len(query) && query[i + 1] != ' ':
+			tokens = append(tokens, queryToken{kind: queryNot, position: i})
+			i++
+		default:
+			token, next, err := readQueryTerm(query, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token)
+			i = next
+		}
+	}
+	return append(tokens, queryToken{kind: queryEnd, position: len(query)}), nil
+}
+
+// Read a term starting at the given offset, the term & the offset after it are returned.
+func readQueryTerm(query string, start int) (queryToken, int, error) {
+	token := queryToken{kind: queryTerm, position: start}
+	i := start
+
+	// the field is the leading lowercase word followed by a colon
+	j := i
+	for j < len(query) && (query[j] >= 'a' && query[j] <= 'z' || query[j] == '_') {
+		j++
+	}
+	if j > i && j < len(query) && query[j] == ':' {
+		token.field = query[i:j]
+		i = j + 1
+	}
+
+	value := strings.Builder{}
+	if i < len(query) && query[i] == '"' {
+		token.quoted = true
+		for i++;;i++ {
+			if i >= len(query) {
+				return token, i, &QueryError{Position: start, Message: "unterminated quote"}
+			}
+			if query[i] == '\\' && i + 1 < len(query) {
+				i++
+			} else if query[i] == '"' {
+				i++
+				break
+			}
+			value.WriteByte(query[i])
+		}
+	} else {
+		for ;i < len(query) && !strings.ContainsRune(" \t\n\r()\"", rune(query[i]));i++ {
+			value.WriteByte(query[i])
+		}
+	}
+	token.value = value.String()
+
+	if token.field != "" && token.value == "" {
+		return token, i, &QueryError{Position: start, Message: fmt.Sprintf("%s has no value", token.field)}
+	}
+	if token.field == "" && !token.quoted {
+		switch token.value {
+		case "AND":
+			token.kind = queryAnd
+		case "OR":
+			token.kind = queryOr
+		case "NOT":
+			token.kind = queryNot
+		}
+	}
+	return token, i, nil
+}
+
+// Parse a search query into a tree of nodes, a *QueryError is returned if the query is invalid.
+func Parse(query string) (*Node, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	parser := queryParser{tokens: tokens}
+	if parser.peek().kind == queryEnd {
+		return nil, &QueryError{Position: 0, Message: "empty query"}
+	}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != queryEnd {
+		return nil, &QueryError{Position: token.position, Message: "unexpected )"}
+	}
+	return node, nil
+}
+
+// A recursive descent parser of search queries.
+type queryParser struct {
+	tokens 	[]queryToken
+	next 	int
+	depth 	int
+	terms 	int
+}
+
+func (parser *queryParser) peek() queryToken {
+	return parser.tokens[parser.next]
+}
+
+func (parser *queryParser) pop() queryToken {
+	token := parser.tokens[parser.next]
+	if token.kind != queryEnd {
+		parser.next++
+	}
+	return token
+}
+
+// or := and (OR and)*
+func (parser *queryParser) parseOr() (*Node, error) {
+	node, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []*Node{node}
+	for parser.peek().kind == queryOr {
+		parser.pop()
+		if node, err = parser.parseAnd(); err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &Node{Kind: NodeOr, Children: children}, nil
+}
+
+// and := not (AND? not)*
+func (parser *queryParser) parseAnd() (*Node, error) {
+	children := make([]*Node, 0)
+	for {
+		if parser.peek().kind == queryAnd && len(children) > 0 {
+			parser.pop()
+		}
+		node, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+		if kind := parser.peek().kind;kind == queryOr || kind == queryClose || kind == queryEnd {
+			break
+		}
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &Node{Kind: NodeAnd, Children: children}, nil
+}
+
+// not := (NOT | -) not | ( or ) | term
+func (parser *queryParser) parseNot() (*Node, error) {
+	token := parser.pop()
+	switch token.kind {
+	case queryNot:
+		node, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Node{Kind: NodeNot, Children: []*Node{node}}, nil
+	case queryOpen:
+		if parser.depth++;parser.depth > constant.SEARCH_QUERY_MAX_DEPTH {
+			return nil, &QueryError{Position: token.position, Message: "too deeply nested"}
+		}
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := parser.pop();closing.kind != queryClose {
+			return nil, &QueryError{Position: token.position, Message: "unclosed ("}
+		}
+		parser.depth--
+		return node, nil
+	case queryTerm:
+		if parser.terms++;parser.terms > constant.SEARCH_QUERY_MAX_TERMS {
+			return nil, &QueryError{Position: token.position,
+				Message: fmt.Sprintf("more than %d terms", constant.SEARCH_QUERY_MAX_TERMS)}
+		}
+		return newQueryTermNode(token)
+	case queryEnd:
+		return nil, &QueryError{Position: token.position, Message: "unexpected end"}
+	default:
+		return nil, &QueryError{Position: token.position, Message: "a term is expected"}
+	}
+}
+
+// Check the field & the value of a term.
+func newQueryTermNode(token queryToken) (*Node, error) {
+	node := &Node{Kind: NodeTerm, Field: token.field, Value: token.value, Quoted: token.quoted}
+	switch token.field {
+	case "", "tag", "name", "camera":
+	case "desc", "description":
+		node.Field = "desc"
+	case "bucket":
+		if _, err := strconv.ParseUint(token.value, 10, 32); err != nil {
+			return nil, &QueryError{Position: token.position, Message: "bucket must be an id"}
+		}
+	case "after", "before", "taken_after", "taken_before":
+		if _, err := time.Parse("2006-01-02", token.value); err != nil {
+			return nil, &QueryError{Position: token.position,
+				Message: fmt.Sprintf("%s must be a date in yyyy-mm-dd", token.field)}
+		}
+	default:
+		return nil, &QueryError{Position: token.position, Message: fmt.Sprintf("unknown field %s", token.field)}
+	}
+	return node, nil
+}
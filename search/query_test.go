@@ -0,0 +1,139 @@
+package search
+
+import (
+	"gin-photo-storage/constant"
+	"strings"
+	"testing"
+)
+
+// Render a node as an s-expression, a quoted value is rendered quoted.
+func render(node *Node) string {
+	switch node.Kind {
+	case NodeAnd, NodeOr, NodeNot:
+		op := map[int]string{NodeAnd: "and", NodeOr: "or", NodeNot: "not"}[node.Kind]
+		parts := []string{op}
+		for _, child := range node.Children {
+			parts = append(parts, render(child))
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	}
+	value := node.Value
+	if node.Quoted {
+		value = `"` + value + `"`
+	}
+	if node.Field == "" {
+		return value
+	}
+	return node.Field + ":" + value
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		query 	string
+		want 	string
+	}{
+		{"tag:cat", "tag:cat"},
+		{"sunset", "sunset"},
+		{"tag:cat tag:beach", "(and tag:cat tag:beach)"},
+		{"tag:cat AND tag:beach", "(and tag:cat tag:beach)"},
+		{"a OR b c", "(or a (and b c))"},
+		{"a b OR c", "(or (and a b) c)"},
+		{"a OR b OR c", "(or a b c)"},
+		{"-tag:private sunset", "(and (not tag:private) sunset)"},
+		{"NOT a b", "(and (not a) b)"},
+		{"NOT -a", "(not (not a))"},
+		{"(a OR b) c", "(and (or a b) c)"},
+		{"((a))", "a"},
+		{"-(a OR b)", "(not (or a b))"},
+		{"a\t(b)\nc", "(and a b c)"},
+		{`name:"IMG 1*"`, `name:"IMG 1*"`},
+		{`"sunny beach"`, `"sunny beach"`},
+		{`"a \"b\" \\c"`, `"a "b" \c"`},
+		{`"OR" "AND"`, `(and "OR" "AND")`},
+		{"or and", "(and or and)"},
+		{"description:sky desc:sea", "(and desc:sky desc:sea)"},
+		{"camera:canon", "camera:canon"},
+		{"bucket:12 after:2023-01-01 before:2024-01-01", "(and bucket:12 after:2023-01-01 before:2024-01-01)"},
+		{"taken_after:2020-02-29 taken_before:2021-01-01", "(and taken_after:2020-02-29 taken_before:2021-01-01)"},
+		{"tag:cat-dog", "tag:cat-dog"},
+		{"a - b", "(and a - b)"},
+		{"Tag:x", "Tag:x"},
+		{"tag:a:b", "tag:a:b"},
+	}
+	for _, c := range cases {
+		node, err := Parse(c.query)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", c.query, err)
+			continue
+		}
+		if got := render(node); got != c.want {
+			t.Errorf("Parse(%q) = %s, want %s", c.query, got, c.want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		query 		string
+		position 	int
+		message 	string
+	}{
+		{"", 0, "empty query"},
+		{"   ", 0, "empty query"},
+		{"tag:", 0, "tag has no value"},
+		{`a tag:""`, 2, "tag has no value"},
+		{`a "b`, 2, "unterminated quote"},
+		{`"a\"`, 0, "unterminated quote"},
+		{"(a", 0, "unclosed ("},
+		{"a (b OR (c)", 2, "unclosed ("},
+		{"a)", 1, "unexpected )"},
+		{"a OR", 4, "unexpected end"},
+		{"a NOT", 5, "unexpected end"},
+		{"()", 1, "a term is expected"},
+		{"OR a", 0, "a term is expected"},
+		{"a AND AND b", 6, "a term is expected"},
+		{"a foo:bar", 2, "unknown field foo"},
+		{"bucket:x", 0, "bucket must be an id"},
+		{"bucket:-1", 0, "bucket must be an id"},
+		{"after:2023-13-01", 0, "after must be a date in yyyy-mm-dd"},
+		{"taken_before:yesterday", 0, "taken_before must be a date in yyyy-mm-dd"},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.query)
+		queryErr, ok := err.(*QueryError)
+		if !ok {
+			t.Errorf("Parse(%q) error = %v, want a *QueryError", c.query, err)
+			continue
+		}
+		if queryErr.Position != c.position || queryErr.Message != c.message {
+			t.Errorf("Parse(%q) error = %d %q, want %d %q",
+				c.query, queryErr.Position, queryErr.Message, c.position, c.message)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	depth := constant.SEARCH_QUERY_MAX_DEPTH
+	nested := strings.Repeat("(", depth) + "a" + strings.Repeat(")", depth)
+	if _, err := Parse(nested); err != nil {
+		t.Errorf("%d nested parentheses: %v", depth, err)
+	}
+	_, err := Parse("(" + nested + ")")
+	if queryErr, ok := err.(*QueryError); !ok || queryErr.Position != depth || queryErr.Message != "too deeply nested" {
+		t.Errorf("%d nested parentheses: %v", depth + 1, err)
+	}
+
+	// sibling groups don't add up
+	if _, err := Parse(strings.Repeat(nested + " ", 2)); err != nil {
+		t.Errorf("sibling groups: %v", err)
+	}
+
+	terms := constant.SEARCH_QUERY_MAX_TERMS
+	if _, err := Parse(strings.Repeat("a ", terms)); err != nil {
+		t.Errorf("%d terms: %v", terms, err)
+	}
+	_, err = Parse(strings.Repeat("a ", terms + 1))
+	if queryErr, ok := err.(*QueryError); !ok || queryErr.Position != terms * 2 || !strings.HasPrefix(queryErr.Message, "more than") {
+		t.Errorf("%d terms: %v", terms + 1, err)
+	}
+}
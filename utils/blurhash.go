@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Encode an image in BlurHash (https://blurha.sh), a short string which decodes to a blurred placeholder.
+// The image is expected to be small already, e.g. 32x32, every pixel counts in every component.
+// The numbers of components must be within 1 to 9, more components keep more details.
+func BlurHash(img image.Image, xComponents, yComponents int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// the pixels in linear RGB, so the colors are averaged correctly
+	pixels := make([][3]float64, width * height)
+	for y := 0;y < height;y++ {
+		for x := 0;x < width;x++ {
+			r, g, b, _ := img.At(bounds.Min.X + x, bounds.Min.Y + y).RGBA()
+			pixels[y * width + x] = [3]float64{
+				srgbToLinear(r >> 8), srgbToLinear(g >> 8), srgbToLinear(b >> 8)}
+		}
+	}
+
+	// the DCT components, the first one is the average color
+	factors := make([][3]float64, 0, xComponents * yComponents)
+	for j := 0;j < yComponents;j++ {
+		for i := 0;i < xComponents;i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1.0
+			}
+			factor := [3]float64{}
+			for y := 0;y < height;y++ {
+				for x := 0;x < width;x++ {
+					basis := normalisation *
+						math.Cos(math.Pi * float64(i) * float64(x) / float64(width)) *
+						math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+					for c := 0;c < 3;c++ {
+						factor[c] += basis * pixels[y * width + x][c]
+					}
+				}
+			}
+			for c := 0;c < 3;c++ {
+				factor[c] /= float64(width * height)
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	hash := strings.Builder{}
+	hash.WriteString(encodeBase83((xComponents - 1) + (yComponents - 1) * 9, 1))
+
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, factor := range factors[1:] {
+			for c := 0;c < 3;c++ {
+				actualMax = math.Max(actualMax, math.Abs(factor[c]))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax * 166 - 0.5))))
+		maxValue = float64(quantisedMax + 1) / 166
+		hash.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83(
+		linearToSrgb(dc[0]) << 16 + linearToSrgb(dc[1]) << 8 + linearToSrgb(dc[2]), 4))
+	for _, factor := range factors[1:] {
+		quantised := [3]int{}
+		for c := 0;c < 3;c++ {
+			quantised[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(factor[c] / maxValue, 0.5) * 9 + 9.5))))
+		}
+		hash.WriteString(encodeBase83(quantised[0] * 19 * 19 + quantised[1] * 19 + quantised[2], 2))
+	}
+	return hash.String()
+}
+
+// Get the dominant color of an image in hex, e.g. "#1e90ff".
+// Colors are grouped into buckets of 4 bits per channel, the average color of the largest bucket wins.
+// Mostly transparent pixels are ignored, the image is expected to be small already.
+func DominantColor(img image.Image) string {
+	bounds := img.Bounds()
+	counts := make(map[uint32]int)
+	sums := make(map[uint32][3]uint32)
+	for y := bounds.Min.Y;y < bounds.Max.Y;y++ {
+		for x := bounds.Min.X;x < bounds.Max.X;x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			r, g, b = r >> 8, g >> 8, b >> 8
+			bucket := (r >> 4) << 8 | (g >> 4) << 4 | b >> 4
+			counts[bucket]++
+			sum := sums[bucket]
+			sums[bucket] = [3]uint32{sum[0] + r, sum[1] + g, sum[2] + b}
+		}
+	}
+
+	dominant, dominantCount := uint32(0), 0
+	for bucket, count := range counts {
+		// break ties by the bucket, so the result doesn't depend on the map order
+		if count > dominantCount || (count == dominantCount && bucket < dominant) {
+			dominant, dominantCount = bucket, count
+		}
+	}
+	if dominantCount == 0 {
+		return ""	// fully transparent
+	}
+	sum := sums[dominant]
+	n := uint32(dominantCount)
+	return fmt.Sprintf("#%02x%02x%02x", sum[0] / n, sum[1] / n, sum[2] / n)
+}
+
+func encodeBase83(value int, length int) string {
+	encoded := make([]byte, length)
+	for i := length - 1;i >= 0;i-- {
+		encoded[i] = base83Chars[value % 83]
+		value /= 83
+	}
+	return string(encoded)
+}
+
+func srgbToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v + 0.055) / 1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v * 12.92 * 255 + 0.5)
+	}
+	return int((1.055 * math.Pow(v, 1 / 2.4) - 0.055) * 255 + 0.5)
+}
+
+func signPow(value float64, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
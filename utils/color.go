@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+)
+
+var ColorFormatError = errors.New("color must be in #rrggbb")
+
+// A color in the CIELAB color space, where the euclidean distance is close to the perceived difference.
+type Lab struct {
+	L 	float64
+	A 	float64
+	B 	float64
+}
+
+// Get the CIE76 color difference of two colors, a difference around 2.3 is just noticeable.
+func (lab Lab) Distance(other Lab) float64 {
+	return math.Sqrt((lab.L - other.L) * (lab.L - other.L) +
+		(lab.A - other.A) * (lab.A - other.A) +
+		(lab.B - other.B) * (lab.B - other.B))
+}
+
+// Convert an 8-bit sRGB color to CIELAB, under the D65 white point.
+func RGBToLab(r, g, b uint8) Lab {
+	lr, lg, lb := srgbToLinear(uint32(r)), srgbToLinear(uint32(g)), srgbToLinear(uint32(b))
+	x := (0.4124564 * lr + 0.3575761 * lg + 0.1804375 * lb) / 0.95047
+	y := 0.2126729 * lr + 0.7151522 * lg + 0.0721750 * lb
+	z := (0.0193339 * lr + 0.1191920 * lg + 0.9503041 * lb) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0 / 24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0 / 27 * t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return Lab{L: 116 * fy - 16, A: 500 * (fx - fy), B: 200 * (fy - fz)}
+}
+
+// Parse a color in hex, e.g. "#3366ff".
+func ParseHexColor(hex string) (Lab, error) {
+	if len(hex) != 7 || hex[0] != '#' {
+		return Lab{}, ColorFormatError
+	}
+	value, err := strconv.ParseUint(hex[1:], 16, 32)
+	if err != nil {
+		return Lab{}, ColorFormatError
+	}
+	return RGBToLab(uint8(value >> 16), uint8(value >> 8), uint8(value)), nil
+}
+
+// Colors of a palette closer than this are merged into one.
+const paletteMergeDistance = 10
+
+// Extract the palette of an image, at most the given number of colors in hex, the most common color goes first.
+// The image is cut into more boxes than needed by median cut, then the boxes of similar colors are merged,
+// so a large area of one color doesn't take several places. Colors of less than the min share
+// of the pixels are dropped. Mostly transparent pixels are ignored, the image is expected to be small already.
+func ColorPalette(img image.Image, maxColors int, minShare float64) []string {
+	bounds := img.Bounds()
+	pixels := make([][3]uint8, 0, bounds.Dx() * bounds.Dy())
+	for y := bounds.Min.Y;y < bounds.Max.Y;y++ {
+		for x := bounds.Min.X;x < bounds.Max.X;x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a >= 0x8000 {
+				pixels = append(pixels, [3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)})
+			}
+		}
+	}
+	if len(pixels) == 0 {
+		return []string{}
+	}
+
+	// split the box with the widest channel range at the median, until there are enough boxes
+	boxes := [][][3]uint8{pixels}
+	for len(boxes) < maxColors * 4 {
+		widest, channel, widestRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			for c := 0;c < 3;c++ {
+				min, max := box[0][c], box[0][c]
+				for _, pixel := range box {
+					if pixel[c] < min {
+						min = pixel[c]
+					}
+					if pixel[c] > max {
+						max = pixel[c]
+					}
+				}
+				if int(max - min) > widestRange {
+					widest, channel, widestRange = i, c, int(max - min)
+				}
+			}
+		}
+		if widest < 0 {
+			break	// every box has a single color
+		}
+
+		box := boxes[widest]
+		sort.Slice(box, func(i, j int) bool {
+			return box[i][channel] < box[j][channel]
+		})
+		boxes[widest] = box[:len(box) / 2]
+		boxes = append(boxes, box[len(box) / 2:])
+	}
+
+	// the larger boxes go first, so the smaller ones are merged into them
+	sort.SliceStable(boxes, func(i, j int) bool {
+		return len(boxes[i]) > len(boxes[j])
+	})
+	type paletteColor struct {
+		sum 	[3]int
+		count 	int
+	}
+	average := func(color paletteColor) (uint8, uint8, uint8) {
+		return uint8(color.sum[0] / color.count), uint8(color.sum[1] / color.count), uint8(color.sum[2] / color.count)
+	}
+	colors := make([]paletteColor, 0, len(boxes))
+	for _, box := range boxes {
+		color := paletteColor{count: len(box)}
+		for _, pixel := range box {
+			for c := 0;c < 3;c++ {
+				color.sum[c] += int(pixel[c])
+			}
+		}
+		merged := false
+		for i := range colors {
+			if RGBToLab(average(colors[i])).Distance(RGBToLab(average(color))) < paletteMergeDistance {
+				for c := 0;c < 3;c++ {
+					colors[i].sum[c] += color.sum[c]
+				}
+				colors[i].count += color.count
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			colors = append(colors, color)
+		}
+	}
+
+	sort.SliceStable(colors, func(i, j int) bool {
+		return colors[i].count > colors[j].count
+	})
+	palette := make([]string, 0, maxColors)
+	for _, color := range colors {
+		if len(palette) == maxColors || float64(color.count) < minShare * float64(len(pixels)) {
+			break
+		}
+		r, g, b := average(color)
+		palette = append(palette, fmt.Sprintf("#%02x%02x%02x", r, g, b))
+	}
+	return palette
+}
@@ -6,72 +6,166 @@ import (
 	"gin-photo-storage/conf"
 	"gin-photo-storage/constant"
 	"github.com/tencentyun/cos-go-sdk-v5"
-	"go.uber.org/zap"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
-var (
-	CosClient    *cos.Client
-	CosUrlFormat = "http://%s-%s.cos.%s.myqcloud.com"
-	BucketName   = ""
-	AppID        = ""
-	Region       = ""
-)
+var CosUrlFormat = "http://%s-%s.cos.%s.myqcloud.com"
+
+// Storage backed by the tencent cloud COS.
+type CosStorage struct {
+	Client 		*cos.Client
+	BucketUrl 	string
+	SecretID 	string
+	SecretKey 	string
+}
 
-// init COS client
-func init() {
-	BucketName = conf.ServerCfg.Get(constant.COS_BUCKET_NAME)
-	AppID = conf.ServerCfg.Get(constant.COS_APP_ID)
-	Region = conf.ServerCfg.Get(constant.COS_REGION)
-	u, _ := url.Parse(fmt.Sprintf(CosUrlFormat, BucketName, AppID, Region))
+// Create a COS storage from the config file.
+func NewCosStorage() *CosStorage {
+	bucketName := conf.ServerCfg.Get(constant.COS_BUCKET_NAME)
+	appID := conf.ServerCfg.Get(constant.COS_APP_ID)
+	region := conf.ServerCfg.Get(constant.COS_REGION)
+	bucketUrl := fmt.Sprintf(CosUrlFormat, bucketName, appID, region)
+	secretID := conf.ServerCfg.Get(constant.COS_SECRET_ID)
+	secretKey := conf.ServerCfg.Get(constant.COS_SECRET_KEY)
+	u, _ := url.Parse(bucketUrl)
 	b := &cos.BaseURL{BucketURL: u}
-	CosClient = cos.NewClient(b, &http.Client{
+	client := cos.NewClient(b, &http.Client{
 		Transport: &cos.AuthorizationTransport{
-			SecretID:  conf.ServerCfg.Get(constant.COS_SECRET_ID),
-			SecretKey: conf.ServerCfg.Get(constant.COS_SECRET_KEY),
+			SecretID:  secretID,
+			SecretKey: secretKey,
 		},
 	})
+	return &CosStorage{Client: client, BucketUrl: bucketUrl, SecretID: secretID, SecretKey: secretKey}
 }
 
-// upload a photo to the tencent cloud COS
-func Upload(photoID uint, fileName string, file io.Reader, fileSize int) string {
-	uploadID := fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photoID)
-	go AsyncUpload(uploadID, photoID, fileName, file, fileSize)	// upload in the ASYNC way
-	return uploadID
+// Upload an object to COS.
+func (s *CosStorage) Put(key string, reader io.Reader, size int64) error {
+	putOption := cos.ObjectPutOptions{}
+	putOption.ObjectPutHeaderOptions = &cos.ObjectPutHeaderOptions{ContentLength: int(size)}
+	_, err := s.Client.Object.Put(context.Background(), key, reader, &putOption)
+	return err
 }
 
-// upload a photo to the tencent cloud COS in the ASYNC way
-func AsyncUpload(uploadID string, photoID uint, fileName string, file io.Reader, fileSize int) {
-	// set upload status in redis
-	if !SetUploadStatus(uploadID, 1) {
-		//log.Println("Fail to set upload status before upload.")
-		AppLogger.Info("Fail to set upload status before upload.", zap.String("service", "AsyncUpload()"))
-		return
+// Download an object from COS.
+func (s *CosStorage) Get(key string) (io.ReadCloser, error) {
+	res, err := s.Client.Object.Get(context.Background(), key, nil)
+	if err != nil {
+		return nil, cosError(err)
 	}
+	return res.Body, nil
+}
 
-	// upload the photo using COS SDK
-	putOption := cos.ObjectPutOptions{}
-	putOption.ObjectPutHeaderOptions = &cos.ObjectPutHeaderOptions{ContentLength: fileSize}
-	_, err := CosClient.Object.Put(context.Background(), fileName, file, &putOption)
+// Download a part of an object from COS.
+func (s *CosStorage) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	option := cos.ObjectGetOptions{Range: httpRange(offset, length)}
+	res, err := s.Client.Object.Get(context.Background(), key, &option)
+	if err != nil {
+		return nil, cosError(err)
+	}
+	return res.Body, nil
+}
+
+// Copy an object within the bucket, COS copies it on the server side.
+func (s *CosStorage) Copy(srcKey string, dstKey string) error {
+	source := strings.TrimPrefix(strings.TrimPrefix(s.BucketUrl, "http://"), "https://") + "/" + srcKey
+	_, _, err := s.Client.Object.Copy(context.Background(), dstKey, source, nil)
+	return cosError(err)
+}
+
+// Delete an object from COS.
+func (s *CosStorage) Delete(key string) error {
+	_, err := s.Client.Object.Delete(context.Background(), key)
+	if err = cosError(err); err != ObjectNotExistError {
+		return err
+	}
+	return nil
+}
 
-	// upload fails, send callback asking for photo deletion
+// Get the meta info of an object in COS.
+func (s *CosStorage) Stat(key string) (*ObjectInfo, error) {
+	res, err := s.Client.Object.Head(context.Background(), key, nil)
 	if err != nil {
-		//log.Println(err)
-		AppLogger.Info(err.Error(), zap.String("service", "AsyncUpload()"))
-		if !SendToChannel(constant.PHOTO_DELETE_CHANNEL, fmt.Sprintf("%d", photoID)) {
-			//log.Println("Fail to send delete-photo message to channel")
-			AppLogger.Info("Fail to send delete-photo msg to channel.", zap.String("service", "AsyncUpload()"))
+		return nil, cosError(err)
+	}
+	lastModified, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &ObjectInfo{
+		Key: key,
+		Size: res.ContentLength,
+		ETag: res.Header.Get("ETag"),
+		LastModified: lastModified,
+	}, nil
+}
+
+// List objects in COS page by page.
+func (s *CosStorage) List(prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	option := cos.BucketGetOptions{Prefix: prefix, MaxKeys: 1000}
+	for {
+		result, _, err := s.Client.Bucket.Get(context.Background(), &option)
+		if err != nil {
+			return objects, err
+		}
+		for _, object := range result.Contents {
+			lastModified, _ := time.Parse(time.RFC3339, object.LastModified)
+			objects = append(objects, ObjectInfo{
+				Key: object.Key,
+				Size: int64(object.Size),
+				ETag: object.ETag,
+				LastModified: lastModified,
+			})
 		}
-		return
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			return objects, nil
+		}
+		// NextMarker is only returned along with a delimiter, use the last key instead
+		option.Marker = result.Contents[len(result.Contents) - 1].Key
+	}
+}
+
+// List a page of objects in COS, starting after the given key.
+func (s *CosStorage) ListPage(prefix string, after string, limit int) ([]ObjectInfo, error) {
+	option := cos.BucketGetOptions{Prefix: prefix, Marker: after, MaxKeys: limit}
+	result, _, err := s.Client.Bucket.Get(context.Background(), &option)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]ObjectInfo, 0, len(result.Contents))
+	for _, object := range result.Contents {
+		lastModified, _ := time.Parse(time.RFC3339, object.LastModified)
+		objects = append(objects, ObjectInfo{
+			Key: object.Key,
+			Size: int64(object.Size),
+			ETag: object.ETag,
+			LastModified: lastModified,
+		})
 	}
+	return objects, nil
+}
+
+// Get the public url of an object in COS.
+func (s *CosStorage) Url(key string) string {
+	return s.BucketUrl + "/" + key
+}
+
+// Sign a url for uploading an object to COS directly.
+func (s *CosStorage) PresignPut(key string, expires time.Duration) (string, error) {
+	u, err := s.Client.Object.GetPresignedURL(context.Background(), http.MethodPut, key,
+		s.SecretID, s.SecretKey, expires, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
 
-	// upload success, send callback asking for updating the photo url
-	fileUrl := fmt.Sprintf(CosUrlFormat, BucketName, AppID, Region) + "/" + fileName
-	updateUrlMessage := fmt.Sprintf("%d-%s", photoID, fileUrl)
-	if !SendToChannel(constant.URL_UPDATE_CHANNEL, updateUrlMessage) {
-		//log.Println("Fail to send update-photo-url message to channel")
-		AppLogger.Info("Fail to send update-photo-url msg to channel.", zap.String("service", "AsyncUpload()"))
+// Translate a "not found" COS error to ObjectNotExistError.
+func cosError(err error) error {
+	if errRes, ok := err.(*cos.ErrorResponse); ok && errRes.Response != nil &&
+		errRes.Response.StatusCode == http.StatusNotFound {
+		return ObjectNotExistError
 	}
-}
\ No newline at end of file
+	return err
+}
@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var ExifFormatError = errors.New("malformed exif")
+
+// EXIF tags removed for privacy.
+const (
+	exifTagExifIFD 				= 0x8769
+	exifTagGPSIFD 				= 0x8825
+	exifTagMakerNote 			= 0x927C	// vendor specific, often has the serial number
+	exifTagCameraOwnerName 		= 0xA430
+	exifTagBodySerialNumber 	= 0xA431
+	exifTagLensSerialNumber 	= 0xA435
+	exifTagCameraSerialNumber 	= 0xC62F
+)
+
+var privateExifTags = map[uint16]bool{
+	exifTagGPSIFD: true,
+	exifTagMakerNote: true,
+	exifTagCameraOwnerName: true,
+	exifTagBodySerialNumber: true,
+	exifTagLensSerialNumber: true,
+	exifTagCameraSerialNumber: true,
+}
+
+// Byte sizes of the TIFF field types, indexed by the type.
+var tiffTypeSizes = []int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// Strip the GPS & serial number tags from the EXIF of a JPEG, PNG or WebP file.
+// The file is modified in place, its length & the rest of the metadata are kept.
+// Returns if anything is stripped, files of other types are not touched.
+func StripPrivateExif(data []byte) (bool, error) {
+	if bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return stripJpegExif(data)
+	}
+	if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return stripPngExif(data)
+	}
+	if len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WEBP" {
+		return stripWebpExif(data)
+	}
+	return false, nil
+}
+
+// Find the APP1 Exif segments of a JPEG & strip them.
+func stripJpegExif(data []byte) (bool, error) {
+	stripped := false
+	for pos := 2;pos + 4 <= len(data); {
+		if data[pos] != 0xFF {
+			return stripped, ExifFormatError
+		}
+		marker := data[pos + 1]
+		if marker == 0xFF {
+			pos++	// padding
+			continue
+		}
+		if marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			pos += 2	// markers without a length
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			break	// the image data starts, no more metadata
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos + 2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return stripped, ExifFormatError
+		}
+		segment := data[pos + 4:end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			changed, err := stripTiff(segment[6:])
+			if err != nil {
+				return stripped, err
+			}
+			stripped = stripped || changed
+		}
+		pos = end
+	}
+	return stripped, nil
+}
+
+// Find the eXIf chunk of a PNG & strip it, the CRC of the chunk is updated.
+func stripPngExif(data []byte) (bool, error) {
+	for pos := 8;pos + 12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos + 4:pos + 8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return false, ExifFormatError
+		}
+		if chunkType == "eXIf" {
+			changed, err := stripTiff(data[pos + 8:pos + 8 + length])
+			if err != nil || !changed {
+				return false, err
+			}
+			binary.BigEndian.PutUint32(data[end - 4:], crc32.ChecksumIEEE(data[pos + 4:end - 4]))
+			return true, nil
+		}
+		if chunkType == "IDAT" || chunkType == "IEND" {
+			break	// eXIf must come before the image data
+		}
+		pos = end
+	}
+	return false, nil
+}
+
+// Find the EXIF chunk of a WebP & strip it, RIFF chunks have no checksum.
+func stripWebpExif(data []byte) (bool, error) {
+	for pos := 12;pos + 8 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[pos + 4:]))
+		end := pos + 8 + length
+		if length < 0 || end > len(data) {
+			return false, ExifFormatError
+		}
+		if string(data[pos:pos + 4]) == "EXIF" {
+			// some writers keep the "Exif" header of JPEG
+			return stripTiff(bytes.TrimPrefix(data[pos + 8:end], []byte("Exif\x00\x00")))
+		}
+		pos = end + length % 2	// chunks are padded to even sizes
+	}
+	return false, nil
+}
+
+// A TIFF structure being stripped in place.
+type tiffStripper struct {
+	data 	[]byte
+	order 	binary.ByteOrder
+}
+
+// Strip the private tags of the TIFF structure in EXIF.
+func stripTiff(data []byte) (bool, error) {
+	if len(data) < 8 {
+		return false, ExifFormatError
+	}
+	stripper := tiffStripper{data: data}
+	switch string(data[:2]) {
+	case "II":
+		stripper.order = binary.LittleEndian
+	case "MM":
+		stripper.order = binary.BigEndian
+	default:
+		return false, ExifFormatError
+	}
+	return stripper.stripIFD(int(stripper.order.Uint32(data[4:])), 0)
+}
+
+// Remove the private entries of an IFD, the sub IFDs & the next IFDs are stripped as well.
+// The remaining entries are moved together, the removed ones & their values are zeroed.
+func (t *tiffStripper) stripIFD(offset int, depth int) (bool, error) {
+	if offset == 0 {
+		return false, nil
+	}
+	if depth > 4 || offset < 8 || offset + 2 > len(t.data) {
+		return false, ExifFormatError
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	entriesEnd := offset + 2 + count * 12
+	if entriesEnd + 4 > len(t.data) {
+		return false, ExifFormatError
+	}
+	nextOffset := int(t.order.Uint32(t.data[entriesEnd:]))
+
+	stripped := false
+	kept := make([][]byte, 0, count)
+	for i := 0;i < count;i++ {
+		entry := t.data[offset + 2 + i * 12:offset + 14 + i * 12]
+		tag := t.order.Uint16(entry)
+		if tag == exifTagExifIFD {
+			changed, err := t.stripIFD(int(t.order.Uint32(entry[8:])), depth + 1)
+			if err != nil {
+				return stripped, err
+			}
+			stripped = stripped || changed
+		}
+		if !privateExifTags[tag] {
+			kept = append(kept, append([]byte(nil), entry...))
+			continue
+		}
+
+		if tag == exifTagGPSIFD {
+			t.zeroIFD(int(t.order.Uint32(entry[8:])))
+		} else {
+			t.zeroValue(entry)
+		}
+		stripped = true
+	}
+
+	changed, err := t.stripIFD(nextOffset, depth + 1)
+	if err != nil {
+		return stripped, err
+	}
+	stripped = stripped || changed
+	if len(kept) == count {
+		return stripped, nil
+	}
+
+	// rewrite the IFD with the kept entries, the next IFD offset follows them
+	t.order.PutUint16(t.data[offset:], uint16(len(kept)))
+	for i, entry := range kept {
+		copy(t.data[offset + 2 + i * 12:], entry)
+	}
+	newEnd := offset + 2 + len(kept) * 12
+	t.order.PutUint32(t.data[newEnd:], uint32(nextOffset))
+	zero(t.data[newEnd + 4:entriesEnd + 4])
+	return true, nil
+}
+
+// Zero an IFD which is no longer referenced, with the values of its entries.
+func (t *tiffStripper) zeroIFD(offset int) {
+	if offset < 8 || offset + 2 > len(t.data) {
+		return
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	end := offset + 2 + count * 12 + 4
+	if end > len(t.data) {
+		return
+	}
+	for i := 0;i < count;i++ {
+		t.zeroValue(t.data[offset + 2 + i * 12:offset + 14 + i * 12])
+	}
+	zero(t.data[offset:end])
+}
+
+// Zero the value of an IFD entry which is stored out of the entry.
+func (t *tiffStripper) zeroValue(entry []byte) {
+	fieldType := int(t.order.Uint16(entry[2:]))
+	if fieldType >= len(tiffTypeSizes) {
+		return
+	}
+	size := int64(tiffTypeSizes[fieldType]) * int64(t.order.Uint32(entry[4:]))
+	if size <= 4 {
+		return	// the value is in the entry
+	}
+	valueOffset := int64(t.order.Uint32(entry[8:]))
+	if valueOffset + size <= int64(len(t.data)) {
+		zero(t.data[valueOffset:valueOffset + size])
+	}
+}
+
+func zero(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
@@ -0,0 +1,282 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// The layout of the test TIFF: the header, IFD0, the Exif IFD, the GPS IFD, then the values out of the entries.
+const (
+	testIFD0 		= 8
+	testExifIFD 	= testIFD0 + 2 + 3 * 12 + 4
+	testGPSIFD 		= testExifIFD + 2 + 2 * 12 + 4
+	testValues 		= testGPSIFD + 2 + 1 * 12 + 4
+	testMake 		= testValues
+	testSerial 		= testMake + 6
+	testLatitude 	= testSerial + 11
+	testTiffSize 	= testLatitude + 24
+)
+
+var testLatitudeValue = bytes.Repeat([]byte{0x77}, 24)
+
+// Build a TIFF with a camera make, an ISO speed, a body serial number & a GPS latitude.
+func buildTestTiff(order binary.ByteOrder) []byte {
+	data := make([]byte, testTiffSize)
+	if order == binary.LittleEndian {
+		copy(data, "II")
+	} else {
+		copy(data, "MM")
+	}
+	order.PutUint16(data[2:], 42)
+	order.PutUint32(data[4:], testIFD0)
+
+	putEntry := func(pos int, tag uint16, fieldType uint16, count uint32, value uint32) {
+		order.PutUint16(data[pos:], tag)
+		order.PutUint16(data[pos + 2:], fieldType)
+		order.PutUint32(data[pos + 4:], count)
+		if fieldType == 3 && count == 1 {
+			order.PutUint16(data[pos + 8:], uint16(value))	// a short in the entry is left-justified
+		} else {
+			order.PutUint32(data[pos + 8:], value)
+		}
+	}
+
+	order.PutUint16(data[testIFD0:], 3)
+	putEntry(testIFD0 + 2, 0x010F, 2, 6, testMake)						// Make
+	putEntry(testIFD0 + 14, exifTagExifIFD, 4, 1, testExifIFD)
+	putEntry(testIFD0 + 26, exifTagGPSIFD, 4, 1, testGPSIFD)
+
+	order.PutUint16(data[testExifIFD:], 2)
+	putEntry(testExifIFD + 2, 0x8827, 3, 1, 100)						// ISOSpeedRatings
+	putEntry(testExifIFD + 14, exifTagBodySerialNumber, 2, 11, testSerial)
+
+	order.PutUint16(data[testGPSIFD:], 1)
+	putEntry(testGPSIFD + 2, 0x0002, 5, 3, testLatitude)				// GPSLatitude
+
+	copy(data[testMake:], "Canon\x00")
+	copy(data[testSerial:], "SERIAL-123\x00")
+	copy(data[testLatitude:], testLatitudeValue)
+	return data
+}
+
+// Get the tags of an IFD of a TIFF.
+func testIFDTags(data []byte, order binary.ByteOrder, offset int) []uint16 {
+	count := int(order.Uint16(data[offset:]))
+	tags := make([]uint16, 0, count)
+	for i := 0;i < count;i++ {
+		tags = append(tags, order.Uint16(data[offset + 2 + i * 12:]))
+	}
+	return tags
+}
+
+// Wrap a TIFF in a JPEG, returns the file & the offset of the TIFF in it.
+func testJpeg(tiff []byte) ([]byte, int) {
+	data := []byte{0xFF, 0xD8}
+	data = append(data, 0xFF, 0xE0, 0x00, 0x07, 'J', 'F', 'I', 'F', 0x00)	// APP0
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(2 + 6 + len(tiff)))
+	data = append(append(append(data, 0xFF, 0xE1), length...), "Exif\x00\x00"...)
+	offset := len(data)
+	data = append(data, tiff...)
+	data = append(data, 0xFF, 0xDA, 0x00, 0x02, 0x12, 0x34, 0xFF, 0xD9)	// SOS, image data, EOI
+	return data, offset
+}
+
+// Append a PNG chunk with its CRC.
+func appendPngChunk(data []byte, chunkType string, chunkData []byte) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(chunkData)))
+	data = append(append(append(data, header...), chunkType...), chunkData...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(append([]byte(chunkType), chunkData...)))
+	return append(data, crc...)
+}
+
+// Wrap a TIFF in a PNG, returns the file & the offset of the TIFF in it.
+func testPng(tiff []byte) ([]byte, int) {
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = appendPngChunk(data, "IHDR", make([]byte, 13))
+	offset := len(data) + 8
+	data = appendPngChunk(data, "eXIf", tiff)
+	data = appendPngChunk(data, "IDAT", []byte{0x12, 0x34})
+	return appendPngChunk(data, "IEND", nil), offset
+}
+
+// Wrap a TIFF in a WebP, returns the file & the offset of the TIFF in it.
+func testWebp(tiff []byte, header string) ([]byte, int) {
+	chunk := func(chunkType string, chunkData []byte) []byte {
+		size := make([]byte, 4)
+		binary.LittleEndian.PutUint32(size, uint32(len(chunkData)))
+		data := append(append([]byte(chunkType), size...), chunkData...)
+		if len(chunkData) % 2 == 1 {
+			data = append(data, 0)
+		}
+		return data
+	}
+	body := append([]byte("WEBP"), chunk("VP8X", make([]byte, 10))...)
+	offset := 12 + len(body) - 4 + 8 + len(header)
+	body = append(body, chunk("EXIF", append([]byte(header), tiff...))...)
+	body = append(body, chunk("VP8 ", []byte{0x12, 0x34, 0x56})...)
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(body)))
+	return append(append([]byte("RIFF"), size...), body...), offset
+}
+
+func TestStripPrivateExif(t *testing.T) {
+	cases := []struct {
+		name 	string
+		order 	binary.ByteOrder
+		wrap 	func([]byte) ([]byte, int)
+	}{
+		{"jpeg little endian", binary.LittleEndian, testJpeg},
+		{"jpeg big endian", binary.BigEndian, testJpeg},
+		{"png little endian", binary.LittleEndian, testPng},
+		{"png big endian", binary.BigEndian, testPng},
+		{"webp", binary.LittleEndian, func(tiff []byte) ([]byte, int) { return testWebp(tiff, "") }},
+		{"webp with exif header", binary.BigEndian, func(tiff []byte) ([]byte, int) { return testWebp(tiff, "Exif\x00\x00") }},
+	}
+	for _, c := range cases {
+		data, offset := c.wrap(buildTestTiff(c.order))
+		size := len(data)
+
+		stripped, err := StripPrivateExif(data)
+		if err != nil || !stripped {
+			t.Errorf("%s: StripPrivateExif() = %v, %v, want true, nil", c.name, stripped, err)
+			continue
+		}
+		if len(data) != size {
+			t.Errorf("%s: length changed from %d to %d", c.name, size, len(data))
+		}
+
+		tiff := data[offset:offset + testTiffSize]
+		if tags := testIFDTags(tiff, c.order, testIFD0); len(tags) != 2 || tags[0] != 0x010F || tags[1] != exifTagExifIFD {
+			t.Errorf("%s: IFD0 tags = %x, want the make & the Exif IFD", c.name, tags)
+		}
+		if tags := testIFDTags(tiff, c.order, testExifIFD); len(tags) != 1 || tags[0] != 0x8827 {
+			t.Errorf("%s: Exif IFD tags = %x, want the ISO speed", c.name, tags)
+		}
+		if !bytes.Contains(data, []byte("Canon")) {
+			t.Errorf("%s: the make is removed", c.name)
+		}
+		if bytes.Contains(data, []byte("SERIAL-123")) {
+			t.Errorf("%s: the serial number is kept", c.name)
+		}
+		if bytes.Contains(data, testLatitudeValue) {
+			t.Errorf("%s: the latitude is kept", c.name)
+		}
+	}
+}
+
+func TestStripPrivateExifPngCrc(t *testing.T) {
+	data, offset := testPng(buildTestTiff(binary.BigEndian))
+	if _, err := StripPrivateExif(data); err != nil {
+		t.Fatalf("StripPrivateExif() failed: %v", err)
+	}
+	chunkStart := offset - 8
+	chunkEnd := offset + testTiffSize
+	want := crc32.ChecksumIEEE(data[chunkStart + 4:chunkEnd])
+	if got := binary.BigEndian.Uint32(data[chunkEnd:]); got != want {
+		t.Errorf("eXIf CRC = %08x, want %08x", got, want)
+	}
+}
+
+func TestStripPrivateExifUntouched(t *testing.T) {
+	plainJpeg := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x07, 'J', 'F', 'I', 'F', 0x00, 0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9}
+	plainPng := appendPngChunk(appendPngChunk([]byte("\x89PNG\r\n\x1a\n"), "IHDR", make([]byte, 13)), "IEND", nil)
+	cleanTiff := buildTestTiff(binary.LittleEndian)
+	binary.LittleEndian.PutUint16(cleanTiff[testIFD0:], 1)	// only the make, with no next IFD
+	binary.LittleEndian.PutUint32(cleanTiff[testIFD0 + 14:], 0)
+	cleanJpeg, _ := testJpeg(cleanTiff)
+
+	cases := []struct {
+		name 	string
+		data 	[]byte
+	}{
+		{"jpeg without exif", plainJpeg},
+		{"png without exif", plainPng},
+		{"jpeg without private tags", cleanJpeg},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")},
+		{"empty", []byte{}},
+	}
+	for _, c := range cases {
+		original := append([]byte(nil), c.data...)
+		stripped, err := StripPrivateExif(c.data)
+		if err != nil || stripped {
+			t.Errorf("%s: StripPrivateExif() = %v, %v, want false, nil", c.name, stripped, err)
+		}
+		if !bytes.Equal(c.data, original) {
+			t.Errorf("%s: the file is modified", c.name)
+		}
+	}
+}
+
+func TestStripPrivateExifMalformed(t *testing.T) {
+	cases := []struct {
+		name 	string
+		mutate 	func(tiff []byte)
+	}{
+		{"bad byte order", func(tiff []byte) {
+			copy(tiff, "XX")
+		}},
+		{"IFD0 out of range", func(tiff []byte) {
+			binary.LittleEndian.PutUint32(tiff[4:], 0xFFFF)
+		}},
+		{"IFD0 in the header", func(tiff []byte) {
+			binary.LittleEndian.PutUint32(tiff[4:], 4)
+		}},
+		{"too many entries", func(tiff []byte) {
+			binary.LittleEndian.PutUint16(tiff[testIFD0:], 0xFFFF)
+		}},
+		{"Exif IFD out of range", func(tiff []byte) {
+			binary.LittleEndian.PutUint32(tiff[testIFD0 + 14 + 8:], uint32(len(tiff)))
+		}},
+		{"IFD chain loop", func(tiff []byte) {
+			binary.LittleEndian.PutUint32(tiff[testIFD0 + 2 + 3 * 12:], testIFD0)	// the next IFD is itself
+		}},
+		{"Exif IFD loop", func(tiff []byte) {
+			binary.LittleEndian.PutUint32(tiff[testIFD0 + 14 + 8:], testIFD0)	// the Exif IFD is IFD0
+		}},
+		{"truncated", func(tiff []byte) {
+			binary.LittleEndian.PutUint32(tiff[4:], testTiffSize - 4)
+		}},
+	}
+	for _, c := range cases {
+		tiff := buildTestTiff(binary.LittleEndian)
+		c.mutate(tiff)
+		data, _ := testJpeg(tiff)
+		if _, err := StripPrivateExif(data); err != ExifFormatError {
+			t.Errorf("%s: StripPrivateExif() = %v, want ExifFormatError", c.name, err)
+		}
+	}
+
+	containers := []struct {
+		name 	string
+		data 	func() []byte
+	}{
+		{"jpeg segment too long", func() []byte {
+			data, offset := testJpeg(buildTestTiff(binary.LittleEndian))
+			binary.BigEndian.PutUint16(data[offset - 8:], 0xFFFF)
+			return data
+		}},
+		{"jpeg marker missing", func() []byte {
+			return []byte{0xFF, 0xD8, 0x00, 0xE1, 0x00, 0x02}
+		}},
+		{"png chunk too long", func() []byte {
+			data, offset := testPng(buildTestTiff(binary.LittleEndian))
+			binary.BigEndian.PutUint32(data[offset - 8:], 0xFFFFFF)
+			return data
+		}},
+		{"webp chunk too long", func() []byte {
+			data, offset := testWebp(buildTestTiff(binary.LittleEndian), "")
+			binary.LittleEndian.PutUint32(data[offset - 4:], 0xFFFFFF)
+			return data
+		}},
+	}
+	for _, c := range containers {
+		if _, err := StripPrivateExif(c.data()); err != ExifFormatError {
+			t.Errorf("%s: StripPrivateExif() = %v, want ExifFormatError", c.name, err)
+		}
+	}
+}
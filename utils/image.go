@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"errors"
+	_ "golang.org/x/image/bmp"	// register bmp decoder
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"	// register webp decoder
+	"image"
+	_ "image/gif"	// register gif decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/bits"
+	"net/http"
+)
+
+var ImageTooLargeError = errors.New("image is too large to decode")
+
+// Image formats of the derivatives, pure Go encoders only.
+const (
+	ImageFormatJPEG = "jpeg"
+	ImageFormatPNG 	= "png"
+)
+
+// Decode an image, the dimensions are checked first to avoid decompression bombs.
+// The reader must be seekable so that it can be read twice.
+func DecodeImage(reader io.ReadSeeker, maxPixels int) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width * config.Height > maxPixels {
+		return nil, format, ImageTooLargeError
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, format, err
+	}
+	img, format, err := image.Decode(reader)
+	return img, format, err
+}
+
+// Detect the MIME type of a file by its magic bytes, then rewind it.
+func SniffContentType(reader io.ReadSeeker) (string, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(reader, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(header[:n]), nil
+}
+
+// Scale an image down to fit in the given width & height, keeping its aspect ratio.
+// An image smaller than the box is not scaled up.
+func FitImage(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if srcWidth <= width && srcHeight <= height {
+		return img
+	}
+
+	dstWidth, dstHeight := width, srcHeight * width / srcWidth
+	if dstHeight > height {
+		dstWidth, dstHeight = srcWidth * height / srcHeight, height
+	}
+	if dstWidth < 1 {
+		dstWidth = 1
+	}
+	if dstHeight < 1 {
+		dstHeight = 1
+	}
+	return ResizeImage(img, dstWidth, dstHeight)
+}
+
+// Scale an image to cover the given width & height, keeping its aspect ratio,
+// then crop the overflowing part around the center.
+func CoverImage(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	// the source rect with the same aspect ratio as the target
+	cropWidth, cropHeight := srcWidth, srcWidth * height / width
+	if cropHeight > srcHeight {
+		cropWidth, cropHeight = srcHeight * width / height, srcHeight
+	}
+	x := bounds.Min.X + (srcWidth - cropWidth) / 2
+	y := bounds.Min.Y + (srcHeight - cropHeight) / 2
+	crop := image.Rect(x, y, x + cropWidth, y + cropHeight)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Src, nil)
+	return dst
+}
+
+// Resize an image to exactly the given width & height.
+func ResizeImage(img image.Image, width, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// Get the derivative format of an image of the given source format,
+// png & gif keep their transparency in png, others become jpeg.
+func DerivativeFormat(srcFormat string) string {
+	if srcFormat == "png" || srcFormat == "gif" {
+		return ImageFormatPNG
+	}
+	return ImageFormatJPEG
+}
+
+// Encode an image in the given format.
+func EncodeImage(writer io.Writer, img image.Image, format string, quality int) error {
+	if format == ImageFormatPNG {
+		return png.Encode(writer, img)
+	}
+	return jpeg.Encode(writer, img, &jpeg.Options{Quality: quality})
+}
+
+// Calculate the difference hash (dHash) of an image, a 64-bit perceptual hash.
+// The image is shrunk to 9x8 in gray, each bit tells if a pixel is brighter than its right neighbour,
+// so similar images get hashes with a small hamming distance.
+func DifferenceHash(img image.Image) uint64 {
+	gray := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.BiLinear.Scale(gray, gray.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	hash := uint64(0)
+	for y := 0;y < 8;y++ {
+		for x := 0;x < 8;x++ {
+			hash <<= 1
+			if gray.GrayAt(x, y).Y > gray.GrayAt(x + 1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// Get the hamming distance of two perceptual hashes.
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
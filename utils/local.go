@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Storage backed by the local file system, useful for development & testing.
+type LocalStorage struct {
+	Root 	string
+	BaseUrl string
+}
+
+// Create a local storage saving objects under the root directory.
+func NewLocalStorage(root string, baseUrl string) *LocalStorage {
+	return &LocalStorage{Root: root, BaseUrl: strings.TrimRight(baseUrl, "/")}
+}
+
+// Save an object as a file, written to a temp file first so that
+// readers never see a half-written object.
+func (s *LocalStorage) Put(key string, reader io.Reader, size int64) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	written, err := io.Copy(tmpFile, reader)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("object size mismatch, expect %d, got %d", size, written)
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// Open the file of an object.
+func (s *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ObjectNotExistError
+	}
+	return file, err
+}
+
+// Open the file of an object and seek to the offset.
+func (s *LocalStorage) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ObjectNotExistError
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+// Copy the file of an object, the copy is written like any other object.
+func (s *LocalStorage) Copy(srcKey string, dstKey string) error {
+	file, err := os.Open(s.path(srcKey))
+	if os.IsNotExist(err) {
+		return ObjectNotExistError
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.Put(dstKey, file, -1)
+}
+
+// Remove the file of an object.
+func (s *LocalStorage) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Get the meta info of an object from its file.
+func (s *LocalStorage) Stat(key string) (*ObjectInfo, error) {
+	fileInfo, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ObjectNotExistError
+	}
+	if err != nil {
+		return nil, err
+	}
+	return localObjectInfo(key, fileInfo), nil
+}
+
+// Walk through the root directory to list objects.
+func (s *LocalStorage) List(prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	err := filepath.Walk(s.Root, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, *localObjectInfo(key, fileInfo))
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// List a page of objects, the whole directory is walked as the files are not visited in the order of keys.
+func (s *LocalStorage) ListPage(prefix string, after string, limit int) ([]ObjectInfo, error) {
+	objects, err := s.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	start := sort.Search(len(objects), func(i int) bool {
+		return objects[i].Key > after
+	})
+	objects = objects[start:]
+	if len(objects) > limit {
+		objects = objects[:limit]
+	}
+	return objects, nil
+}
+
+// Get the url of an object, the files are supposed to be served under the base url.
+func (s *LocalStorage) Url(key string) string {
+	return s.BaseUrl + "/" + key
+}
+
+// Map a key to a file path, keys can never escape from the root directory.
+func (s *LocalStorage) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(filepath.Clean("/" + key)))
+}
+
+func localObjectInfo(key string, fileInfo os.FileInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key: key,
+		Size: fileInfo.Size(),
+		ETag: fmt.Sprintf("\"%x-%x\"", fileInfo.ModTime().UnixNano(), fileInfo.Size()),
+		LastModified: fileInfo.ModTime(),
+	}
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var InvalidSeekError = errors.New("invalid seek offset")
+
+// A seekable reader of an object in the storage.
+// Nothing is downloaded until reading, and seeking only moves the offset,
+// so serving a small range of a large object is cheap.
+type ObjectReader struct {
+	key 	string
+	size 	int64
+	offset 	int64
+	reader 	io.ReadCloser
+}
+
+// Create a reader of the object with the given key & size.
+func NewObjectReader(key string, size int64) *ObjectReader {
+	return &ObjectReader{key: key, size: size}
+}
+
+// Read from the current offset, a ranged download is started if needed.
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.reader == nil {
+		reader, err := Store.GetRange(r.key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.reader = reader
+	}
+	n, err := r.reader.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// Move the offset, the ongoing download is dropped if the offset changes.
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return r.offset, InvalidSeekError
+	}
+	if offset != r.offset && r.reader != nil {
+		r.reader.Close()
+		r.reader = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close the ongoing download.
+func (r *ObjectReader) Close() error {
+	if r.reader != nil {
+		err := r.reader.Close()
+		r.reader = nil
+		return err
+	}
+	return nil
+}
+
+// Build the value of a HTTP Range header.
+func httpRange(offset int64, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset + length - 1)
+}
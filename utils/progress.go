@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"gin-photo-storage/constant"
+	"go.uber.org/zap"
+	"io"
+	"time"
+)
+
+// The stage of an upload, from the file received by the server to its thumbnails generated.
+type UploadStage string
+
+const (
+	UploadReceived 		UploadStage = "received"
+	UploadStored 		UploadStage = "stored"
+	UploadIndexed 		UploadStage = "indexed"
+	UploadThumbnailed 	UploadStage = "thumbnailed"
+	UploadFailed 		UploadStage = "failed"
+)
+
+// Check if no more progress follows the stage.
+func (stage UploadStage) Final() bool {
+	return stage == UploadThumbnailed || stage == UploadFailed
+}
+
+// The progress of an upload.
+// The latest progress is kept in redis & every change is published, so any instance can stream it.
+type UploadProgress struct {
+	UploadID 	string		`json:"upload_id"`
+	Stage 		UploadStage	`json:"stage"`
+	Transferred int64		`json:"transferred,omitempty"`	// the bytes sent to the storage
+	Total 		int64		`json:"total,omitempty"`
+	Attempts 	int			`json:"attempts,omitempty"`
+	Url 		string		`json:"url,omitempty"`
+	Error 		string		`json:"error,omitempty"`	// why the upload failed, or why the last attempt failed
+}
+
+// Save the latest progress of an upload & publish it.
+func PublishUploadProgress(progress *UploadProgress) {
+	encoded, err := json.Marshal(progress)
+	if err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "PublishUploadProgress()"))
+		return
+	}
+	pipe := RedisClient.TxPipeline()
+	pipe.Set(fmt.Sprintf(constant.UPLOAD_STAGE_KEY_FORMAT, progress.UploadID), encoded,
+		constant.UPLOAD_STAGE_EXPIRE_HOUR * time.Hour)
+	pipe.Publish(fmt.Sprintf(constant.UPLOAD_PROGRESS_CHANNEL_FORMAT, progress.UploadID), encoded)
+	if _, err := pipe.Exec(); err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "PublishUploadProgress()"))
+	}
+}
+
+// Publish the stage of an upload.
+func PublishUploadStage(uploadID string, stage UploadStage, url string, reason string) {
+	PublishUploadProgress(&UploadProgress{UploadID: uploadID, Stage: stage, Url: url, Error: reason})
+}
+
+// Watch the progress of an upload, the latest progress (nil if it's not tracked) is returned
+// with a channel of the following ones. The returned function stops watching & closes the channel.
+func WatchUploadProgress(uploadID string) (*UploadProgress, <-chan *UploadProgress, func(), error) {
+	// subscribe before getting the latest progress, so no progress in between is missed
+	pubsub := RedisClient.Subscribe(fmt.Sprintf(constant.UPLOAD_PROGRESS_CHANNEL_FORMAT, uploadID))
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		AppLogger.Info(err.Error(), zap.String("service", "WatchUploadProgress()"))
+		return nil, nil, nil, err
+	}
+
+	var latest *UploadProgress
+	if encoded := RedisClient.Get(fmt.Sprintf(constant.UPLOAD_STAGE_KEY_FORMAT, uploadID)).Val(); encoded != "" {
+		latest = &UploadProgress{}
+		if err := json.Unmarshal([]byte(encoded), latest); err != nil {
+			latest = nil
+		}
+	}
+
+	progresses := make(chan *UploadProgress)
+	done := make(chan struct{})
+	go func() {
+		defer close(progresses)
+		for message := range pubsub.Channel() {
+			progress := UploadProgress{}
+			if err := json.Unmarshal([]byte(message.Payload), &progress); err != nil {
+				continue
+			}
+			select {
+			case progresses <- &progress:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	stop := func() {
+		close(done)
+		pubsub.Close()
+	}
+	return latest, progresses, stop, nil
+}
+
+// A reader which publishes the bytes read from it, at most once in an interval.
+type progressReader struct {
+	reader 		io.Reader
+	progress 	UploadProgress
+	published 	time.Time
+}
+
+func newProgressReader(reader io.Reader, progress UploadProgress) *progressReader {
+	return &progressReader{reader: reader, progress: progress, published: time.Now()}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.progress.Transferred += int64(n)
+	if time.Since(r.published) >= constant.UPLOAD_PROGRESS_INTERVAL_MS * time.Millisecond {
+		r.published = time.Now()
+		PublishUploadProgress(&r.progress)
+	}
+	return n, err
+}
@@ -1,9 +1,12 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"gin-photo-storage/conf"
 	"gin-photo-storage/constant"
+	"gin-photo-storage/events"
 	"github.com/go-redis/redis"
 	"go.uber.org/zap"
 	"strconv"
@@ -11,9 +14,11 @@ import (
 )
 
 var RedisClient *redis.Client
-var InitComplete = make(chan struct{}, 1)
 
-// Init redis client
+// the bus of the photo lifecycle events
+var Events *events.Bus
+
+// Init redis client & the event bus on it
 func init() {
 	host := conf.ServerCfg.Get(constant.REDIS_HOST)
 	port := conf.ServerCfg.Get(constant.REDIS_PORT)
@@ -22,7 +27,16 @@ func init() {
 		Password: "",
 		DB: 0,
 	})
-	InitComplete <- struct{}{}
+
+	transportType := conf.ServerCfg.Get(constant.EVENT_TRANSPORT)
+	switch transportType {
+	case constant.EVENT_TRANSPORT_REDIS:
+		Events = events.NewBus(events.NewRedisTransport(RedisClient, constant.EVENT_CHANNEL_PREFIX), AppLogger)
+	case constant.EVENT_TRANSPORT_MEMORY:
+		Events = events.NewBus(events.NewMemoryTransport(), AppLogger)
+	default:
+		AppLogger.Fatal("Unknown event transport: " + transportType, zap.String("service", "init()"))
+	}
 }
 
 // Add an auth to redis, meaning that he/she has logged in.
@@ -82,13 +96,220 @@ func GetUploadStatus(key string) int {
 	return status
 }
 
-// Send a message to the given channel.
-func SendToChannel(channel string, message string) bool {
-	err := RedisClient.Publish(channel, message).Err()
+// Save the info of a direct upload which is waiting for confirmation.
+func SetDirectUploadInfo(uploadID string, info string, expiration time.Duration) bool {
+	key := fmt.Sprintf(constant.DIRECT_UPLOAD_KEY_FORMAT, uploadID)
+	err := RedisClient.Set(key, info, expiration).Err()
 	if err != nil {
-		//log.Println(err)
-		AppLogger.Info(err.Error(), zap.String("service", "SendToChannel()"))
+		AppLogger.Info(err.Error(), zap.String("service", "SetDirectUploadInfo()"))
+		return false
+	}
+	return true
+}
+
+// Get the info of a direct upload, empty if no such upload.
+func GetDirectUploadInfo(uploadID string) string {
+	key := fmt.Sprintf(constant.DIRECT_UPLOAD_KEY_FORMAT, uploadID)
+	return RedisClient.Get(key).Val()
+}
+
+// Remove the info of a confirmed direct upload.
+func RemoveDirectUploadInfo(uploadID string) bool {
+	key := fmt.Sprintf(constant.DIRECT_UPLOAD_KEY_FORMAT, uploadID)
+	err := RedisClient.Del(key).Err()
+	if err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "RemoveDirectUploadInfo()"))
+		return false
+	}
+	return true
+}
+
+// Set the bytes transferred & the total bytes of an upload, it expires like a resumable upload.
+func SetUploadProgress(uploadID string, transferred int64, total int64) bool {
+	key := fmt.Sprintf(constant.UPLOAD_PROGRESS_KEY_FORMAT, uploadID)
+	err := RedisClient.Set(key, fmt.Sprintf("%d/%d", transferred, total),
+		constant.RESUMABLE_UPLOAD_EXPIRE_HOUR * time.Hour).Err()
+	if err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "SetUploadProgress()"))
+		return false
+	}
+	return true
+}
+
+// Get the bytes transferred & the total bytes of an upload, false if not tracked.
+func GetUploadProgress(uploadID string) (int64, int64, bool) {
+	key := fmt.Sprintf(constant.UPLOAD_PROGRESS_KEY_FORMAT, uploadID)
+	var transferred, total int64
+	if _, err := fmt.Sscanf(RedisClient.Get(key).Val(), "%d/%d", &transferred, &total); err != nil {
+		return 0, 0, false
+	}
+	return transferred, total, true
+}
+
+// Save the fields of a resumable upload.
+func SetResumableUpload(uploadID string, fields map[string]interface{}) bool {
+	key := fmt.Sprintf(constant.RESUMABLE_UPLOAD_KEY_FORMAT, uploadID)
+	pipe := RedisClient.TxPipeline()
+	pipe.HMSet(key, fields)
+	pipe.Expire(key, constant.RESUMABLE_UPLOAD_EXPIRE_HOUR * time.Hour)
+	if _, err := pipe.Exec(); err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "SetResumableUpload()"))
+		return false
+	}
+	return true
+}
+
+// Get all fields of a resumable upload, empty if no such upload.
+func GetResumableUpload(uploadID string) map[string]string {
+	key := fmt.Sprintf(constant.RESUMABLE_UPLOAD_KEY_FORMAT, uploadID)
+	return RedisClient.HGetAll(key).Val()
+}
+
+// Lock a resumable upload so that chunks are never written concurrently, nil if it's locked.
+func LockResumableUpload(uploadID string) *Lock {
+	key := fmt.Sprintf(constant.RESUMABLE_UPLOAD_LOCK_FORMAT, uploadID)
+	return AcquireLock(key, constant.RESUMABLE_UPLOAD_LOCK_MINUTE * time.Minute)
+}
+
+// A lock shared by all instances. It holds a random token, so only its holder can release or extend it,
+// even after it expires & is taken by another instance.
+type Lock struct {
+	key 	string
+	token 	string
+}
+
+// delete the lock only if it still holds the token
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// expire the lock later only if it still holds the token
+var extendLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// Acquire a lock shared by all instances, it's released automatically after the expiration.
+// Nil is returned if the lock is held by others.
+func AcquireLock(key string, expiration time.Duration) *Lock {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "AcquireLock()"))
+		return nil
+	}
+	lock := Lock{key: key, token: hex.EncodeToString(token)}
+	ok, err := RedisClient.SetNX(key, lock.token, expiration).Result()
+	if err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "AcquireLock()"))
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	return &lock
+}
+
+// Release the lock, unless it's expired & taken by others.
+func (lock *Lock) Release() {
+	if err := releaseLockScript.Run(RedisClient, []string{lock.key}, lock.token).Err(); err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "Lock.Release()"))
+	}
+}
+
+// Extend the lock held for a long work, so it's not released automatically in the middle.
+// False is returned if the lock is lost, i.e. it's expired already.
+func (lock *Lock) Extend(expiration time.Duration) bool {
+	extended, err := extendLockScript.Run(RedisClient, []string{lock.key}, lock.token,
+		int64(expiration / time.Millisecond)).Int64()
+	if err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "Lock.Extend()"))
+		return false
+	}
+	return extended == 1
+}
+
+// Keep extending the lock in background while a long work runs, until the returned function is called.
+// It's extended every third of the expiration, & given up once it's lost.
+func (lock *Lock) KeepAlive(expiration time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(expiration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !lock.Extend(expiration) {
+					AppLogger.Info("Lock is lost.", zap.String("service", "Lock.KeepAlive()"),
+						zap.String("key", lock.key))
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// Save the report of the running or the last reindex.
+func SetReindexReport(report string) bool {
+	err := RedisClient.Set(constant.REINDEX_REPORT_KEY, report, 0).Err()
+	if err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "SetReindexReport()"))
 		return false
 	}
 	return true
+}
+
+// Get the report of the running or the last reindex, empty if no reindex has run.
+func GetReindexReport() string {
+	return RedisClient.Get(constant.REINDEX_REPORT_KEY).Val()
+}
+
+// Record the photos changed by the outbox during a reindex.
+func AddReindexChanges(photoIDs []uint) error {
+	members := make([]interface{}, 0, len(photoIDs))
+	for _, photoID := range photoIDs {
+		members = append(members, photoID)
+	}
+	pipe := RedisClient.TxPipeline()
+	pipe.SAdd(constant.REINDEX_CHANGES_KEY, members...)
+	pipe.Expire(constant.REINDEX_CHANGES_KEY, constant.REINDEX_CHANGES_EXPIRE_HOUR * time.Hour)
+	if _, err := pipe.Exec(); err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "AddReindexChanges()"))
+		return err
+	}
+	return nil
+}
+
+// Get the photos changed by the outbox during a reindex.
+func GetReindexChanges() ([]uint, error) {
+	members, err := RedisClient.SMembers(constant.REINDEX_CHANGES_KEY).Result()
+	if err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "GetReindexChanges()"))
+		return nil, err
+	}
+	photoIDs := make([]uint, 0, len(members))
+	for _, member := range members {
+		if photoID, err := strconv.ParseUint(member, 10, 64); err == nil {
+			photoIDs = append(photoIDs, uint(photoID))
+		}
+	}
+	return photoIDs, nil
+}
+
+// Forget the photos changed during the last reindex.
+func ClearReindexChanges() error {
+	if err := RedisClient.Del(constant.REINDEX_CHANGES_KEY).Err(); err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "ClearReindexChanges()"))
+		return err
+	}
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Storage backed by any S3-compatible service, e.g. MinIO, Ceph RGW, AWS S3.
+type S3Storage struct {
+	Client 		*minio.Client
+	BucketName 	string
+	BucketUrl 	string
+}
+
+// Create a S3 storage from the config file.
+func NewS3Storage() *S3Storage {
+	endpoint := conf.ServerCfg.Get(constant.S3_ENDPOINT)
+	bucketName := conf.ServerCfg.Get(constant.S3_BUCKET_NAME)
+	useSSL := conf.ServerCfg.Get(constant.S3_USE_SSL) == "true"
+	pathStyle := conf.ServerCfg.Get(constant.S3_PATH_STYLE) == "true"
+
+	bucketLookup := minio.BucketLookupDNS
+	if pathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+	client, err := minio.NewWithOptions(endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4(conf.ServerCfg.Get(constant.S3_ACCESS_KEY),
+			conf.ServerCfg.Get(constant.S3_SECRET_KEY), ""),
+		Secure: useSSL,
+		Region: conf.ServerCfg.Get(constant.S3_REGION),
+		BucketLookup: bucketLookup,
+	})
+	if err != nil {
+		AppLogger.Fatal(err.Error(), zap.String("service", "NewS3Storage()"))
+	}
+
+	scheme := "http"
+	if useSSL {
+		scheme = "https"
+	}
+	bucketUrl := fmt.Sprintf("%s://%s.%s", scheme, bucketName, endpoint)
+	if pathStyle {
+		bucketUrl = fmt.Sprintf("%s://%s/%s", scheme, endpoint, bucketName)
+	}
+	return &S3Storage{Client: client, BucketName: bucketName, BucketUrl: bucketUrl}
+}
+
+// Upload an object to S3.
+func (s *S3Storage) Put(key string, reader io.Reader, size int64) error {
+	_, err := s.Client.PutObject(s.BucketName, key, reader, size, minio.PutObjectOptions{})
+	return err
+}
+
+// Download an object from S3.
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	object, err := s.Client.GetObject(s.BucketName, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	// GetObject is lazy, stat the object to find out whether it exists
+	if _, err = object.Stat(); err != nil {
+		object.Close()
+		return nil, s3Error(err)
+	}
+	return object, nil
+}
+
+// Download a part of an object from S3.
+// The lazy object of Client.GetObject drops the range once it's stat, request the range directly instead.
+func (s *S3Storage) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	option := minio.GetObjectOptions{}
+	option.Set("Range", httpRange(offset, length))
+	object, _, err := minio.Core{Client: s.Client}.GetObject(s.BucketName, key, option)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return object, nil
+}
+
+// Copy an object within the bucket, S3 copies it on the server side.
+func (s *S3Storage) Copy(srcKey string, dstKey string) error {
+	dst, err := minio.NewDestinationInfo(s.BucketName, dstKey, nil, nil)
+	if err != nil {
+		return err
+	}
+	return s3Error(s.Client.CopyObject(dst, minio.NewSourceInfo(s.BucketName, srcKey, nil)))
+}
+
+// Delete an object from S3.
+func (s *S3Storage) Delete(key string) error {
+	if err := s3Error(s.Client.RemoveObject(s.BucketName, key)); err != ObjectNotExistError {
+		return err
+	}
+	return nil
+}
+
+// Get the meta info of an object in S3, with its SHA-256 checksum if it's uploaded with one.
+func (s *S3Storage) Stat(key string) (*ObjectInfo, error) {
+	option := minio.StatObjectOptions{}
+	option.Set("x-amz-checksum-mode", "ENABLED")
+	object, err := s.Client.StatObject(s.BucketName, key, option)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	info := &ObjectInfo{
+		Key: object.Key,
+		Size: object.Size,
+		ETag: object.ETag,
+		LastModified: object.LastModified,
+	}
+	if checksum, err := base64.StdEncoding.DecodeString(object.Metadata.Get("X-Amz-Checksum-Sha256"));
+		err == nil && len(checksum) == 32 {
+		info.SHA256 = hex.EncodeToString(checksum)
+	}
+	return info, nil
+}
+
+// List objects in S3.
+func (s *S3Storage) List(prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range s.Client.ListObjectsV2(s.BucketName, prefix, true, doneCh) {
+		if object.Err != nil {
+			return objects, object.Err
+		}
+		objects = append(objects, ObjectInfo{
+			Key: object.Key,
+			Size: object.Size,
+			ETag: object.ETag,
+			LastModified: object.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+// List a page of objects in S3, starting after the given key.
+func (s *S3Storage) ListPage(prefix string, after string, limit int) ([]ObjectInfo, error) {
+	result, err := minio.Core{Client: s.Client}.ListObjectsV2(s.BucketName, prefix, "", false, "", limit, after)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]ObjectInfo, 0, len(result.Contents))
+	for _, object := range result.Contents {
+		objects = append(objects, ObjectInfo{
+			Key: object.Key,
+			Size: object.Size,
+			ETag: object.ETag,
+			LastModified: object.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+// Get the url of an object in S3, either path-style or virtual-hosted-style.
+func (s *S3Storage) Url(key string) string {
+	return s.BucketUrl + "/" + key
+}
+
+// Sign a url for uploading an object to S3 directly.
+func (s *S3Storage) PresignPut(key string, expires time.Duration) (string, error) {
+	u, err := s.Client.PresignedPutObject(s.BucketName, key, expires)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// Translate a "not found" S3 error to ObjectNotExistError.
+func s3Error(err error) error {
+	if err != nil && minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+		return ObjectNotExistError
+	}
+	return err
+}
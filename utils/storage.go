@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"errors"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"go.uber.org/zap"
+	"io"
+	"time"
+)
+
+var ObjectNotExistError = errors.New("object does not exist")
+var PresignNotSupportedError = errors.New("presigned upload is not supported by the storage")
+
+// Meta info of an object in the storage.
+type ObjectInfo struct {
+	Key 			string
+	Size 			int64
+	ETag 			string
+	LastModified 	time.Time
+	SHA256 			string	// the SHA-256 checksum in hex if the storage keeps one, e.g. S3 for an object uploaded with it
+}
+
+// The object storage where photo files are saved.
+type Storage interface {
+	// Save an object under the given key.
+	Put(key string, reader io.Reader, size int64) error
+	// Read an object, the caller must close the returned reader.
+	Get(key string) (io.ReadCloser, error)
+	// Read a part of an object starting from offset, a negative length means reading to the end.
+	GetRange(key string, offset int64, length int64) (io.ReadCloser, error)
+	// Copy an object to another key within the storage, the object is not read through the service.
+	Copy(srcKey string, dstKey string) error
+	// Delete an object, deleting a non-existed object is not an error.
+	Delete(key string) error
+	// Get the meta info of an object.
+	Stat(key string) (*ObjectInfo, error)
+	// List all objects whose keys start with the given prefix.
+	List(prefix string) ([]ObjectInfo, error)
+	// List a page of the objects whose keys start with the given prefix & come after the given key,
+	// at most limit objects in the order of their keys. An empty page means no more objects.
+	ListPage(prefix string, after string, limit int) ([]ObjectInfo, error)
+	// Get the url through which an object can be accessed.
+	Url(key string) string
+}
+
+// A storage which can sign urls so that clients upload objects to it directly.
+type Presigner interface {
+	// Get a url through which an object can be uploaded by a PUT request before it expires.
+	PresignPut(key string, expires time.Duration) (string, error)
+}
+
+// the global storage used by the service
+var Store Storage
+
+// Init the storage selected in the config file.
+func init() {
+	storageType := conf.ServerCfg.Get(constant.STORAGE_TYPE)
+	switch storageType {
+	case constant.STORAGE_TYPE_COS:
+		Store = NewCosStorage()
+	case constant.STORAGE_TYPE_S3:
+		Store = NewS3Storage()
+	case constant.STORAGE_TYPE_LOCAL:
+		Store = NewLocalStorage(conf.ServerCfg.Get(constant.LOCAL_STORAGE_ROOT),
+			conf.ServerCfg.Get(constant.LOCAL_STORAGE_URL))
+	default:
+		AppLogger.Fatal("Unknown storage type: " + storageType, zap.String("service", "init()"))
+	}
+}
+
+// Sign a direct upload url for the given key if the storage supports it.
+func PresignPut(key string, expires time.Duration) (string, error) {
+	if presigner, ok := Store.(Presigner); ok {
+		return presigner.PresignPut(key, expires)
+	}
+	return "", PresignNotSupportedError
+}
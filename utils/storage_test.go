@@ -0,0 +1,449 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/tencentyun/cos-go-sdk-v5"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-process fake of an object storage service, it speaks enough of the S3 & COS protocols
+// for the storage clients: PUT (plain, aws-chunked or a copy), GET with a range, HEAD, DELETE & listing.
+type fakeObjectServer struct {
+	mutex 		sync.Mutex
+	bucket 		string	// the first path segment for path-style requests, empty for virtual-hosted-style
+	pageSize 	int		// objects per listing page, small to exercise the pagination
+	objects 	map[string][]byte
+	modTime 	time.Time
+}
+
+func newFakeObjectServer(bucket string) *fakeObjectServer {
+	return &fakeObjectServer{
+		bucket: bucket,
+		pageSize: 2,
+		objects: make(map[string][]byte),
+		modTime: time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+type fakeObject struct {
+	Key 			string
+	LastModified 	string
+	ETag 			string
+	Size 			int
+}
+
+type fakeListResult struct {
+	XMLName 				xml.Name	`xml:"ListBucketResult"`
+	Name 					string
+	Prefix 					string
+	Marker 					string		`xml:",omitempty"`
+	KeyCount 				int
+	MaxKeys 				int
+	IsTruncated 			bool
+	NextContinuationToken 	string		`xml:",omitempty"`
+	Contents 				[]fakeObject
+}
+
+func (s *fakeObjectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if s.bucket != "" {
+		key = strings.TrimPrefix(strings.TrimPrefix(key, s.bucket), "/")
+	}
+	if key == "" && r.Method == http.MethodGet {
+		s.list(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source") + r.Header.Get("X-Cos-Copy-Source");source != "" {
+			s.copy(w, r, source, key)
+			return
+		}
+		var body io.Reader = r.Body
+		if r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+			body = decodeAwsChunked(r.Body)
+		}
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = content
+		w.Header().Set("ETag", s.etag(content))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		content, ok := s.objects[key]
+		if !ok {
+			s.notFound(w, r)
+			return
+		}
+		status := http.StatusOK
+		start, end := 0, len(content) - 1
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			bounds := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)
+			start, _ = strconv.Atoi(bounds[0])
+			if bounds[1] != "" {
+				end, _ = strconv.Atoi(bounds[1])
+			}
+			if end >= len(content) {
+				end = len(content) - 1
+			}
+			status = http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(end - start + 1))
+		w.Header().Set("ETag", s.etag(content))
+		w.Header().Set("Last-Modified", s.modTime.Format(http.TimeFormat))
+		if r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" {
+			checksum := sha256.Sum256(content)
+			w.Header().Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(checksum[:]))
+		}
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(content[start:end + 1])
+		}
+	case http.MethodDelete:
+		if _, ok := s.objects[key]; !ok {
+			s.notFound(w, r)
+			return
+		}
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Copy an object, the source is "<bucket>/<key>" for S3 & "<host>/<key>" for COS, escaped.
+func (s *fakeObjectServer) copy(w http.ResponseWriter, r *http.Request, source string, key string) {
+	source, _ = url.PathUnescape(source)
+	parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	content, ok := s.objects[parts[len(parts) - 1]]
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+	s.objects[key] = content
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>",
+		s.etag(content), s.modTime.Format(time.RFC3339))
+}
+
+// List the objects after the continuation token (v2) or the marker (v1), a page at a time.
+func (s *fakeObjectServer) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	after := query.Get("marker")
+	if query.Get("list-type") == "2" {
+		after = query.Get("continuation-token")
+		if after == "" {
+			after = query.Get("start-after")
+		}
+	}
+
+	keys := make([]string, 0)
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pageSize := s.pageSize
+	if maxKeys, err := strconv.Atoi(query.Get("max-keys")); err == nil && maxKeys < pageSize {
+		pageSize = maxKeys
+	}
+	result := fakeListResult{Name: s.bucket, Prefix: prefix, Marker: query.Get("marker"), MaxKeys: pageSize}
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys) - 1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, fakeObject{
+			Key: key,
+			LastModified: s.modTime.Format(time.RFC3339),
+			ETag: s.etag(s.objects[key]),
+			Size: len(s.objects[key]),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(&result)
+}
+
+func (s *fakeObjectServer) notFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+	}
+}
+
+func (s *fakeObjectServer) etag(content []byte) string {
+	return fmt.Sprintf("\"%x\"", len(content))
+}
+
+// Decode a body signed chunk by chunk: "<hex size>;chunk-signature=<signature>\r\n<data>\r\n" ... a 0-sized chunk.
+func decodeAwsChunked(body io.Reader) io.Reader {
+	reader := bufio.NewReader(body)
+	decoded := bytes.Buffer{}
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(header), ";", 2)[0], 16, 64)
+		if err != nil || size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&decoded, reader, size); err != nil {
+			break
+		}
+		reader.ReadString('\n')
+	}
+	return &decoded
+}
+
+// Run the same cases against a storage implementation, the cases depend on each other & run in order.
+func testStorage(t *testing.T, store Storage) {
+	content := []byte("0123456789abcdef")
+	keys := []string{"blobs/ab/1", "blobs/ab/2", "blobs/cd/3", "derivatives/ab/1"}
+
+	for _, key := range keys {
+		if err := store.Put(key, bytes.NewReader(content), int64(len(content))); err != nil {
+			t.Fatalf("Put(%q) failed: %v", key, err)
+		}
+	}
+
+	readCases := []struct {
+		name 	string
+		offset 	int64
+		length 	int64
+		want 	string
+	}{
+		{"whole object", 0, -1, "0123456789abcdef"},
+		{"head", 0, 4, "0123"},
+		{"middle", 5, 3, "567"},
+		{"to the end", 10, -1, "abcdef"},
+		{"last byte", 15, 1, "f"},
+	}
+	for _, c := range readCases {
+		reader, err := store.GetRange(keys[0], c.offset, c.length)
+		if err != nil {
+			t.Errorf("%s: GetRange() failed: %v", c.name, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(got) != c.want {
+			t.Errorf("%s: GetRange() = %q, %v, want %q", c.name, got, err, c.want)
+		}
+	}
+
+	reader, err := store.Get(keys[0])
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	got, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if !bytes.Equal(got, content) {
+		t.Errorf("Get() = %q, want %q", got, content)
+	}
+
+	info, err := store.Stat(keys[0])
+	if err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+	if info.Size != int64(len(content)) || info.ETag == "" || info.LastModified.IsZero() {
+		t.Errorf("Stat() = %+v, want size %d with an etag & a modify time", info, len(content))
+	}
+
+	listCases := []struct {
+		prefix 	string
+		want 	[]string
+	}{
+		{"blobs/", keys[:3]},
+		{"blobs/ab/", keys[:2]},
+		{"derivatives/", keys[3:]},
+		{"renders/", []string{}},
+		{"", keys},
+	}
+	for _, c := range listCases {
+		objects, err := store.List(c.prefix)
+		if err != nil {
+			t.Errorf("List(%q) failed: %v", c.prefix, err)
+			continue
+		}
+		listed := make([]string, 0)
+		for _, object := range objects {
+			listed = append(listed, object.Key)
+			if object.Size != int64(len(content)) {
+				t.Errorf("List(%q): size of %q = %d, want %d", c.prefix, object.Key, object.Size, len(content))
+			}
+		}
+		sort.Strings(listed)
+		if strings.Join(listed, ",") != strings.Join(c.want, ",") {
+			t.Errorf("List(%q) = %v, want %v", c.prefix, listed, c.want)
+		}
+	}
+
+	for _, limit := range []int{1, 2, 3} {
+		listed := make([]string, 0)
+		for after := "";; {
+			objects, err := store.ListPage("blobs/", after, limit)
+			if err != nil || len(objects) > limit {
+				t.Errorf("ListPage(%q, %d) = %d objects, %v", after, limit, len(objects), err)
+				break
+			}
+			if len(objects) == 0 {
+				break
+			}
+			for _, object := range objects {
+				listed = append(listed, object.Key)
+			}
+			after = objects[len(objects) - 1].Key
+		}
+		if strings.Join(listed, ",") != strings.Join(keys[:3], ",") {
+			t.Errorf("ListPage() by %d = %v, want %v", limit, listed, keys[:3])
+		}
+	}
+
+	if err := store.Copy(keys[0], "blobs/ef/5"); err != nil {
+		t.Fatalf("Copy() failed: %v", err)
+	}
+	if reader, err := store.Get("blobs/ef/5"); err != nil {
+		t.Errorf("Get() of a copy failed: %v", err)
+	} else {
+		got, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if !bytes.Equal(got, content) {
+			t.Errorf("Get() of a copy = %q, want %q", got, content)
+		}
+	}
+	if err := store.Copy("blobs/ef/none", "blobs/ef/6"); err != ObjectNotExistError {
+		t.Errorf("Copy() of a non-existed object = %v, want ObjectNotExistError", err)
+	}
+
+	if err := store.Delete(keys[0]); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	if err := store.Delete(keys[0]); err != nil {
+		t.Errorf("Delete() of a deleted object = %v, want nil", err)
+	}
+	if _, err := store.Get(keys[0]); err != ObjectNotExistError {
+		t.Errorf("Get() of a deleted object = %v, want ObjectNotExistError", err)
+	}
+	if _, err := store.GetRange(keys[0], 1, 2); err != ObjectNotExistError {
+		t.Errorf("GetRange() of a deleted object = %v, want ObjectNotExistError", err)
+	}
+	if _, err := store.Stat(keys[0]); err != ObjectNotExistError {
+		t.Errorf("Stat() of a deleted object = %v, want ObjectNotExistError", err)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "local-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	store := NewLocalStorage(root, "http://localhost/files/")
+	testStorage(t, store)
+
+	if url := store.Url("blobs/ab/1"); url != "http://localhost/files/blobs/ab/1" {
+		t.Errorf("Url() = %q", url)
+	}
+	// keys never escape from the root
+	if err := store.Put("../../escaped", strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped")); err != nil {
+		t.Errorf("object is not saved under the root: %v", err)
+	}
+	if err := store.Put("short", strings.NewReader("x"), 2); err == nil {
+		t.Errorf("Put() of a short object succeeded")
+	}
+	if _, err := store.Stat("short"); err != ObjectNotExistError {
+		t.Errorf("Stat() of a short object = %v, want ObjectNotExistError", err)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	server := httptest.NewServer(newFakeObjectServer("photos"))
+	defer server.Close()
+
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+	client, err := minio.NewWithOptions(endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4("access", "secret", ""),
+		Secure: false,
+		Region: "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &S3Storage{Client: client, BucketName: "photos", BucketUrl: server.URL + "/photos"}
+	testStorage(t, store)
+
+	// the fake keeps the checksum of every object
+	if info, err := store.Stat("blobs/ab/2"); err != nil ||
+		info.SHA256 != fmt.Sprintf("%x", sha256.Sum256([]byte("0123456789abcdef"))) {
+		t.Errorf("Stat() = %+v, %v, want the SHA-256 checksum", info, err)
+	}
+
+	presigned, err := store.PresignPut("blobs/ab/1", time.Minute)
+	if err != nil {
+		t.Fatalf("PresignPut() failed: %v", err)
+	}
+	if u, _ := url.Parse(presigned); u == nil || u.Path != "/photos/blobs/ab/1" || u.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("PresignPut() = %q, want a signed url of the object", presigned)
+	}
+}
+
+func TestCosStorage(t *testing.T) {
+	server := httptest.NewServer(newFakeObjectServer(""))
+	defer server.Close()
+
+	bucketUrl, _ := url.Parse(server.URL)
+	client := cos.NewClient(&cos.BaseURL{BucketURL: bucketUrl}, &http.Client{
+		Transport: &cos.AuthorizationTransport{SecretID: "id", SecretKey: "key"},
+	})
+	store := &CosStorage{Client: client, BucketUrl: server.URL, SecretID: "id", SecretKey: "key"}
+	testStorage(t, store)
+
+	presigned, err := store.PresignPut("blobs/ab/1", time.Minute)
+	if err != nil {
+		t.Fatalf("PresignPut() failed: %v", err)
+	}
+	if u, _ := url.Parse(presigned); u == nil || u.Path != "/blobs/ab/1" || !strings.Contains(u.Query().Get("sign"), "q-signature=") {
+		t.Errorf("PresignPut() = %q, want a signed url of the object", presigned)
+	}
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// upload a photo to the storage, the file is closed after uploading
+// The file is spooled on disk & an upload job is queued, so the upload survives restarts & is retried on failure.
+// If the job can't be queued, an error is returned & the photo is never stored.
+func Upload(photoID uint, fileName string, file io.ReadCloser, fileSize int) (string, error) {
+	uploadID := fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, photoID)
+
+	// set upload status in redis
+	if !SetUploadStatus(uploadID, 1) {
+		AppLogger.Info("Fail to set upload status before upload.", zap.String("service", "Upload()"))
+	}
+
+	job := UploadJob{PhotoID: photoID, Key: fileName, Size: int64(fileSize)}
+	spoolPath, err := spoolUpload(uploadID, file)
+	if err == nil {
+		job.SpoolPath = spoolPath
+		err = EnqueueUpload(&job)
+	}
+	if err == nil {
+		PublishUploadProgress(&UploadProgress{UploadID: uploadID, Stage: UploadReceived, Total: job.Size})
+	}
+	if err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "Upload()"))
+		job.LastError = err.Error()
+		FailUpload(&job)
+		return uploadID, err
+	}
+	return uploadID, nil
+}
+
+// Save the file of an upload in the spool dir, the file is closed afterwards.
+func spoolUpload(uploadID string, file io.ReadCloser) (string, error) {
+	defer file.Close()
+
+	spoolDir := conf.ServerCfg.Get(constant.UPLOAD_SPOOL_DIR)
+	if err := os.MkdirAll(spoolDir, 0755); err != nil {
+		return "", err
+	}
+	spoolPath := filepath.Join(spoolDir, uploadID)
+	spool, err := os.Create(spoolPath)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(spool, file)
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(spoolPath)
+		return "", err
+	}
+	return spoolPath, nil
+}
+
+// upload the spooled file of a job to the storage, it's called by the upload workers
+// The spooled file is kept until the result is applied to the photo.
+func AsyncUpload(job *UploadJob) error {
+	progress := UploadProgress{
+		UploadID: fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, job.PhotoID),
+		Stage: UploadReceived,
+		Total: job.Size,
+		Attempts: job.Attempts,
+		Error: job.LastError,
+	}
+	file, err := os.Open(job.SpoolPath)
+	if os.IsNotExist(err) {
+		// the job runs again after the file is stored, e.g. the instance stopped before acking it
+		if _, statErr := Store.Stat(job.Key); statErr != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		defer file.Close()
+
+		// upload the photo to the storage, tracking the bytes sent
+		reader := newProgressReader(bufio.NewReader(file), progress)
+		if err := Store.Put(job.Key, reader, job.Size); err != nil {
+			return err
+		}
+	}
+	progress.Stage = UploadStored
+	progress.Transferred = job.Size
+	progress.Error = ""	// the url is published once it's updated, it's not the stored one if the photo is shared stripped
+	PublishUploadProgress(&progress)
+	return nil
+}
+
+// Give up an upload, its spooled file is removed & the failure is published.
+func FailUpload(job *UploadJob) {
+	if job.SpoolPath != "" {
+		os.Remove(job.SpoolPath)
+	}
+	PublishUploadProgress(&UploadProgress{
+		UploadID: fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, job.PhotoID),
+		Stage: UploadFailed,
+		Attempts: job.Attempts,
+		Error: job.LastError,
+	})
+}
@@ -0,0 +1,384 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"gin-photo-storage/conf"
+	"gin-photo-storage/constant"
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upload jobs are kept in a redis stream read by a consumer group, so every job is taken by one worker,
+// & a job stays pending until it's acked, even if the instance stops in the middle of it.
+// The files of the jobs are spooled on the local disk, so every instance has a stream of its own,
+// named by UPLOAD_INSTANCE_ID (the hostname if it's empty), which must stay the same across restarts
+// for the jobs left by a stopped instance to run again.
+// A failed job waits in a sorted set scored by the time of its next attempt,
+// it's moved to the dead letter stream once it runs out of attempts.
+// The result of a job is applied to its photo before the job is acked, so it's never lost either.
+
+// An upload job, its file is spooled on disk until it's stored.
+type UploadJob struct {
+	EntryID 	string	`json:"entry_id,omitempty"`	// the id of the stream entry, set when the job is read
+	PhotoID 	uint	`json:"photo_id"`
+	Key 		string	`json:"key"`
+	SpoolPath 	string	`json:"spool_path"`
+	Size 		int64	`json:"size"`
+	Attempts 	int		`json:"attempts"`
+	LastError 	string	`json:"last_error,omitempty"`
+	FailedAt 	int64	`json:"failed_at,omitempty"`
+}
+
+// Applies the results of upload jobs to their photos.
+// An error leaves the job pending, & the job runs again.
+type UploadResultHandler interface {
+	// The file of a job is stored.
+	UploadStored(job *UploadJob) error
+	// A job is given up after all its attempts.
+	UploadFailed(job *UploadJob) error
+}
+
+// The numbers of upload jobs in each stage.
+type UploadQueueStats struct {
+	Queued 		int64	`json:"queued"`
+	Retrying 	int64	`json:"retrying"`
+	Failed 		int64	`json:"failed"`
+}
+
+// Move the failed jobs which are due to the stream, atomically so a job is never lost or doubled.
+var retryScript = redis.NewScript(`
+local jobs = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, job in ipairs(jobs) do
+	redis.call('XADD', KEYS[2], '*', 'job', job)
+	redis.call('ZREM', KEYS[1], job)
+end
+return #jobs
+`)
+
+// Get the id of this instance among the upload workers, the resumable uploads spooled here are tagged with it.
+func UploadInstance() string {
+	if instance := conf.ServerCfg.Get(constant.UPLOAD_INSTANCE_ID); instance != "" {
+		return instance
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// Get the job stream of an instance.
+func uploadJobStream(instance string) string {
+	return fmt.Sprintf(constant.UPLOAD_JOB_STREAM_FORMAT, instance)
+}
+
+// Get the retry set of an instance.
+func uploadJobRetryKey(instance string) string {
+	return fmt.Sprintf(constant.UPLOAD_JOB_RETRY_KEY_FORMAT, instance)
+}
+
+// Add an upload job to the queue of this instance, which has its file.
+func EnqueueUpload(job *UploadJob) error {
+	job.EntryID = ""
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return RedisClient.XAdd(&redis.XAddArgs{
+		Stream: uploadJobStream(UploadInstance()),
+		Values: map[string]interface{}{"job": string(encoded)},
+	}).Err()
+}
+
+// Run the upload workers in background, the number of workers bounds the concurrent uploads of the instance.
+// The results of the jobs are applied by the given handler.
+func RunUploadWorkers(results UploadResultHandler) {
+	instance := UploadInstance()
+	stream := uploadJobStream(instance)
+	err := RedisClient.XGroupCreateMkStream(stream, constant.UPLOAD_JOB_GROUP, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {	// the group exists already
+		AppLogger.Info(err.Error(), zap.String("service", "RunUploadWorkers()"))
+		return
+	}
+	// the instances are remembered for the stats
+	if err := RedisClient.SAdd(constant.UPLOAD_JOB_INSTANCES_KEY, instance).Err(); err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "RunUploadWorkers()"))
+	}
+
+	workers, _ := strconv.Atoi(conf.ServerCfg.Get(constant.UPLOAD_WORKERS))
+	if workers < 1 {
+		workers = 1
+	}
+	hostname, _ := os.Hostname()
+	consumer := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+
+	// the jobs are passed without a buffer, so no more jobs are taken than the workers can run
+	jobs := make(chan *UploadJob)
+	for i := 0;i < workers;i++ {
+		go func() {
+			for job := range jobs {
+				runUploadJob(instance, consumer, job, results)
+			}
+		}()
+	}
+	go readUploadJobs(stream, consumer, jobs)
+	go claimStaleUploadJobs(stream, consumer, jobs)
+	go scheduleUploadRetries(instance)
+}
+
+// Read new jobs of the stream for the workers.
+func readUploadJobs(stream string, consumer string, jobs chan<- *UploadJob) {
+	for {
+		streams, err := RedisClient.XReadGroup(&redis.XReadGroupArgs{
+			Group: constant.UPLOAD_JOB_GROUP,
+			Consumer: consumer,
+			Streams: []string{stream, ">"},
+			Count: 1,
+			Block: constant.UPLOAD_JOB_BLOCK_SECOND * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue	// no new job
+		}
+		if err != nil {
+			AppLogger.Info(err.Error(), zap.String("service", "readUploadJobs()"))
+			time.Sleep(constant.UPLOAD_JOB_BLOCK_SECOND * time.Second)
+			continue
+		}
+		for _, result := range streams {
+			for _, message := range result.Messages {
+				if job := decodeUploadJob(stream, message); job != nil {
+					jobs <- job
+				}
+			}
+		}
+	}
+}
+
+// Take over the jobs pending too long, which are left by a stopped process of the instance.
+func claimStaleUploadJobs(stream string, consumer string, jobs chan<- *UploadJob) {
+	claimIdle := constant.UPLOAD_JOB_CLAIM_MINUTE * time.Minute
+	for {
+		pending, err := RedisClient.XPendingExt(&redis.XPendingExtArgs{
+			Stream: stream,
+			Group: constant.UPLOAD_JOB_GROUP,
+			Start: "-",
+			End: "+",
+			Count: 100,
+		}).Result()
+		if err != nil {
+			AppLogger.Info(err.Error(), zap.String("service", "claimStaleUploadJobs()"))
+		}
+
+		ids := make([]string, 0)
+		for _, entry := range pending {
+			if entry.Idle >= claimIdle {
+				ids = append(ids, entry.Id)
+			}
+		}
+		if len(ids) > 0 {
+			// only the entries still idle are claimed, so two instances never claim the same one
+			messages, err := RedisClient.XClaim(&redis.XClaimArgs{
+				Stream: stream,
+				Group: constant.UPLOAD_JOB_GROUP,
+				Consumer: consumer,
+				MinIdle: claimIdle,
+				Messages: ids,
+			}).Result()
+			if err != nil {
+				AppLogger.Info(err.Error(), zap.String("service", "claimStaleUploadJobs()"))
+			}
+			for _, message := range messages {
+				if job := decodeUploadJob(stream, message); job != nil {
+					jobs <- job
+				}
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// Requeue the failed jobs of the instance when their next attempts are due.
+func scheduleUploadRetries(instance string) {
+	for {
+		err := retryScript.Run(RedisClient, []string{uploadJobRetryKey(instance), uploadJobStream(instance)},
+			time.Now().Unix()).Err()
+		if err != nil && err != redis.Nil {
+			AppLogger.Info(err.Error(), zap.String("service", "scheduleUploadRetries()"))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Decode the job of a stream entry, a broken entry is dropped.
+func decodeUploadJob(stream string, message redis.XMessage) *UploadJob {
+	job := UploadJob{}
+	encoded, _ := message.Values["job"].(string)
+	if err := json.Unmarshal([]byte(encoded), &job); err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "decodeUploadJob()"))
+		ackUploadJob(stream, message.ID)
+		return nil
+	}
+	job.EntryID = message.ID
+	return &job
+}
+
+// Run an upload job, its result is applied before it's acked.
+// A failed job is retried later with an exponential backoff, or given up once it runs out of attempts.
+// A lost file is retried as well, it may be back once the disk is, & the job is given up in the end anyway.
+func runUploadJob(instance string, consumer string, job *UploadJob, results UploadResultHandler) {
+	stream := uploadJobStream(instance)
+	stop := keepUploadJob(stream, consumer, job.EntryID)
+	defer stop()
+
+	err := AsyncUpload(job)
+	if err == nil {
+		err = results.UploadStored(job)
+	}
+	if err == nil {
+		os.Remove(job.SpoolPath)
+		ackUploadJob(stream, job.EntryID)
+		return
+	}
+
+	AppLogger.Info(err.Error(), zap.String("service", "runUploadJob()"),
+		zap.Uint("photo_id", job.PhotoID), zap.Int("attempts", job.Attempts + 1))
+	entryID := job.EntryID
+	job.EntryID = ""
+	job.Attempts++
+	job.LastError = err.Error()
+	maxAttempts, _ := strconv.Atoi(conf.ServerCfg.Get(constant.UPLOAD_MAX_ATTEMPTS))
+
+	// the job is saved before it's acked, so it's never lost if the instance stops in between
+	if job.Attempts < maxAttempts {
+		encoded, _ := json.Marshal(job)
+		retryAt := time.Now().Add(uploadRetryDelay(job.Attempts))
+		err = RedisClient.ZAdd(uploadJobRetryKey(instance),
+			redis.Z{Score: float64(retryAt.Unix()), Member: string(encoded)}).Err()
+		PublishUploadProgress(&UploadProgress{
+			UploadID: fmt.Sprintf(constant.PHOTO_UPDATE_ID_FORMAT, job.PhotoID),
+			Stage: UploadReceived,
+			Total: job.Size,
+			Attempts: job.Attempts,
+			Error: job.LastError,
+		})
+	} else if err = results.UploadFailed(job); err == nil {
+		job.FailedAt = time.Now().Unix()
+		encoded, _ := json.Marshal(job)
+		err = RedisClient.XAdd(&redis.XAddArgs{
+			Stream: constant.UPLOAD_JOB_DEAD_STREAM,
+			MaxLenApprox: constant.UPLOAD_JOB_DEAD_MAX_LEN,
+			Values: map[string]interface{}{"job": string(encoded)},
+		}).Err()
+		FailUpload(job)
+	}
+	if err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "runUploadJob()"))
+		return	// left pending, the job is claimed again later
+	}
+	ackUploadJob(stream, entryID)
+}
+
+// Keep a running job from being claimed as a stale one, by resetting its idle time in background
+// until the returned function is called.
+func keepUploadJob(stream string, consumer string, entryID string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(constant.UPLOAD_JOB_CLAIM_MINUTE * time.Minute / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// claiming its own entry again resets the idle time, & the entry is kept by this consumer
+				err := RedisClient.XClaimJustID(&redis.XClaimArgs{
+					Stream: stream,
+					Group: constant.UPLOAD_JOB_GROUP,
+					Consumer: consumer,
+					MinIdle: 0,
+					Messages: []string{entryID},
+				}).Err()
+				if err != nil {
+					AppLogger.Info(err.Error(), zap.String("service", "keepUploadJob()"))
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// Get the delay before the next attempt of a job, doubled after each attempt.
+func uploadRetryDelay(attempts int) time.Duration {
+	delay := constant.UPLOAD_RETRY_BASE_SECOND * time.Second
+	for i := 1;i < attempts && delay < constant.UPLOAD_RETRY_MAX_SECOND * time.Second;i++ {
+		delay *= 2
+	}
+	if delay > constant.UPLOAD_RETRY_MAX_SECOND * time.Second {
+		delay = constant.UPLOAD_RETRY_MAX_SECOND * time.Second
+	}
+	return delay
+}
+
+// Ack a finished job & remove it from the stream.
+func ackUploadJob(stream string, entryID string) {
+	pipe := RedisClient.TxPipeline()
+	pipe.XAck(stream, constant.UPLOAD_JOB_GROUP, entryID)
+	pipe.XDel(stream, entryID)
+	if _, err := pipe.Exec(); err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "ackUploadJob()"))
+	}
+}
+
+// Get the jobs which have run out of attempts, the latest ones first.
+func GetFailedUploadJobs(offset int, count int) ([]UploadJob, error) {
+	messages, err := RedisClient.XRevRangeN(constant.UPLOAD_JOB_DEAD_STREAM, "+", "-", int64(offset + count)).Result()
+	if err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "GetFailedUploadJobs()"))
+		return nil, err
+	}
+
+	jobs := make([]UploadJob, 0, count)
+	for i := offset;i < len(messages);i++ {
+		job := UploadJob{}
+		encoded, _ := messages[i].Values["job"].(string)
+		if err := json.Unmarshal([]byte(encoded), &job); err != nil {
+			continue
+		}
+		job.EntryID = messages[i].ID
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Get the numbers of queued, retrying & failed upload jobs of all instances.
+func GetUploadQueueStats() (UploadQueueStats, error) {
+	instances, err := RedisClient.SMembers(constant.UPLOAD_JOB_INSTANCES_KEY).Result()
+	if err != nil {
+		AppLogger.Info(err.Error(), zap.String("service", "GetUploadQueueStats()"))
+		return UploadQueueStats{}, err
+	}
+
+	pipe := RedisClient.Pipeline()
+	queued := make([]*redis.IntCmd, 0, len(instances))
+	retrying := make([]*redis.IntCmd, 0, len(instances))
+	for _, instance := range instances {
+		queued = append(queued, pipe.XLen(uploadJobStream(instance)))
+		retrying = append(retrying, pipe.ZCard(uploadJobRetryKey(instance)))
+	}
+	failed := pipe.XLen(constant.UPLOAD_JOB_DEAD_STREAM)
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		AppLogger.Info(err.Error(), zap.String("service", "GetUploadQueueStats()"))
+		return UploadQueueStats{}, err
+	}
+
+	stats := UploadQueueStats{Failed: failed.Val()}
+	for i := range instances {
+		stats.Queued += queued[i].Val()
+		stats.Retrying += retrying[i].Val()
+	}
+	return stats, nil
+}
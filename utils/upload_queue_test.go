@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUploadRetryDelay(t *testing.T) {
+	cases := []struct {
+		attempts 	int
+		want 		time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{8, 1280 * time.Second},
+		{9, 30 * time.Minute},
+		{1000, 30 * time.Minute},
+	}
+	for _, c := range cases {
+		if got := uploadRetryDelay(c.attempts); got != c.want {
+			t.Errorf("uploadRetryDelay(%d) = %v, want %v", c.attempts, got, c.want)
+		}
+	}
+}